@@ -0,0 +1,144 @@
+package main
+
+// 接口调用凭证管理, 钉钉/企业微信/飞书的access_token都有有效期(一般7200秒)
+// 按接口返回的有效秒数记录过期时间, 后台协程在过期前主动刷新, 扫码请求不用等刷新
+// 同一时间只发一个刷新请求, 并发的请求等它的结果
+// token存在sessionStore的access_token桶, redis模式下多个实例共用一个token
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const accessTokenRefreshAhead = 600 // 过期前多少秒主动刷新
+
+type AccessTokenManager struct {
+	name    string
+	fetch   func() (string, int64, error) // 调接口获取新token, 返回token和有效秒数
+	mutex   sync.Mutex
+	token   string
+	expired int64            // 过期时间戳
+	call    *accessTokenCall // 正在进行的刷新
+}
+
+type accessTokenCall struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+type accessTokenRecord struct {
+	Token   string `json:"access_token"`
+	Expired int64  `json:"expired"`
+}
+
+var accessTokenManagers []*AccessTokenManager
+
+func NewAccessTokenManager(name string, fetch func() (string, int64, error)) *AccessTokenManager {
+	m := &AccessTokenManager{name: name, fetch: fetch}
+	accessTokenManagers = append(accessTokenManagers, m)
+	return m
+}
+
+// 取当前有效的token, 过期或者没有就刷新
+func (m *AccessTokenManager) Get() (string, error) {
+	now := time.Now().Unix()
+	m.mutex.Lock()
+	if m.token != "" && now < m.expired-60 {
+		token := m.token
+		m.mutex.Unlock()
+		return token, nil
+	}
+	m.mutex.Unlock()
+
+	if record, ok := m.loadStored(); ok && now < record.Expired-60 {
+		return record.Token, nil
+	}
+	return m.Refresh("")
+}
+
+// 其它实例刷新过的token, 比自己的新就换成它
+func (m *AccessTokenManager) loadStored() (accessTokenRecord, bool) {
+	var record accessTokenRecord
+	b, ok := sessionStore.Load("access_token", m.name)
+	if !ok || json.Unmarshal(b, &record) != nil || record.Token == "" {
+		return record, false
+	}
+	m.mutex.Lock()
+	if record.Expired > m.expired {
+		m.token = record.Token
+		m.expired = record.Expired
+	}
+	m.mutex.Unlock()
+	return record, true
+}
+
+// 重新获取token, stale是调用方发现已经失效的token, 别的请求已经换过了就直接用新的
+func (m *AccessTokenManager) Refresh(stale string) (string, error) {
+	m.mutex.Lock()
+	if stale != "" && m.token != "" && m.token != stale {
+		token := m.token
+		m.mutex.Unlock()
+		return token, nil
+	}
+	if call := m.call; call != nil {
+		m.mutex.Unlock()
+		<-call.done
+		return call.token, call.err
+	}
+	call := &accessTokenCall{done: make(chan struct{})}
+	m.call = call
+	m.mutex.Unlock()
+
+	token, expiresIn, err := m.fetch()
+	if expiresIn <= 0 {
+		expiresIn = 7200
+	}
+
+	if err == nil {
+		metricTokenRefreshes.Inc(m.name, "ok")
+	} else {
+		metricTokenRefreshes.Inc(m.name, "error")
+	}
+
+	m.mutex.Lock()
+	if err == nil {
+		m.token = token
+		m.expired = time.Now().Unix() + expiresIn
+		b, _ := json.Marshal(accessTokenRecord{Token: token, Expired: m.expired})
+		sessionStore.Store("access_token", m.name, b, m.expired)
+		loger.Println("------------------", m.name, "accessToken refresh, expires in", expiresIn)
+	}
+	call.token, call.err = token, err
+	m.call = nil
+	m.mutex.Unlock()
+	close(call.done)
+	return token, err
+}
+
+// 用过的token快过期时提前刷新, 没用过的(没有开启的身份提供方)不管
+func (m *AccessTokenManager) refreshLoop() {
+	if !loopSleep(time.Second * 60) {
+		return
+	}
+	defer loopDone()
+
+	m.mutex.Lock()
+	expired := m.expired
+	m.mutex.Unlock()
+	if expired > 0 && time.Now().Unix() >= expired-accessTokenRefreshAhead {
+		if record, ok := m.loadStored(); !ok || time.Now().Unix() >= record.Expired-accessTokenRefreshAhead {
+			if _, err := m.Refresh(""); err != nil {
+				loger.Println(m.name, "accessToken refresh error:", err.Error())
+			}
+		}
+	}
+	go m.refreshLoop()
+}
+
+func startAccessTokenRefresh() {
+	for _, m := range accessTokenManagers {
+		go m.refreshLoop()
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+// 审计日志
+// 登录相关的每个事件写一行json到 ./logs/年-月_audit.jsonl, 和钉钉接口返回等调试日志分开, 安全部门排查时按用户/时间/事件类型查询
+// correlation_id 由ticket哈希得到, 同一次扫码从打开扫码页到业务方fetch的所有事件都是同一个, 日志里不保存ticket原文
+// 查询接口 audit_url 和管理后台一样只允许127.0.0.1访问
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	AuditScanStarted        = "scan_started"        // 打开扫码页, 生成ticket
+	AuditCodeExchanged      = "code_exchanged"      // 扫码回调的code换到了扫码人身份
+	AuditUserNotFound       = "user_not_found"      // 扫码人不在通讯录
+	AuditUserInactive       = "user_inactive"       // 扫码人已离职/停用
+	AuditLoginFailed        = "login_failed"        // 其它原因登录失败, 看err_code
+	AuditTwoFactorChallenge = "2fa_challenged"      // 要求二次认证
+	AuditTwoFactorPassed    = "2fa_passed"          // 二次认证通过
+	AuditTwoFactorFailed    = "2fa_failed"          // 二次认证失败
+	AuditSessionReused      = "session_reused"      // 单点登录会话有效, 没有扫码直接生成ticket
+	AuditTicketIssued       = "ticket_issued"       // 登录成功, ticket可以用了
+	AuditTicketFetched      = "ticket_fetched"      // 业务方用ticket取到了用户信息
+	AuditTicketFetchFailed  = "ticket_fetch_failed" // 业务方用ticket取用户信息失败, 看err_code
+	AuditTicketRenewed      = "ticket_renewed"      // 业务方续期ticket
+	AuditTicketRevoked      = "ticket_revoked"      // ticket被删除(离职/管理员操作)
+	AuditAdminAction        = "admin_action"        // 管理后台和管理接口的操作
+	AuditSourceBlocked      = "source_blocked"      // 调用方ip fetch失败太多被屏蔽
+)
+
+type AuditEvent struct {
+	Time          string `json:"time"`
+	Event         string `json:"event"`
+	CorrelationId string `json:"correlation_id"`
+	UserId        string `json:"user_id,omitempty"`
+	UserName      string `json:"user_name,omitempty"`
+	Provider      string `json:"provider,omitempty"`
+	App           string `json:"app,omitempty"` // 业务方client_id, oidc/saml/cas发起的是 oidc:client_id 这种
+	Ip            string `json:"ip,omitempty"`
+	UserAgent     string `json:"user_agent,omitempty"`
+	ErrCode       string `json:"err_code,omitempty"`
+	Detail        string `json:"detail,omitempty"`
+}
+
+type AuditWriter struct {
+	mutex    sync.Mutex
+	fd       *os.File
+	fileName string
+}
+
+var auditWriter = &AuditWriter{}
+
+func auditFileName(t time.Time) string {
+	return "./logs/" + t.Format("2006-01") + "_audit.jsonl"
+}
+
+// ticket不能写到日志里, 用它的哈希关联同一次登录的所有事件
+func auditCorrelationId(ticket string) string {
+	if ticket == "" {
+		return GetRandomStr(16)
+	}
+	sum := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (a *AuditWriter) Write(event AuditEvent) {
+	now := time.Now()
+	event.Time = now.Format("2006-01-02T15:04:05.000Z07:00")
+	if event.CorrelationId == "" {
+		event.CorrelationId = GetRandomStr(16)
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if fileName := auditFileName(now); fileName != a.fileName { // 按月换文件
+		fd, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			loger.Println("audit log open error:", err.Error())
+			return
+		}
+		if a.fd != nil {
+			a.fd.Close()
+		}
+		a.fd = fd
+		a.fileName = fileName
+	}
+	a.fd.Write(append(b, '\n'))
+}
+
+func (a *AuditWriter) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.fd == nil {
+		return nil
+	}
+	err := a.fd.Close()
+	a.fd = nil
+	a.fileName = ""
+	return err
+}
+
+func audit(event AuditEvent) {
+	observeAuditEvent(event)
+	auditWriter.Write(event)
+}
+
+// 登录失败按错误编号归类
+func auditLoginError(err error, ticket string, provider string, userId string, userIp string, userAgent string) {
+	event := AuditEvent{Event: AuditLoginFailed, CorrelationId: auditCorrelationId(ticket), UserId: userId, Provider: provider, App: getTicketApp(ticket), Ip: userIp, UserAgent: userAgent}
+	if providerError, ok := err.(*ProviderError); ok {
+		event.ErrCode = providerError.ErrId
+		switch providerError.ErrId {
+		case "err:3:1", "err:9:1":
+			event.Event = AuditUserNotFound
+		case "err:12":
+			event.Event = AuditUserInactive
+		}
+	}
+	event.Detail = err.Error()
+	audit(event)
+}
+
+// ticket相关的事件, 用户信息从ticket保存的json里取
+func auditTicket(event string, ticket string, userIp string, userAgent string, errCode string, detail string) {
+	auditEvent := AuditEvent{Event: event, CorrelationId: auditCorrelationId(ticket), App: getTicketApp(ticket), Ip: userIp, UserAgent: userAgent, ErrCode: errCode, Detail: detail}
+	if jsonByte, ok := MemMap.Load(ticket); ok {
+		var ssoUserInfo SsoUserInfoStruct
+		if json.Unmarshal(jsonByte.([]byte), &ssoUserInfo) == nil {
+			auditEvent.UserId = ssoUserInfo.SsoDingdingUserId
+			auditEvent.UserName = ssoUserInfo.SsoName
+			auditEvent.Provider = ssoUserInfo.SsoProvider
+		}
+	}
+	audit(auditEvent)
+}
+
+// 发起扫码的业务方
+func getTicketApp(ticket string) string {
+	if temp, ok := MemTicketClientMap.Load(ticket); ok {
+		return temp.(TicketClientStruct).ClientId
+	}
+	if temp, ok := MemOidcAuthMap.Load(ticket); ok {
+		return "oidc:" + temp.(OidcAuthRequestStruct).ClientId
+	}
+	if temp, ok := MemSamlAuthMap.Load(ticket); ok {
+		return "saml:" + temp.(SamlAuthRequestStruct).SpEntityId
+	}
+	if temp, ok := MemCasAuthMap.Load(ticket); ok {
+		return "cas:" + temp.(CasAuthRequestStruct).Service
+	}
+	return ""
+}
+
+// 支持 unix秒 和 2006-01-02 15:04:05 两种格式
+func parseAuditTime(s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), true
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+type AuditQuery struct {
+	UserId        string
+	CorrelationId string
+	Ip            string
+	Events        map[string]bool
+	From          time.Time
+	To            time.Time
+	Limit         int
+}
+
+func (q AuditQuery) match(event AuditEvent) bool {
+	if q.UserId != "" && event.UserId != q.UserId {
+		return false
+	}
+	if q.CorrelationId != "" && event.CorrelationId != q.CorrelationId {
+		return false
+	}
+	if q.Ip != "" && event.Ip != q.Ip {
+		return false
+	}
+	if len(q.Events) > 0 && !q.Events[event.Event] {
+		return false
+	}
+	t, err := time.Parse("2006-01-02T15:04:05.000Z07:00", event.Time)
+	return err == nil && !t.Before(q.From) && !t.After(q.To)
+}
+
+// 按月份依次读文件, 最多返回Limit条, 按时间先后
+func queryAudit(q AuditQuery) []AuditEvent {
+	events := []AuditEvent{}
+	month := time.Date(q.From.Year(), q.From.Month(), 1, 0, 0, 0, 0, time.Local)
+	for !month.After(q.To) && len(events) < q.Limit {
+		fd, err := os.Open(auditFileName(month))
+		month = month.AddDate(0, 1, 0)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(fd)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event AuditEvent
+			if json.Unmarshal(scanner.Bytes(), &event) != nil || !q.match(event) {
+				continue
+			}
+			events = append(events, event)
+			if len(events) >= q.Limit {
+				break
+			}
+		}
+		fd.Close()
+	}
+	return events
+}
+
+// GET ?user_id=xx&event=2fa_failed,login_failed&from=2021-12-01&to=2021-12-31 23:59:59&ip=xx&correlation_id=xx&limit=1000
+// 不带from默认查最近7天
+func auditHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isLocalRequest(req) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		switch req.Method {
+		case "GET":
+			gets := req.URL.Query()
+			q := AuditQuery{
+				UserId:        gets.Get("user_id"),
+				CorrelationId: gets.Get("correlation_id"),
+				Ip:            gets.Get("ip"),
+				Events:        map[string]bool{},
+				To:            time.Now(),
+				Limit:         1000,
+			}
+			for _, event := range splitList(gets.Get("event")) {
+				q.Events[event] = true
+			}
+			if to, ok := parseAuditTime(gets.Get("to")); ok {
+				q.To = to
+			}
+			q.From = q.To.AddDate(0, 0, -7)
+			if from, ok := parseAuditTime(gets.Get("from")); ok {
+				q.From = from
+			}
+			if limit, err := strconv.Atoi(gets.Get("limit")); err == nil && limit > 0 && limit <= 10000 {
+				q.Limit = limit
+			}
+			b, _ := json.Marshal(queryAudit(q))
+			EchoJson(w, "0", b)
+			return
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+	}
+}
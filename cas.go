@@ -0,0 +1,296 @@
+package main
+
+// Apereo CAS 2.0/3.0 协议兼容
+// 老的java/php后台大多已经有CAS客户端, 配置cas_prefix后直接把本服务当CAS server用
+// 流程: /login?service=xx 生成ticket -> 钉钉扫码 -> scan_success_url 回调 -> 302跳转回service?ticket=ST-xx -> 业务方用ST调/serviceValidate
+// ST和普通ticket一样保存在MemMap/MemMapTTL中, 只能校验一次
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var MemCasAuthMap = &StoreMap{bucket: "cas_auth", encode: encodeJson, decode: decodeCasAuthRequest, expired: expiredCasAuthRequest}           // ticket => CasAuthRequestStruct, 等待扫码的登录请求
+var MemCasServiceMap = &StoreMap{bucket: "cas_service", encode: encodeJson, decode: decodeCasServiceTicket, expired: expiredCasServiceTicket} // ST => CasServiceTicketStruct, ST只能给生成它的service校验
+
+type CasAuthRequestStruct struct {
+	Service string `json:"service"`
+	Expired int64  `json:"expired"` // 过期时间戳 到点会自动删除
+}
+
+type CasServiceTicketStruct struct {
+	Service string `json:"service"`
+	Expired int64  `json:"expired"` // 和ST的过期时间相同
+}
+
+func decodeCasAuthRequest(b []byte) (interface{}, error) {
+	var authRequest CasAuthRequestStruct
+	err := json.Unmarshal(b, &authRequest)
+	return authRequest, err
+}
+
+func expiredCasAuthRequest(value interface{}) int64 {
+	return value.(CasAuthRequestStruct).Expired
+}
+
+func decodeCasServiceTicket(b []byte) (interface{}, error) {
+	var serviceTicket CasServiceTicketStruct
+	err := json.Unmarshal(b, &serviceTicket)
+	return serviceTicket, err
+}
+
+func expiredCasServiceTicket(value interface{}) int64 {
+	return value.(CasServiceTicketStruct).Expired
+}
+
+func isCasOn() bool {
+	cas, ok := ConfigMap.Load("cas")
+	return ok && cas.(string) == "on"
+}
+
+// service必须和cas_allowed_services中的某一个协议/域名/端口完全相同, 路径按目录匹配, 防止ST被跳转到外部网站
+// 不能用字符串前缀比较, https://app.xx.com.evil.com 和 https://app.xx.com@evil.com 都以 https://app.xx.com 开头
+func isCasServiceAllowed(service string) bool {
+	serviceUrl, err := url.Parse(service)
+	if err != nil || serviceUrl.User != nil || serviceUrl.Host == "" || (serviceUrl.Scheme != "https" && serviceUrl.Scheme != "http") {
+		return false
+	}
+	allowedServices, ok := ConfigMap.Load("cas_allowed_services")
+	if !ok {
+		return false
+	}
+	for _, allowed := range strings.Split(allowedServices.(string), ",") {
+		allowedUrl, err := url.Parse(strings.TrimSpace(allowed))
+		if err != nil || allowedUrl.Host == "" {
+			continue
+		}
+		if !strings.EqualFold(serviceUrl.Scheme, allowedUrl.Scheme) || !strings.EqualFold(serviceUrl.Host, allowedUrl.Host) {
+			continue
+		}
+		allowedPath := strings.TrimRight(allowedUrl.Path, "/")
+		if allowedPath == "" || serviceUrl.Path == allowedPath || strings.HasPrefix(serviceUrl.Path, allowedPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func getCasTicketTTL() int64 {
+	if temp, ok := ConfigMap.Load("cas_ticket_ttl"); ok {
+		if ttl, err := strconv.Atoi(temp.(string)); err == nil && ttl > 0 {
+			return int64(ttl)
+		}
+	}
+	return 60
+}
+
+func casLoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		gets := req.URL.Query()
+		service := gets.Get("service")
+		if service == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			EchoJson(w, "err:21", nil)
+			return
+		}
+		if !isCasServiceAllowed(service) {
+			w.WriteHeader(http.StatusForbidden)
+			EchoJson(w, "err:44", nil)
+			loger.Println("cas service not allowed:", service)
+			return
+		}
+		if gets.Get("gateway") == "true" { // 没有已登录的会话, gateway模式直接跳回不带ticket
+			http.Redirect(w, req, service, http.StatusFound)
+			return
+		}
+
+		userAgent := req.Header.Get("User-Agent")
+		userIp := GetIp(req)
+		if _, ok := MemForbiddenMap.Load(userIp); ok {
+			w.WriteHeader(http.StatusForbidden)
+			EchoJson(w, "err:31", nil)
+			return
+		}
+
+		ticket := generateTicket(userAgent, userIp, int(getCasTicketTTL())) // 扫码的ticket只用来换ST, 和ST一样短
+		MemCasAuthMap.Store(ticket, CasAuthRequestStruct{
+			Service: service,
+			Expired: time.Now().Unix() + 300,
+		})
+		http.Redirect(w, req, GetQrUrl(ticket, req.URL.Query().Get("provider")), http.StatusFound)
+	}
+}
+
+// 扫码成功后由successReturn调用, 如果这个ticket是cas发起的, 生成ST跳转回service, 返回true
+func casAuthorizeReturn(w http.ResponseWriter, ticket string, ssoUserByte []byte) bool {
+	temp, ok := MemCasAuthMap.Load(ticket)
+	if !ok {
+		return false
+	}
+	MemCasAuthMap.Delete(ticket)
+	authRequest := temp.(CasAuthRequestStruct)
+
+	serviceTicket := "ST-" + GetRandomStr(64)
+	MemMap.Store(serviceTicket, ssoUserByte)
+	expired := time.Now().Unix() + getCasTicketTTL()
+	MemMapTTL.Store(serviceTicket, expired)
+	MemCasServiceMap.Store(serviceTicket, CasServiceTicketStruct{Service: authRequest.Service, Expired: expired})
+
+	q := url.Values{}
+	q.Set("ticket", serviceTicket)
+	w.Header().Set("Location", appendQuery(authRequest.Service, q))
+	w.WriteHeader(http.StatusFound)
+	return true
+}
+
+func casFailure(w http.ResponseWriter, code, description string) {
+	w.Write([]byte(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationFailure code="` + code + `">` + html.EscapeString(description) + `</cas:authenticationFailure>
+</cas:serviceResponse>
+`))
+}
+
+func casAttribute(name string, values ...string) string {
+	var attribute string
+	for _, value := range values {
+		attribute += "      <cas:" + name + ">" + html.EscapeString(value) + "</cas:" + name + ">\n"
+	}
+	return attribute
+}
+
+// CAS 2.0 的serviceValidate和CAS 3.0 的p3/serviceValidate, 都带上用户属性
+func casServiceValidateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		gets := req.URL.Query()
+		service := gets.Get("service")
+		serviceTicket := gets.Get("ticket")
+		if service == "" || serviceTicket == "" {
+			casFailure(w, "INVALID_REQUEST", "service and ticket are required")
+			return
+		}
+		if !strings.HasPrefix(serviceTicket, "ST-") {
+			casFailure(w, "INVALID_TICKET_SPEC", "ticket "+serviceTicket+" not recognized")
+			return
+		}
+
+		// ST只能校验一次, 取出来的同时删掉, 并发校验同一个ST只有一个能取到
+		ticketService, ok := MemCasServiceMap.LoadAndDelete(serviceTicket)
+		jsonByte, found := MemMap.LoadAndDelete(serviceTicket)
+		expire, hasTTL := MemMapTTL.LoadAndDelete(serviceTicket)
+		var ssoUserInfo SsoUserInfoStruct
+		found = found && hasTTL && time.Now().Unix() < expire.(int64) && json.Unmarshal(jsonByte.([]byte), &ssoUserInfo) == nil
+		if !ok || !found {
+			casFailure(w, "INVALID_TICKET", "ticket "+serviceTicket+" not recognized")
+			return
+		}
+		if ticketService.(CasServiceTicketStruct).Service != service {
+			casFailure(w, "INVALID_SERVICE", "ticket "+serviceTicket+" does not match supplied service")
+			return
+		}
+
+		var deptNames, deptIds []string
+		for _, dept := range ssoUserInfo.SsoUserDeptInfo {
+			deptNames = append(deptNames, dept.SsoDeptName)
+			deptIds = append(deptIds, dept.SsoDeptId)
+		}
+		attributes := casAttribute("name", ssoUserInfo.SsoName) +
+			casAttribute("nickname", ssoUserInfo.SsoDingdingNickName) +
+			casAttribute("mobile", ssoUserInfo.SsoMobile) +
+			casAttribute("avatar", ssoUserInfo.SsoAvatar) +
+			casAttribute("job_title", ssoUserInfo.SsoJobTitle) +
+			casAttribute("union_id", ssoUserInfo.SsoDingdingUnionId) +
+			casAttribute("contact_type", strconv.FormatFloat(ssoUserInfo.SsoContactType, 'f', -1, 64)) +
+			casAttribute("departments", deptNames...) +
+			casAttribute("department_ids", deptIds...)
+		if ssoUserInfo.SsoEmail != "" {
+			attributes += casAttribute("email", ssoUserInfo.SsoEmail)
+		}
+		if ssoUserInfo.SsoCompanyName != "" {
+			attributes += casAttribute("company_name", ssoUserInfo.SsoCompanyName)
+		}
+
+		loger.Println("Cas ticket validated,", ssoUserInfo.SsoName, "service:", service)
+		w.Write([]byte(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationSuccess>
+    <cas:user>` + html.EscapeString(ssoUserInfo.SsoDingdingUserId) + `</cas:user>
+    <cas:attributes>
+      <cas:authenticationDate>` + time.Now().UTC().Format(time.RFC3339) + `</cas:authenticationDate>
+      <cas:isFromNewLogin>true</cas:isFromNewLogin>
+` + attributes + `    </cas:attributes>
+  </cas:authenticationSuccess>
+</cas:serviceResponse>
+`))
+	}
+}
+
+// 本服务不保存登录会话, 登出只需要跳回service
+func casLogoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		service := req.URL.Query().Get("service")
+		if isCasServiceAllowed(service) {
+			http.Redirect(w, req, service, http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("已退出登录"))
+	}
+}
+
+func clearExpiredCas() {
+	if !loopSleep(time.Second * 5) {
+		return
+	}
+	defer loopDone()
+
+	now := time.Now().Unix()
+	MemCasAuthMap.Range(func(key, value interface{}) bool {
+		if now >= value.(CasAuthRequestStruct).Expired {
+			MemCasAuthMap.Delete(key)
+		}
+		return true
+	})
+	MemCasServiceMap.Range(func(key, value interface{}) bool {
+		if now >= value.(CasServiceTicketStruct).Expired {
+			MemCasServiceMap.Delete(key)
+		}
+		return true
+	})
+	go clearExpiredCas()
+}
+
+// 注册cas相关的地址, CAS客户端只需要配置cas_prefix对应的完整地址
+func registerCasHandlers() {
+	prefix, ok := ConfigMap.Load("cas_prefix")
+	if !ok || len(prefix.(string)) == 0 {
+		panic("config cas_prefix not found")
+	}
+	casPrefix := strings.TrimRight(prefix.(string), "/")
+
+	if !sessionStore.NativeExpiry() {
+		go clearExpiredCas() // 定期清理没有完成扫码的登录请求
+	}
+
+	http.Handle(casPrefix+"/login", casLoginHandler())
+	http.Handle(casPrefix+"/serviceValidate", casServiceValidateHandler())
+	http.Handle(casPrefix+"/p3/serviceValidate", casServiceValidateHandler())
+	http.Handle(casPrefix+"/logout", casLogoutHandler())
+}
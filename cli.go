@@ -0,0 +1,158 @@
+package main
+
+// 命令行子命令, 不带参数启动服务
+// ./main check-config [config.ini]       校验配置文件, 输出所有问题, 有问题退出码为1
+// ./main print-config [config.ini]       输出生效的配置(包括默认值), 密钥类的值不输出
+// ./main probe-dingtalk [钉钉userid]      用配置的app_key/app_secret获取accessToken, 带userid时按扫码登录的流程查出用户信息
+// ./main gen-secret                      生成ticket_hash_secret
+// ./main gen-secret client               生成业务方的client_secret和配置文件里的secret哈希
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const cliUsage = `usage:
+  main                                 启动服务
+  main check-config [config.ini]       校验配置文件
+  main print-config [config.ini]       输出生效的配置, 密钥不输出
+  main probe-dingtalk [userid]         检查钉钉accessToken, 带userid时按扫码登录的流程查询用户
+  main gen-secret [client]             生成ticket_hash_secret, 带client生成业务方secret和哈希`
+
+func runCommand(args []string) int {
+	switch args[0] {
+	case "check-config":
+		return checkConfigCommand(args[1:])
+	case "print-config":
+		return printConfigCommand(args[1:])
+	case "probe-dingtalk":
+		return probeDingtalkCommand(args[1:])
+	case "gen-secret":
+		return genSecretCommand(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, cliUsage)
+		return 2
+	}
+}
+
+// 读取配置文件, 返回配置文件里的值和所有问题
+func readConfigForCommand(args []string) (map[string]string, []string, bool) {
+	if len(args) > 0 {
+		configFile = args[0]
+	}
+	b, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, configFile, "read error:", err.Error())
+		return nil, nil, false
+	}
+	values, problems := parseConfig(b)
+	problems = append(problems, configProblems(mergeConfigDefaults(values))...)
+	return values, problems, true
+}
+
+func checkConfigCommand(args []string) int {
+	_, problems, ok := readConfigForCommand(args)
+	if !ok {
+		return 1
+	}
+	if len(problems) == 0 {
+		fmt.Println(configFile, "ok")
+		return 0
+	}
+	for _, problem := range problems {
+		fmt.Println(configFile+":", problem)
+	}
+	return 1
+}
+
+func printConfigCommand(args []string) int {
+	fileValues, problems, ok := readConfigForCommand(args)
+	if !ok {
+		return 1
+	}
+	values := mergeConfigDefaults(fileValues)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		line := key + " = " + redactConfigValue(key, values[key])
+		if value, ok := fileValues[key]; !ok || value == "" && configDefaults[key] != "" {
+			line += " # 默认值"
+		}
+		fmt.Println(line)
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, configFile+":", problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// 错误编号加上配置文件里的说明
+func describeCommandError(err error) string {
+	if providerError, ok := err.(*ProviderError); ok {
+		message := err.Error()
+		if temp, ok := ConfigMap.Load(providerError.ErrId); ok {
+			message += " (" + temp.(string) + ")"
+		}
+		if len(providerError.RespBody) > 0 {
+			message += "\n" + string(providerError.RespBody)
+		}
+		return message
+	}
+	return err.Error()
+}
+
+func probeDingtalkCommand(args []string) int {
+	config, info, err := loadConfigFile()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, configFile, err.Error())
+		return 1
+	}
+	applyConfig(config, info)
+	startFakeDingding() // 配置了假钉钉时调假钉钉, 和启动服务时一样
+
+	token, err := dingdingAccessToken.Refresh("")
+	if err != nil {
+		fmt.Println("access token error:", describeCommandError(err))
+		return 1
+	}
+	if len(token) > 6 {
+		token = token[:6] + "..."
+	}
+	fmt.Println("access token ok:", token)
+	if len(args) == 0 {
+		return 0
+	}
+
+	// 和scanSuccessHandler用unionid换到userId之后的流程一样
+	userId := args[0]
+	provider := identityProviders["dingtalk"]()
+	dingdingRawStruct := DingdingRawStruct{}
+	ssoUserInfo, err := buildInternalSsoUser(provider, userId, ProviderIdentity{UserId: userId}, &dingdingRawStruct)
+	if err != nil {
+		fmt.Println("user", userId, "error:", describeCommandError(err))
+		return 1
+	}
+	b, _ := json.MarshalIndent(ssoUserInfo, "", "  ")
+	fmt.Println(string(b))
+	return 0
+}
+
+func genSecretCommand(args []string) int {
+	if len(args) > 0 && args[0] == "client" {
+		secret := GetRandomStr(40)
+		fmt.Println("client_secret:", secret)
+		fmt.Println("secret哈希:", hashClientSecret(secret))
+		return 0
+	}
+	fmt.Println("ticket_hash_secret = " + GetRandomStr(64))
+	return 0
+}
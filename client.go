@@ -0,0 +1,301 @@
+package main
+
+// 业务方登记
+// 扫码页带上 client_id 参数, 生成的ticket绑定这个业务方, 扫码成功后只postMessage给它登记的origin, fetch时要用它的client_secret认证
+// 配置格式 client:业务方client_id = secret哈希|origin|redirect_uri|最大ttl|claims, 多个origin/redirect_uri/claims用逗号分割, 不需要的留空
+// secret哈希格式 sha256$盐$hex(sha256(盐+secret)), 配置文件里不保存明文
+// 也可以用管理接口 client_admin_url 登记, 保存在sessionStore的client桶, 配置文件里的优先
+// client_required = on 时扫码必须带client_id, fetch必须认证, 没有登记的业务方不能再用
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type ClientStruct struct {
+	ClientId     string   `json:"client_id"`
+	SecretHash   string   `json:"secret_hash,omitempty"`
+	Origins      []string `json:"origins"`       // 允许打开扫码页的业务方页面origin, 例如 https://admin.xx.com
+	RedirectUris []string `json:"redirect_uris"` // 不用弹窗时, 扫码成功后带着sso_ticket跳转的地址
+	MaxTTL       int      `json:"max_ttl"`       // ticket最长有效秒数, 0不限制(还是不能超过ticket_max_ttl)
+	Claims       []string `json:"claims"`        // 能拿到哪些用户信息, 为空是全部
+	Reauth       string   `json:"reauth"`        // sso_session = on 时的重新认证策略, 留空 always 或者秒数, 见sso_session.go
+	Source       string   `json:"source"`        // config 配置文件  api 管理接口
+}
+
+// ticket => 绑定的业务方, 扫码时生成, 随ticket一起过期
+type TicketClientStruct struct {
+	ClientId    string `json:"client_id"`
+	Origin      string `json:"origin"`
+	RedirectUri string `json:"redirect_uri"`
+	Expired     int64  `json:"expired"`
+}
+
+// 不管有没有配置claims, 这些字段都会返回
+var clientBaseClaimFields = []string{"sso_provider", "sso_name", "sso_contact_type", "sso_ticket", "sso_session_token", "sso_dingding_union_id", "sso_dingding_user_id", "sso_dingding_open_id", "sso_dingding_nick_name"}
+
+var clientClaimFields = map[string][]string{
+	"profile":  {"sso_avatar", "sso_job_title", "sso_company_name", "sso_address", "sso_remark"},
+	"phone":    {"sso_mobile", "sso_state_code"},
+	"email":    {"sso_email"},
+	"dept":     {"sso_user_dept_info"},
+	"follower": {"sso_follower_user_id", "sso_follower_user"},
+	"raw":      {"dingding_raw"},
+}
+
+func isClientRequired() bool {
+	clientRequired, ok := ConfigMap.Load("client_required")
+	return ok && clientRequired.(string) == "on"
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func parseClientConfig(clientId, value string) (ClientStruct, bool) {
+	fields := strings.Split(value, "|")
+	if len(fields) != 5 && len(fields) != 6 || fields[0] == "" {
+		return ClientStruct{}, false
+	}
+	var reauth string
+	if len(fields) == 6 {
+		if reauth = strings.TrimSpace(fields[5]); !isValidReauth(reauth) {
+			return ClientStruct{}, false
+		}
+	}
+	maxTTL, err := strconv.Atoi(strings.TrimSpace(fields[3]))
+	if err != nil && strings.TrimSpace(fields[3]) != "" {
+		return ClientStruct{}, false
+	}
+	return ClientStruct{
+		ClientId:     clientId,
+		SecretHash:   strings.TrimSpace(fields[0]),
+		Origins:      splitList(fields[1]),
+		RedirectUris: splitList(fields[2]),
+		MaxTTL:       maxTTL,
+		Claims:       splitList(fields[4]),
+		Reauth:       reauth,
+		Source:       "config",
+	}, true
+}
+
+func getClient(clientId string) (ClientStruct, bool) {
+	if clientId == "" {
+		return ClientStruct{}, false
+	}
+	if temp, ok := ConfigMap.Load("client:" + clientId); ok {
+		return parseClientConfig(clientId, temp.(string))
+	}
+	if temp, ok := MemClientMap.Load(clientId); ok {
+		return temp.(ClientStruct), true
+	}
+	return ClientStruct{}, false
+}
+
+func getClients() []ClientStruct {
+	var clients []ClientStruct
+	ConfigMap.Range(func(key, value interface{}) bool {
+		if clientId := strings.TrimPrefix(key.(string), "client:"); clientId != key.(string) {
+			if client, ok := parseClientConfig(clientId, value.(string)); ok {
+				clients = append(clients, client)
+			}
+		}
+		return true
+	})
+	MemClientMap.Range(func(key, value interface{}) bool {
+		if _, ok := ConfigMap.Load("client:" + key.(string)); !ok {
+			clients = append(clients, value.(ClientStruct))
+		}
+		return true
+	})
+	return clients
+}
+
+func hashClientSecret(secret string) string {
+	salt := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		panic(err)
+	}
+	saltHex := hex.EncodeToString(salt)
+	sum := sha256.Sum256([]byte(saltHex + secret))
+	return "sha256$" + saltHex + "$" + hex.EncodeToString(sum[:])
+}
+
+func (c ClientStruct) VerifySecret(secret string) bool {
+	parts := strings.Split(c.SecretHash, "$")
+	if len(parts) != 3 || parts[0] != "sha256" || secret == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(parts[1] + secret))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(parts[2]))) == 1
+}
+
+func (c ClientStruct) HasOrigin(origin string) bool {
+	for _, allowed := range c.Origins {
+		if strings.TrimRight(allowed, "/") == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c ClientStruct) HasRedirectUri(redirectUri string) bool {
+	for _, allowed := range c.RedirectUris {
+		if allowed == redirectUri {
+			return true
+		}
+	}
+	return false
+}
+
+// 扫码页的打开方, 优先用origin参数, 没有就用Referer, 业务方只登记了一个origin时直接用它
+func (c ClientStruct) ResolveOrigin(req *http.Request) (string, bool) {
+	origin := req.URL.Query().Get("origin")
+	if origin == "" {
+		if referer, err := url.Parse(req.Header.Get("Referer")); err == nil && referer.Host != "" {
+			origin = referer.Scheme + "://" + referer.Host
+		}
+	}
+	if origin == "" && len(c.Origins) == 1 {
+		return strings.TrimRight(c.Origins[0], "/"), true
+	}
+	origin = strings.TrimRight(origin, "/")
+	return origin, c.HasOrigin(origin)
+}
+
+// fetch接口的业务方认证, 支持HTTP Basic和表单里的client_id/client_secret
+func authenticateClient(req *http.Request) (ClientStruct, bool) {
+	clientId, clientSecret, ok := req.BasicAuth()
+	if !ok {
+		clientId = req.Form.Get("client_id")
+		clientSecret = req.Form.Get("client_secret")
+	}
+	client, ok := getClient(clientId)
+	if !ok || !client.VerifySecret(clientSecret) {
+		return ClientStruct{}, false
+	}
+	return client, true
+}
+
+// 按业务方登记的claims过滤用户信息
+func filterClientClaims(client ClientStruct, ssoUserByte []byte) []byte {
+	if len(client.Claims) == 0 {
+		return ssoUserByte
+	}
+	var userMap map[string]json.RawMessage
+	if err := json.Unmarshal(ssoUserByte, &userMap); err != nil {
+		return ssoUserByte
+	}
+	allowed := map[string]bool{}
+	for _, field := range clientBaseClaimFields {
+		allowed[field] = true
+	}
+	for _, claim := range client.Claims {
+		for _, field := range clientClaimFields[claim] {
+			allowed[field] = true
+		}
+	}
+	for field := range userMap {
+		if !allowed[field] {
+			delete(userMap, field)
+		}
+	}
+	filtered, err := json.Marshal(userMap)
+	if err != nil {
+		return ssoUserByte
+	}
+	return filtered
+}
+
+// 管理接口, 和管理后台一样只允许127.0.0.1访问
+// GET 列出所有业务方  POST 登记/修改(json body, 不带client_secret时自动生成, 只在这次返回明文)  DELETE ?client_id=xx 删除
+func clientAdminHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isLocalRequest(req) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		switch req.Method {
+		case "GET":
+			clients := getClients()
+			for i := range clients {
+				clients[i].SecretHash = ""
+			}
+			if clients == nil {
+				clients = []ClientStruct{}
+			}
+			b, _ := json.Marshal(clients)
+			EchoJson(w, "0", b)
+			return
+		case "POST":
+			var body struct {
+				ClientStruct
+				ClientSecret string `json:"client_secret"`
+			}
+			if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil || body.ClientId == "" || strings.ContainsAny(body.ClientId, " |") || !isValidReauth(body.Reauth) {
+				w.WriteHeader(http.StatusBadRequest)
+				EchoJson(w, "err:20", nil)
+				return
+			}
+			if _, ok := ConfigMap.Load("client:" + body.ClientId); ok { // 配置文件里的只能改配置文件
+				w.WriteHeader(http.StatusConflict)
+				EchoJson(w, "err:52", nil)
+				return
+			}
+			client := body.ClientStruct
+			client.Source = "api"
+			secret := body.ClientSecret
+			if secret == "" {
+				if old, ok := getClient(client.ClientId); ok { // 修改时不带secret就不换
+					client.SecretHash = old.SecretHash
+				} else {
+					secret = GetRandomStr(40)
+				}
+			}
+			if secret != "" {
+				client.SecretHash = hashClientSecret(secret)
+			}
+			MemClientMap.Store(client.ClientId, client)
+			loger.Println("client registered:", client.ClientId)
+			audit(AuditEvent{Event: AuditAdminAction, App: client.ClientId, Ip: getRemoteIp(req), UserAgent: req.Header.Get("User-Agent"), Detail: "client register"})
+
+			client.SecretHash = ""
+			b, _ := json.Marshal(struct {
+				ClientStruct
+				ClientSecret string `json:"client_secret,omitempty"`
+			}{client, secret})
+			EchoJson(w, "0", b)
+			return
+		case "DELETE":
+			clientId := req.URL.Query().Get("client_id")
+			if _, ok := ConfigMap.Load("client:" + clientId); ok {
+				w.WriteHeader(http.StatusConflict)
+				EchoJson(w, "err:52", nil)
+				return
+			}
+			MemClientMap.Delete(clientId)
+			loger.Println("client deleted:", clientId)
+			audit(AuditEvent{Event: AuditAdminAction, App: clientId, Ip: getRemoteIp(req), UserAgent: req.Header.Get("User-Agent"), Detail: "client delete"})
+			EchoJson(w, "0", []byte(`null`))
+			return
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+	}
+}
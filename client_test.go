@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestClientVerifySecret(t *testing.T) {
+	hash := hashClientSecret("s3cret")
+	if !strings.HasPrefix(hash, "sha256$") || strings.Contains(hash, "s3cret") {
+		t.Fatalf("hash = %s", hash)
+	}
+	if hashClientSecret("s3cret") == hash {
+		t.Fatal("same secret hashed with the same salt twice")
+	}
+	parts := strings.Split(hash, "$")
+	tests := []struct {
+		name       string
+		secretHash string
+		secret     string
+		want       bool
+	}{
+		{"right secret", hash, "s3cret", true},
+		{"upper case hex", parts[0] + "$" + parts[1] + "$" + strings.ToUpper(parts[2]), "s3cret", true},
+		{"wrong secret", hash, "s3cret2", false},
+		{"empty secret", hash, "", false},
+		{"plaintext in config", "s3cret", "s3cret", false},
+		{"unknown algorithm", "md5$" + parts[1] + "$" + parts[2], "s3cret", false},
+		{"empty hash", "", "", false},
+	}
+	for _, tt := range tests {
+		if got := (ClientStruct{SecretHash: tt.secretHash}).VerifySecret(tt.secret); got != tt.want {
+			t.Errorf("%s: VerifySecret = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// oidc_client和client:都只保存secret哈希, 用明文secret认证
+func TestClientAuthenticate(t *testing.T) {
+	setTestConfig(t, map[string]string{
+		"client:admin":       hashClientSecret("admin-secret") + "|https://admin.example.com|||",
+		"oidc_client:gitlab": hashClientSecret("gitlab-secret") + "|https://gitlab.example.com/callback",
+		"oidc_client:legacy": "legacy-secret|https://legacy.example.com/callback",
+	})
+
+	form := func(clientId, clientSecret string) url.Values {
+		return url.Values{"client_id": {clientId}, "client_secret": {clientSecret}}
+	}
+	for _, tt := range []struct {
+		values url.Values
+		want   bool
+	}{
+		{form("admin", "admin-secret"), true},
+		{form("admin", "wrong"), false},
+		{form("missing", "admin-secret"), false},
+	} {
+		req := httptest.NewRequest("POST", "/fetch", strings.NewReader(tt.values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.ParseForm()
+		if _, ok := authenticateClient(req); ok != tt.want {
+			t.Errorf("authenticateClient(%s) = %v, want %v", tt.values.Encode(), ok, tt.want)
+		}
+	}
+	req := httptest.NewRequest("POST", "/fetch", nil)
+	req.SetBasicAuth("admin", "admin-secret")
+	req.ParseForm()
+	if _, ok := authenticateClient(req); !ok {
+		t.Error("basic auth rejected")
+	}
+
+	for _, tt := range []struct {
+		clientId, secret string
+		want             bool
+	}{
+		{"gitlab", "gitlab-secret", true},
+		{"gitlab", "admin-secret", false},
+		{"admin", "admin-secret", true}, // 没有oidc_client的用client:登记的业务方
+		{"legacy", "legacy-secret", false},
+	} {
+		client, ok := getOidcClient(tt.clientId)
+		if got := ok && client.VerifySecret(tt.secret); got != tt.want {
+			t.Errorf("oidc client %s secret %s = %v, want %v", tt.clientId, tt.secret, got, tt.want)
+		}
+	}
+	if client, _ := getOidcClient("gitlab"); len(client.RedirectUris) != 1 || client.RedirectUris[0] != "https://gitlab.example.com/callback" {
+		t.Errorf("gitlab redirect uris = %v", client.RedirectUris)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+// 用户ip
+// 所有ip都转成标准写法再用: ticket哈希/可信ip/屏蔽列表/限流都按这个字符串, IPv4映射的IPv6地址(::ffff:1.2.3.4)当成IPv4
+// trusted_proxies: 本服务前的代理, ip或网段, 只有直接连过来的是代理时才看 X-Forwarded-For 和 X-Real-IP
+//   X-Forwarded-For 从右往左找第一个不是代理的ip, 中间每一跳都是代理时取最左边的; 没有 X-Forwarded-For 时用 X-Real-IP
+//   0.0.0.0 相当于 0.0.0.0/0,::/0, 任何人都能伪造ip, 只为兼容老配置
+// inner_networks: 内网网段, 续期ticket和监控指标只允许内网访问
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ip或网段, 逗号分割, 单个ip当成/32或/128
+func parseIpNetList(s string) ([]netip.Prefix, []string) {
+	var prefixes []netip.Prefix
+	var invalid []string
+	for _, item := range splitList(s) {
+		if item == "0.0.0.0" {
+			prefixes = append(prefixes, netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0"))
+			continue
+		}
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				invalid = append(invalid, item)
+				continue
+			}
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			invalid = append(invalid, item)
+			continue
+		}
+		addr = addr.Unmap().WithZone("")
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, invalid
+}
+
+func ipNetListContains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// 1.2.3.4  ::1  [::1]:8080  1.2.3.4:8080 都可以
+func parseIp(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap().WithZone(""), true
+	}
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), true
+	}
+	return netip.Addr{}, false
+}
+
+// 转成标准写法, 不是ip的原样返回
+func normalizeIp(s string) string {
+	if addr, ok := parseIp(s); ok {
+		return addr.String()
+	}
+	return s
+}
+
+// 直接连过来的ip, 不看代理头
+func getRemoteIp(req *http.Request) string {
+	if addr, ok := parseIp(req.RemoteAddr); ok {
+		return addr.String()
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// 管理后台/管理接口只允许本机访问, 127.0.0.0/8 和 ::1 都算
+func isLocalRequest(req *http.Request) bool {
+	addr, ok := parseIp(req.RemoteAddr)
+	return ok && addr.IsLoopback()
+}
+
+func GetIp(req *http.Request) string {
+	remote, ok := parseIp(req.RemoteAddr)
+	if !ok {
+		return getRemoteIp(req)
+	}
+	trustedProxies := getConfig().TrustedProxies
+	if !ipNetListContains(trustedProxies, remote) {
+		return remote.String()
+	}
+
+	var hops []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if realIp, ok := parseIp(req.Header.Get("X-Real-IP")); ok {
+			return realIp.String()
+		}
+		return remote.String()
+	}
+	// 从右往左, 右边是离本服务最近的代理加上的, 左边的用户可以随便伪造
+	userIp := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseIp(hops[i])
+		if !ok { // 格式不对就不再往左看, 用上一跳
+			break
+		}
+		userIp = addr
+		if !ipNetListContains(trustedProxies, addr) {
+			break
+		}
+	}
+	return userIp.String()
+}
+
+func isInnerIp(ip string) bool {
+	addr, ok := parseIp(ip)
+	return ok && ipNetListContains(getConfig().InnerNetworks, addr)
+}
@@ -0,0 +1,471 @@
+package main
+
+// 配置文件
+// 启动时读取config.ini并校验, 不通过直接退出
+// 运行中收到SIGHUP或者每5秒发现文件修改时间/大小变化时重新读取, 校验不通过的修改不生效, 继续用之前的配置, readyz会报告
+// 每次重新读取都在日志里输出改了哪些配置, 密钥类的值不输出
+// 常用的配置解析成Config的字段, 所有配置的原始值同步到ConfigMap, 文件里删掉的配置也从ConfigMap删掉
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var configFile = "config.ini" // check-config/print-config 可以指定别的文件
+
+type Config struct {
+	Values map[string]string // 所有配置的原始值, 包括错误提示 err:xx, 业务方 client:xx 等
+
+	Title                                string
+	Domain                               string
+	ScanUrl                              string
+	ScanSuccessUrl                       string
+	TicketUrl                            string
+	TtlUrl                               string
+	VersionUrl                           string
+	ManagerUrl                           string
+	Port                                 string
+	ShutdownTimeout                      int64
+	TwoFactorAuthentication              bool
+	TwoFactorAuthenticationBlockDuration int64
+	TrustIpStoreDuration                 int64
+	TicketMaxTTL                         int64
+	AllowTicketRenew                     bool
+	TrustedProxies                       []netip.Prefix
+	InnerNetworks                        []netip.Prefix
+	TicketFormat                         string
+	TicketKeyId                          string            // 生成ticket用的密钥
+	TicketKeys                           map[string]string // 密钥id => 密钥, ticket_hash_secret 是 0
+	SessionStore                         string
+	DeptCacheTTL                         int64
+	RevalidateInterval                   int64
+}
+
+// 没有配置时的默认值
+var configDefaults = map[string]string{
+	"scan_url":         "/bms-sso/scan",
+	"scan_success_url": "/bms-sso/scan-success",
+	"ticket_url":       "/bms-sso/fetch-by-ticket",
+	"ttl_url":          "/bms-sso/ttl-by-ticket",
+	"version_url":      "/bms-sso/version",
+	"manager_url":      "/bms-sso/manager",
+
+	"port":             ":8093",
+	"shutdown_timeout": "30",
+	"session_store":    "memory",
+
+	"two_factor_authentication":                "off",
+	"two_factor_authentication_block_duration": "60",
+	"trust_ip_store_duration":                  "265200",
+
+	"ticket_format":       "v1",
+	"ticket_key_id":       "0",
+	"ticket_max_ttl":      "86400",
+	"allow_ticket_renew":  "no",
+	"dept_cache_ttl":      "600",
+	"revalidate_interval": "300",
+	"inner_networks":      "127.0.0.0/8, ::1/128, 10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16, fc00::/7",
+
+	"sso_session":         "off",
+	"sso_session_max_age": "28800",
+	"sso_session_cookie":  "bms_sso_session",
+
+	"session_token":            "off",
+	"session_token_url":        "/bms-sso/session-token",
+	"session_token_jwks_url":   "/bms-sso/session-token/jwks",
+	"session_token_revoke_url": "/bms-sso/session-token/revoke",
+
+	"rate_limit_ip":             "30/60",
+	"rate_limit_app":            "1200/60",
+	"fetch_fail_limit":          "30/60",
+	"fetch_fail_block_duration": "600",
+}
+
+// 必须配置而且不能为空
+var configRequiredKeys = []string{"title", "domain", "ticket_hash_secret", "dingding_agent_id", "dingding_app_key", "dingding_app_secret"}
+
+// 整数配置的最小值
+var configIntKeys = map[string]int64{
+	"ticket_max_ttl":                           1,
+	"shutdown_timeout":                         1,
+	"two_factor_authentication_block_duration": 0,
+	"trust_ip_store_duration":                  0,
+	"dept_cache_ttl":                           0,
+	"revalidate_interval":                      0,
+	"session_store_snapshot_interval":          1,
+	"oidc_token_ttl":                           1,
+	"saml_session_ttl":                         1,
+	"cas_ticket_ttl":                           1,
+	"redis_db":                                 0,
+	"fetch_fail_block_duration":                1,
+	"sso_session_max_age":                      1,
+}
+
+var configSwitchKeys = map[string][]string{
+	"two_factor_authentication": {"on", "off"},
+	"client_required":           {"on", "off"},
+	"oidc":                      {"on", "off"},
+	"saml":                      {"on", "off"},
+	"cas":                       {"on", "off"},
+	"session_token":             {"on", "off"},
+	"sso_session":               {"on", "off"},
+	"dingding_callback":         {"on", "off"},
+	"allow_ticket_renew":        {"yes", "no"},
+	"session_store":             {"memory", "file", "redis"},
+	"dingding_login_mode":       {"legacy", "oauth2"},
+	"ticket_format":             {"v1", "v2"},
+}
+
+// 启动时才读取的配置, 修改后要重启才生效
+var configRestartKeys = map[string]bool{
+	"port": true, "pid_file": true, "session_store": true, "session_store_dir": true, "session_store_snapshot_interval": true,
+	"redis_addr": true, "redis_password": true, "redis_db": true, "redis_key_prefix": true,
+	"oidc": true, "saml": true, "cas": true, "cas_prefix": true, "dingding_callback": true, "dingding_fake_fixture": true, "dingding_fake_addr": true,
+	"session_token": true, "session_token_key_file": true, "session_token_url": true, "session_token_jwks_url": true, "session_token_revoke_url": true,
+}
+
+var currentConfig atomic.Value // *Config
+var configMutex sync.Mutex     // 同一时间只有一次重新读取
+var configReloadError error    // 最近一次重新读取被拒绝的原因
+var configModTime time.Time
+var configSize int64
+
+func getConfig() *Config {
+	return currentConfig.Load().(*Config)
+}
+
+func getConfigReloadError() error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	return configReloadError
+}
+
+// 每行 key = value, #开头是注释, 等号前后的空格可以省略, 返回所有格式不对的行
+func parseConfig(b []byte) (map[string]string, []string) {
+	values := map[string]string{}
+	var problems []string
+	for i, line := range strings.Split(strings.Replace(string(b), "\r\n", "\n", -1), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		index := strings.Index(line, " = ") // 优先按 " = " 分割, saml_sp:的key里可能有等号
+		separator := 3
+		if index < 0 {
+			index = strings.Index(line, "=")
+			separator = 1
+		}
+		if index <= 0 {
+			problems = append(problems, "line "+strconv.Itoa(i+1)+" is not key = value")
+			continue
+		}
+		values[strings.TrimSpace(line[:index])] = strings.TrimSpace(line[index+separator:])
+	}
+	return values, problems
+}
+
+// 配置成/开头的路径, 或者完整的http(s)地址
+func validateConfigUrl(value string) bool {
+	if value == "" || strings.HasPrefix(value, "/") {
+		return !strings.ContainsAny(value, " \t")
+	}
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// 配置的所有问题, 没有问题返回空
+func configProblems(values map[string]string) []string {
+	var problems []string
+	for _, key := range configRequiredKeys {
+		if values[key] == "" {
+			problems = append(problems, key+" not found")
+		}
+	}
+	for key, min := range configIntKeys {
+		if value, ok := values[key]; ok {
+			if i, err := strconv.ParseInt(value, 10, 64); err != nil || i < min {
+				problems = append(problems, key+" must be an integer not less than "+strconv.FormatInt(min, 10))
+			}
+		}
+	}
+	for key, allowed := range configSwitchKeys {
+		if value, ok := values[key]; ok && !inStrings(value, allowed) {
+			problems = append(problems, key+" must be one of "+strings.Join(allowed, "/"))
+		}
+	}
+	for key, value := range values {
+		if (strings.HasSuffix(key, "_url") || key == "domain" || key == "dingding_oapi_base" || key == "cas_prefix") && !validateConfigUrl(value) {
+			problems = append(problems, key+" is not a valid url")
+		}
+		if keyId := strings.TrimPrefix(key, "ticket_key:"); keyId != key && (!isTicketKeyId(keyId) || keyId == "0" || value == "") {
+			problems = append(problems, key+" id must be letters/digits/-/_ and not 0, secret can not be empty")
+		}
+		if clientId := strings.TrimPrefix(key, "client:"); clientId != key {
+			if _, ok := parseClientConfig(clientId, value); !ok {
+				problems = append(problems, key+" is not secret_hash|origins|redirect_uris|max_ttl|claims[|reauth]")
+			}
+		}
+	}
+	if _, _, err := net.SplitHostPort(values["port"]); err != nil {
+		problems = append(problems, "port is not host:port")
+	}
+	if keyId := values["ticket_key_id"]; keyId != "0" && values["ticket_key:"+keyId] == "" {
+		problems = append(problems, "ticket_key_id "+keyId+" not found, add ticket_key:"+keyId)
+	}
+	for _, key := range []string{"trusted_proxies", "inner_networks"} {
+		_, invalid := parseIpNetList(values[key])
+		for _, item := range invalid {
+			problems = append(problems, key+" "+item+" is not an ip or cidr")
+		}
+	}
+	for _, key := range []string{"rate_limit_ip", "rate_limit_app", "fetch_fail_limit"} {
+		if _, _, ok := parseRateLimit(values[key]); !ok && values[key] != "0" {
+			problems = append(problems, key+" must be count/seconds or 0")
+		}
+	}
+	for _, name := range splitList(values["identity_providers"]) {
+		if _, ok := identityProviders[name]; !ok {
+			problems = append(problems, "identity_providers "+name+" not supported")
+		}
+	}
+	if values["dingding_callback"] == "on" && len(values["dingding_callback_aes_key"]) != 43 {
+		problems = append(problems, "dingding_callback_aes_key must be 43 characters")
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func validateConfig(values map[string]string) error {
+	if problems := configProblems(values); len(problems) > 0 {
+		return errors.New("config not valid: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// 密钥id会出现在ticket里, 不能有"."
+func isTicketKeyId(s string) bool {
+	if len(s) == 0 || len(s) > 16 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func inStrings(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 配置文件的值加上默认值
+func mergeConfigDefaults(fileValues map[string]string) map[string]string {
+	values := map[string]string{}
+	for key, value := range configDefaults {
+		values[key] = value
+	}
+	for key, value := range fileValues {
+		if value == "" && configDefaults[key] != "" { // 留空用默认值
+			continue
+		}
+		values[key] = value
+	}
+	return values
+}
+
+func newConfig(fileValues map[string]string) (*Config, error) {
+	values := mergeConfigDefaults(fileValues)
+	if err := validateConfig(values); err != nil {
+		return nil, err
+	}
+	parseInt := func(key string) int64 {
+		i, _ := strconv.ParseInt(values[key], 10, 64)
+		return i
+	}
+	trustedProxies, _ := parseIpNetList(values["trusted_proxies"])
+	innerNetworks, _ := parseIpNetList(values["inner_networks"])
+	ticketKeys := map[string]string{"0": values["ticket_hash_secret"]}
+	for key, value := range values {
+		if keyId := strings.TrimPrefix(key, "ticket_key:"); keyId != key {
+			ticketKeys[keyId] = value
+		}
+	}
+	return &Config{
+		Values:                               values,
+		Title:                                values["title"],
+		Domain:                               values["domain"],
+		ScanUrl:                              values["scan_url"],
+		ScanSuccessUrl:                       values["scan_success_url"],
+		TicketUrl:                            values["ticket_url"],
+		TtlUrl:                               values["ttl_url"],
+		VersionUrl:                           values["version_url"],
+		ManagerUrl:                           values["manager_url"],
+		Port:                                 values["port"],
+		ShutdownTimeout:                      parseInt("shutdown_timeout"),
+		TwoFactorAuthentication:              values["two_factor_authentication"] == "on",
+		TwoFactorAuthenticationBlockDuration: parseInt("two_factor_authentication_block_duration"),
+		TrustIpStoreDuration:                 parseInt("trust_ip_store_duration"),
+		TicketMaxTTL:                         parseInt("ticket_max_ttl"),
+		AllowTicketRenew:                     values["allow_ticket_renew"] == "yes",
+		TrustedProxies:                       trustedProxies,
+		InnerNetworks:                        innerNetworks,
+		TicketFormat:                         values["ticket_format"],
+		TicketKeyId:                          values["ticket_key_id"],
+		TicketKeys:                           ticketKeys,
+		SessionStore:                         values["session_store"],
+		DeptCacheTTL:                         parseInt("dept_cache_ttl"),
+		RevalidateInterval:                   parseInt("revalidate_interval"),
+	}, nil
+}
+
+// 读取失败(编辑器保存时文件可能短暂不存在)返回的info为nil, 下一轮再试
+func loadConfigFile() (*Config, os.FileInfo, error) {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, problems := parseConfig(b)
+	if len(problems) > 0 {
+		return nil, info, errors.New("config not valid: " + strings.Join(problems, "; "))
+	}
+	config, err := newConfig(values)
+	return config, info, err
+}
+
+// 密钥类的配置在日志和print-config里不输出
+func isSecretConfigKey(key string) bool {
+	for _, word := range []string{"secret", "password", "aes_key", "callback_token"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return strings.HasPrefix(key, "client:") || strings.HasPrefix(key, "oidc_client:") || strings.HasPrefix(key, "ticket_key:")
+}
+
+func redactConfigValue(key, value string) string {
+	if isSecretConfigKey(key) && value != "" {
+		return "******"
+	}
+	return value
+}
+
+func logConfigDiff(oldValues, newValues map[string]string) {
+	var keys []string
+	for key := range oldValues {
+		keys = append(keys, key)
+	}
+	for key := range newValues {
+		if _, ok := oldValues[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	changed := 0
+	for _, key := range keys {
+		oldValue, oldOk := oldValues[key]
+		newValue, newOk := newValues[key]
+		if oldOk && newOk && oldValue == newValue {
+			continue
+		}
+		changed++
+		note := ""
+		if configRestartKeys[key] || (strings.HasSuffix(key, "_url") && key != "two_factor_authentication_url") {
+			note = " (restart required)"
+		}
+		switch {
+		case !oldOk:
+			loger.Println("config added:", key, "=", redactConfigValue(key, newValue)+note)
+		case !newOk:
+			loger.Println("config removed:", key+note)
+		default:
+			loger.Println("config changed:", key, "=", redactConfigValue(key, oldValue), "=>", redactConfigValue(key, newValue)+note)
+		}
+	}
+	loger.Println("config reloaded,", changed, "changes")
+}
+
+func applyConfig(config *Config, info os.FileInfo) {
+	configModTime, configSize = info.ModTime(), info.Size()
+	old, _ := currentConfig.Load().(*Config)
+	for key, value := range config.Values {
+		ConfigMap.Store(key, value)
+	}
+	if old != nil {
+		for key := range old.Values {
+			if _, ok := config.Values[key]; !ok {
+				ConfigMap.Delete(key)
+			}
+		}
+	}
+	currentConfig.Store(config)
+	if old != nil {
+		logConfigDiff(old.Values, config.Values)
+	}
+}
+
+// 读取配置文件, 启动时调用, 不通过直接退出
+func ReadFile() {
+	config, info, err := loadConfigFile()
+	if err != nil {
+		panic("config.ini " + err.Error())
+	}
+	applyConfig(config, info)
+	for _, prefix := range config.TrustedProxies {
+		if prefix.Bits() == 0 {
+			loger.Println("warning: trusted_proxies trusts every address, X-Forwarded-For/X-Real-IP can be forged")
+			break
+		}
+	}
+	go watchConfigFile()
+}
+
+func reloadConfig(reason string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config, info, err := loadConfigFile()
+	if info != nil { // 读到了文件, 不管校验是否通过, 文件不再改就不再重复读取
+		configModTime, configSize = info.ModTime(), info.Size()
+	}
+	if err != nil {
+		configReloadError = err
+		loger.Println("config reload ("+reason+") rejected, keep previous config:", err.Error())
+		return
+	}
+	configReloadError = nil
+	applyConfig(config, info)
+}
+
+// 每5秒检查配置文件的修改时间和大小
+func watchConfigFile() {
+	if !loopSleep(time.Second * 5) {
+		return
+	}
+	defer loopDone()
+	configMutex.Lock()
+	modTime, size := configModTime, configSize
+	configMutex.Unlock()
+	if info, err := os.Stat(configFile); err == nil && (!info.ModTime().Equal(modTime) || info.Size() != size) {
+		reloadConfig("file changed")
+	}
+	go watchConfigFile()
+}
@@ -0,0 +1,223 @@
+package main
+
+// 部门信息缓存
+// 部门名称/管理员/上级部门很少变, 每次登录都调接口太慢, 按 dept_cache_ttl 秒缓存
+// 后台协程在过期前刷新最近登录用到过的部门, 很久没用到的直接删掉
+// 刷新失败时继续用旧的, 接口偶尔失败不影响登录
+
+import (
+	"sync"
+	"time"
+)
+
+const deptPathMaxDepth = 50 // 上级部门最多找多少层, 防止数据有环时死循环
+
+type deptCacheEntry struct {
+	provider  IdentityProvider
+	dept      ProviderDept
+	raw       string   // 接口原始返回, 放到DingdingRaw.Departments
+	parentIds []string // 从自己到根部门, nil表示还没查过
+	expired   int64
+	used      int64 // 最后一次登录用到的时间
+}
+
+type DeptCache struct {
+	mutex   sync.Mutex
+	entries map[string]*deptCacheEntry
+}
+
+var deptCache = &DeptCache{entries: map[string]*deptCacheEntry{}}
+
+func getDeptCacheTTL() int64 {
+	return getConfig().DeptCacheTTL
+}
+
+func deptCacheKey(provider IdentityProvider, deptId string) string {
+	return provider.Name() + ":" + deptId
+}
+
+// 取缓存, 没有或者过期了就调接口
+func (c *DeptCache) lookup(provider IdentityProvider, deptId string) (*deptCacheEntry, error) {
+	key := deptCacheKey(provider, deptId)
+	now := time.Now().Unix()
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		entry.used = now
+		if now < entry.expired {
+			c.mutex.Unlock()
+			return entry, nil
+		}
+	}
+	c.mutex.Unlock()
+
+	fresh, err := c.fetch(provider, deptId)
+	if err != nil {
+		if ok { // 接口失败用旧的
+			loger.Println("dept cache", key, "refresh error, use stale:", err.Error())
+			return entry, nil
+		}
+		return nil, err
+	}
+	fresh.used = now
+	c.mutex.Lock()
+	c.entries[key] = fresh
+	c.mutex.Unlock()
+	return fresh, nil
+}
+
+func (c *DeptCache) fetch(provider IdentityProvider, deptId string) (*deptCacheEntry, error) {
+	var raw DingdingRawStruct
+	dept, err := provider.GetDepartment(deptId, &raw)
+	if err != nil {
+		return nil, err
+	}
+	entry := &deptCacheEntry{provider: provider, dept: dept, expired: time.Now().Unix() + getDeptCacheTTL()}
+	if len(raw.Departments) > 0 {
+		entry.raw = raw.Departments[0]
+	}
+	return entry, nil
+}
+
+// 部门信息和接口原始返回
+func (c *DeptCache) Get(provider IdentityProvider, deptId string) (ProviderDept, string, error) {
+	entry, err := c.lookup(provider, deptId)
+	if err != nil {
+		return ProviderDept{}, "", err
+	}
+	return entry.dept, entry.raw, nil
+}
+
+// 从根部门到自己的完整路径
+func (c *DeptCache) Path(provider IdentityProvider, deptId string) ([]ProviderDept, error) {
+	entry, err := c.lookup(provider, deptId)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	parentIds := entry.parentIds
+	c.mutex.Unlock()
+	if parentIds == nil {
+		if parentIds, err = provider.GetDepartmentParentIds(deptId); err != nil {
+			return nil, err
+		}
+		c.mutex.Lock()
+		entry.parentIds = parentIds
+		c.mutex.Unlock()
+	}
+
+	path := make([]ProviderDept, 0, len(parentIds))
+	for i := len(parentIds) - 1; i >= 0; i-- {
+		dept, _, err := c.Get(provider, parentIds[i])
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, dept)
+	}
+	return path, nil
+}
+
+// 部门变更时删掉缓存, 下次登录重新查
+func (c *DeptCache) Invalidate(providerName, deptId string) {
+	c.mutex.Lock()
+	delete(c.entries, providerName+":"+deptId)
+	c.mutex.Unlock()
+}
+
+// 员工调部门/改主管/离职时, 他所在的部门和他当主管的部门的主管列表都可能变了, 一起删掉
+func (c *DeptCache) InvalidateUser(providerName, userId string, deptIds []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, deptId := range deptIds {
+		delete(c.entries, providerName+":"+deptId)
+	}
+	for key, entry := range c.entries {
+		if entry.provider.Name() != providerName {
+			continue
+		}
+		for _, managerUserId := range entry.dept.ManagerUserIds {
+			if managerUserId == userId {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+}
+
+// 上级部门变了会影响所有下级部门的路径, 直接全部清掉
+func (c *DeptCache) InvalidateAll() {
+	c.mutex.Lock()
+	c.entries = map[string]*deptCacheEntry{}
+	c.mutex.Unlock()
+}
+
+// 一个TTL内有登录用到的部门在过期前刷新, 没用到的删掉
+func (c *DeptCache) refreshLoop() {
+	if !loopSleep(time.Second * 60) {
+		return
+	}
+	defer loopDone()
+
+	now := time.Now().Unix()
+	ttl := getDeptCacheTTL()
+	var refresh []string
+	c.mutex.Lock()
+	for key, entry := range c.entries {
+		if now < entry.expired-60 {
+			continue
+		}
+		if now-entry.used > ttl {
+			delete(c.entries, key)
+			continue
+		}
+		refresh = append(refresh, key)
+	}
+	c.mutex.Unlock()
+
+	for _, key := range refresh {
+		c.mutex.Lock()
+		entry, ok := c.entries[key]
+		var parentIds []string
+		if ok {
+			parentIds = entry.parentIds
+		}
+		c.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		fresh, err := c.fetch(entry.provider, entry.dept.Id)
+		if err != nil {
+			loger.Println("dept cache", key, "refresh error:", err.Error())
+			continue
+		}
+		if parentIds != nil {
+			if parentIds, err := entry.provider.GetDepartmentParentIds(entry.dept.Id); err == nil {
+				fresh.parentIds = parentIds
+			}
+		}
+		c.mutex.Lock()
+		fresh.used = entry.used
+		c.entries[key] = fresh
+		c.mutex.Unlock()
+	}
+	go c.refreshLoop()
+}
+
+// 企业微信/飞书没有一次查出所有上级部门的接口, 沿着上级部门id一层层往上找
+func walkDepartmentParents(provider IdentityProvider, deptId string, rootParentId string) ([]string, error) {
+	var parentIds []string
+	for deptId != "" && deptId != rootParentId && len(parentIds) < deptPathMaxDepth {
+		for _, parentId := range parentIds {
+			if parentId == deptId {
+				return parentIds, nil
+			}
+		}
+		dept, _, err := deptCache.Get(provider, deptId)
+		if err != nil {
+			return nil, err
+		}
+		parentIds = append(parentIds, deptId)
+		deptId = dept.ParentId
+	}
+	return parentIds, nil
+}
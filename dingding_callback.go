@@ -0,0 +1,354 @@
+package main
+
+// 钉钉事件订阅(HTTP推送), 通讯录变更时钉钉主动通知, 员工离职几秒内就能踢下线, 不用等离职校验的下一轮
+// 钉钉文档 https://open.dingtalk.com/document/orgapp/configure-event-subcription
+// 推送的body是 {"encrypt":"..."}, url上带 msg_signature timestamp nonce
+// 签名: sha1(sort(token, timestamp, nonce, encrypt)), timestamp和本机时间相差超过5分钟的当成重放, 不处理
+// 加密: AES-256-CBC, key是aes_key补一个=后base64解码的32字节, iv是key的前16字节, PKCS7补位
+// 明文: 16字节随机串 + 4字节消息长度(大端) + 消息json + 应用的AppKey(企业内部应用)或CorpId
+// 返回: 把 success 按同样方式加密签名后返回, 钉钉收不到正确的返回会重试, 多次失败会停止推送
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dingdingCallbackMaxSkew = 300 // 推送的timestamp和本机时间最多相差5分钟
+
+type DingdingCallbackEvent struct {
+	EventType string   `json:"EventType"`
+	TimeStamp string   `json:"TimeStamp"`
+	CorpId    string   `json:"CorpId"`
+	UserId    []string `json:"UserId"`
+	DeptId    []int64  `json:"DeptId"`
+}
+
+type DingdingCallbackCrypto struct {
+	token  string
+	aesKey []byte
+	key    string // AppKey或CorpId
+}
+
+func isDingdingCallbackOn() bool {
+	callback, ok := ConfigMap.Load("dingding_callback")
+	return ok && callback.(string) == "on"
+}
+
+func getDingdingCallbackCrypto() (*DingdingCallbackCrypto, error) {
+	token, _ := ConfigMap.Load("dingding_callback_token")
+	aesKey, _ := ConfigMap.Load("dingding_callback_aes_key")
+	key, _ := ConfigMap.Load("dingding_callback_key")
+	if key == nil || key.(string) == "" {
+		key, _ = ConfigMap.Load("dingding_app_key")
+	}
+	if token == nil || aesKey == nil || key == nil {
+		return nil, errors.New("dingding callback config not found")
+	}
+	aesKeyByte, err := base64.StdEncoding.DecodeString(aesKey.(string) + "=")
+	if err != nil || len(aesKeyByte) != 32 {
+		return nil, errors.New("dingding_callback_aes_key must be 43 characters")
+	}
+	return &DingdingCallbackCrypto{token: token.(string), aesKey: aesKeyByte, key: key.(string)}, nil
+}
+
+func (c *DingdingCallbackCrypto) Signature(timestamp, nonce, encrypt string) string {
+	strs := []string{c.token, timestamp, nonce, encrypt}
+	sort.Strings(strs)
+	sum := sha1.Sum([]byte(strings.Join(strs, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *DingdingCallbackCrypto) Decrypt(encrypt string) ([]byte, error) {
+	cipherText, err := base64.StdEncoding.DecodeString(encrypt)
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherText) == 0 || len(cipherText)%aes.BlockSize != 0 {
+		return nil, errors.New("cipher text length not valid")
+	}
+	block, err := aes.NewCipher(c.aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(cipherText))
+	cipher.NewCBCDecrypter(block, c.aesKey[:aes.BlockSize]).CryptBlocks(plain, cipherText)
+
+	pad := int(plain[len(plain)-1])
+	if pad < 1 || pad > 32 || pad > len(plain) {
+		return nil, errors.New("padding not valid")
+	}
+	plain = plain[:len(plain)-pad]
+	if len(plain) < 20 {
+		return nil, errors.New("plain text too short")
+	}
+	msgLen := int(binary.BigEndian.Uint32(plain[16:20]))
+	if msgLen > len(plain)-20 {
+		return nil, errors.New("message length not valid")
+	}
+	if string(plain[20+msgLen:]) != c.key {
+		return nil, errors.New("key not match")
+	}
+	return plain[20 : 20+msgLen], nil
+}
+
+func (c *DingdingCallbackCrypto) Encrypt(msg []byte) (string, error) {
+	var buf bytes.Buffer
+	random := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return "", err
+	}
+	buf.Write(random)
+	binary.Write(&buf, binary.BigEndian, uint32(len(msg)))
+	buf.Write(msg)
+	buf.WriteString(c.key)
+	pad := 32 - buf.Len()%32
+	buf.Write(bytes.Repeat([]byte{byte(pad)}, pad))
+
+	block, err := aes.NewCipher(c.aesKey)
+	if err != nil {
+		return "", err
+	}
+	cipherText := make([]byte, buf.Len())
+	cipher.NewCBCEncrypter(block, c.aesKey[:aes.BlockSize]).CryptBlocks(cipherText, buf.Bytes())
+	return base64.StdEncoding.EncodeToString(cipherText), nil
+}
+
+// timestamp是毫秒, 和本机时间相差超过 dingdingCallbackMaxSkew 秒的不处理
+func isDingdingCallbackTimestampValid(timestamp string) bool {
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Now().Unix() - ms/1000
+	return skew <= dingdingCallbackMaxSkew && skew >= -dingdingCallbackMaxSkew
+}
+
+func dingdingCallbackHandler(crypto *DingdingCallbackCrypto) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		switch req.Method {
+		case "POST":
+			gets := req.URL.Query()
+			signature := gets.Get("msg_signature")
+			if signature == "" {
+				signature = gets.Get("signature")
+			}
+			timestamp := gets.Get("timestamp")
+			nonce := gets.Get("nonce")
+
+			var body struct {
+				Encrypt string `json:"encrypt"`
+			}
+			if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil || body.Encrypt == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				EchoJson(w, "err:20", nil)
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(crypto.Signature(timestamp, nonce, body.Encrypt)), []byte(signature)) != 1 {
+				loger.Println("dingding callback signature not match, remote:", req.RemoteAddr)
+				w.WriteHeader(http.StatusForbidden)
+				EchoJson(w, "err:46", nil)
+				return
+			}
+			if !isDingdingCallbackTimestampValid(timestamp) { // 签名正确但时间太久的是被截获后重放的
+				loger.Println("dingding callback timestamp expired:", timestamp, "remote:", req.RemoteAddr)
+				w.WriteHeader(http.StatusForbidden)
+				EchoJson(w, "err:46", nil)
+				return
+			}
+			msg, err := crypto.Decrypt(body.Encrypt)
+			if err != nil {
+				loger.Println("dingding callback decrypt error:", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				EchoJson(w, "err:47", nil)
+				return
+			}
+			loger.Println("dingding callback:", string(msg))
+
+			var event DingdingCallbackEvent
+			if err := json.Unmarshal(msg, &event); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				EchoJson(w, "err:47", nil)
+				return
+			}
+			handleDingdingEvent(event)
+
+			// 不管什么事件都要返回加密的success, 否则钉钉会重试
+			replyTimestamp := strconv.FormatInt(time.Now().UnixNano()/1e6, 10)
+			replyNonce := GetRandomStr(16)
+			encrypt, err := crypto.Encrypt([]byte("success"))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				EchoJson(w, "err:47", nil)
+				return
+			}
+			reply, _ := json.Marshal(map[string]string{
+				"msg_signature": crypto.Signature(replyTimestamp, replyNonce, encrypt),
+				"timeStamp":     replyTimestamp,
+				"nonce":         replyNonce,
+				"encrypt":       encrypt,
+			})
+			w.Write(reply)
+			return
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+	}
+}
+
+func handleDingdingEvent(event DingdingCallbackEvent) {
+	switch event.EventType {
+	case "check_url": // 开发者后台保存回调地址时的校验
+	case "user_leave_org":
+		for _, userId := range event.UserId {
+			forbidLeftUser(userId)
+		}
+	case "user_add_org": // 离职后又入职, 解除离职时加的限制
+		for _, userId := range event.UserId {
+			MemForbiddenMap.Delete(userId)
+		}
+	case "user_modify_org":
+		for _, userId := range event.UserId {
+			refreshUserTickets(userId)
+		}
+	case "org_dept_modify": // 可能改了上级部门, 下级部门的路径也变了
+		deptCache.InvalidateAll()
+	case "org_dept_remove":
+		for _, deptId := range event.DeptId {
+			deptCache.Invalidate("dingtalk", strconv.FormatInt(deptId, 10))
+		}
+	}
+}
+
+// ticket里保存的部门id, 事件推送时员工的部门可能已经变了, 旧部门的缓存也要删
+func ticketDeptIds(tickets []SsoUserInfoStruct) []string {
+	var deptIds []string
+	for _, ssoUserInfo := range tickets {
+		for _, dept := range ssoUserInfo.SsoUserDeptInfo {
+			deptIds = append(deptIds, dept.SsoDeptId)
+		}
+	}
+	return deptIds
+}
+
+// 离职的员工立即删除ticket, 并在ticket_max_ttl内禁止登录
+func forbidLeftUser(userId string) {
+	name := ""
+	var tickets []SsoUserInfoStruct
+	MemMap.Range(func(key, value interface{}) bool {
+		var ssoUserInfo SsoUserInfoStruct
+		if jsonByte, ok := value.([]byte); ok && json.Unmarshal(jsonByte, &ssoUserInfo) == nil && ssoUserInfo.SsoDingdingUserId == userId && ssoUserInfo.SsoContactType == 0 {
+			name = ssoUserInfo.SsoName
+			tickets = append(tickets, ssoUserInfo)
+		}
+		return true
+	})
+	deptCache.InvalidateUser("dingtalk", userId, ticketDeptIds(tickets))
+	count := revokeUserTickets("dingtalk", userId, 0)
+
+	// 离职的人ticket最多还能用ticket_max_ttl秒, 这段时间内禁止扫码
+	MemForbiddenMap.Store(userId, ForbiddenStruct{SsoName: name, SsoContactType: 0, Expired: time.Now().Unix() + getConfig().TicketMaxTTL, Reason: "离职"})
+	audit(AuditEvent{Event: AuditTicketRevoked, UserId: userId, UserName: name, Provider: "dingtalk", Detail: "user_leave_org event, tickets: " + strconv.Itoa(count)})
+}
+
+// 员工信息(姓名/部门/职位等)变了, 重新获取后更新他所有ticket里的用户信息, 业务方下次fetch拿到的就是新的
+func refreshUserTickets(userId string) {
+	tickets := map[string]SsoUserInfoStruct{}
+	var oldTickets []SsoUserInfoStruct
+	MemMap.Range(func(key, value interface{}) bool {
+		var ssoUserInfo SsoUserInfoStruct
+		if jsonByte, ok := value.([]byte); ok && json.Unmarshal(jsonByte, &ssoUserInfo) == nil && ssoUserInfo.SsoDingdingUserId == userId && ssoUserInfo.SsoContactType == 0 && (ssoUserInfo.SsoProvider == "" || ssoUserInfo.SsoProvider == "dingtalk") {
+			tickets[key.(string)] = ssoUserInfo
+			oldTickets = append(oldTickets, ssoUserInfo)
+		}
+		return true
+	})
+	oldDeptIds := ticketDeptIds(oldTickets)
+	deptCache.InvalidateUser("dingtalk", userId, oldDeptIds) // 没有ticket的也要删, 下次登录用新的
+	if len(tickets) == 0 {
+		return
+	}
+	provider, ok := getIdentityProvider("dingtalk")
+	if !ok {
+		return
+	}
+
+	var identity ProviderIdentity
+	name := ""
+	for _, ssoUserInfo := range tickets {
+		identity = ProviderIdentity{UnionId: ssoUserInfo.SsoDingdingUnionId, OpenId: ssoUserInfo.SsoDingdingOpenId, NickName: ssoUserInfo.SsoDingdingNickName, UserId: userId}
+		name = ssoUserInfo.SsoName
+		break
+	}
+	var raw DingdingRawStruct
+	ssoUserInfo, err := buildInternalSsoUser(provider, userId, identity, &raw)
+	if err == nil { // 调到了新部门, 新部门之前缓存的主管列表里可能还没有他, 删掉重新查一次
+		invalidated := map[string]bool{}
+		for _, deptId := range oldDeptIds {
+			invalidated[deptId] = true
+		}
+		var newDeptIds []string
+		for _, dept := range ssoUserInfo.SsoUserDeptInfo {
+			if !invalidated[dept.SsoDeptId] {
+				newDeptIds = append(newDeptIds, dept.SsoDeptId)
+			}
+		}
+		if len(newDeptIds) > 0 {
+			deptCache.InvalidateUser("dingtalk", userId, newDeptIds)
+			raw = DingdingRawStruct{}
+			ssoUserInfo, err = buildInternalSsoUser(provider, userId, identity, &raw)
+		}
+	}
+	if err != nil {
+		if providerError, ok := err.(*ProviderError); ok && (providerError.ErrId == "err:12" || providerError.ErrId == "err:9:1") {
+			count := revokeUserTickets("dingtalk", userId, 0)
+			audit(AuditEvent{Event: AuditTicketRevoked, UserId: userId, UserName: name, Provider: "dingtalk", ErrCode: providerError.ErrId, Detail: "user_modify_org event, tickets: " + strconv.Itoa(count)})
+			return
+		}
+		loger.Println("dingding callback refresh user", userId, "error:", err.Error())
+		return
+	}
+	for ticket, old := range tickets {
+		ssoUserInfo.SsoTicket = old.SsoTicket
+		ssoUserInfo.SsoSessionToken = old.SsoSessionToken // 会话令牌是扫码时签发的, 业务方可能已经拿去用了
+		ssoUserByte, err := json.Marshal(ssoUserInfo)
+		if err != nil {
+			continue
+		}
+		expired, ok := MemMapTTL.Load(ticket)
+		if !ok { // 刚好被删掉或者过期的不要再写回去
+			continue
+		}
+		MemMap.Store(ticket, ssoUserByte)
+		sessionStore.Expire("ticket", ticket, expired.(int64)) // redis的SET会清掉原来的过期时间
+	}
+	loger.Println("dingding callback refresh user", userId, "tickets:", len(tickets))
+}
+
+func registerDingdingCallbackHandlers() {
+	callbackUrl, ok := ConfigMap.Load("dingding_callback_url")
+	if !ok || len(callbackUrl.(string)) == 0 {
+		panic("config dingding_callback_url not found")
+	}
+	crypto, err := getDingdingCallbackCrypto()
+	if err != nil {
+		panic(err)
+	}
+	http.Handle(callbackUrl.(string), dingdingCallbackHandler(crypto))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestCallbackCrypto() *DingdingCallbackCrypto {
+	return &DingdingCallbackCrypto{token: "callback-token", aesKey: bytes.Repeat([]byte("k"), 32), key: "ding-app-key"}
+}
+
+// 按钉钉的方式加密签名后推送, 返回状态码和返回内容
+func postDingdingCallback(t *testing.T, crypto *DingdingCallbackCrypto, event DingdingCallbackEvent, timestamp int64, signature string) *httptest.ResponseRecorder {
+	t.Helper()
+	msg, _ := json.Marshal(event)
+	encrypt, err := crypto.Encrypt(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestampStr := strconv.FormatInt(timestamp, 10)
+	if signature == "" {
+		signature = crypto.Signature(timestampStr, "nonce1", encrypt)
+	}
+	body, _ := json.Marshal(map[string]string{"encrypt": encrypt})
+	query := url.Values{"msg_signature": {signature}, "timestamp": {timestampStr}, "nonce": {"nonce1"}}
+	w := httptest.NewRecorder()
+	dingdingCallbackHandler(crypto)(w, httptest.NewRequest("POST", "/dingding/callback?"+query.Encode(), bytes.NewReader(body)))
+	return w
+}
+
+func TestDingdingCallbackRejectsBadSignatureAndTimestamp(t *testing.T) {
+	setTestConfig(t, nil)
+	crypto := newTestCallbackCrypto()
+	nowMs := time.Now().UnixNano() / 1e6
+	event := DingdingCallbackEvent{EventType: "check_url"}
+
+	tests := []struct {
+		name      string
+		timestamp int64
+		signature string
+		want      int
+	}{
+		{"valid", nowMs, "", http.StatusOK},
+		{"wrong signature", nowMs, "0123456789abcdef0123456789abcdef01234567", http.StatusForbidden},
+		{"replayed 10 minutes later", nowMs - 600*1000, "", http.StatusForbidden},
+		{"timestamp in the future", nowMs + 600*1000, "", http.StatusForbidden},
+		{"timestamp in seconds", nowMs / 1000, "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := postDingdingCallback(t, crypto, event, tt.timestamp, tt.signature)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d, body %s", tt.name, w.Code, tt.want, w.Body.String())
+		}
+	}
+
+	// 正确的推送要返回加密的success
+	w := postDingdingCallback(t, crypto, event, nowMs, "")
+	var reply map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if crypto.Signature(reply["timeStamp"], reply["nonce"], reply["encrypt"]) != reply["msg_signature"] {
+		t.Error("reply signature not valid")
+	}
+	if msg, err := crypto.Decrypt(reply["encrypt"]); err != nil || string(msg) != "success" {
+		t.Errorf("reply = %q, %v", msg, err)
+	}
+}
+
+// 离职事件删掉ticket, 同时删掉他所在部门和他当主管的部门的缓存
+func TestDingdingCallbackUserLeaveOrg(t *testing.T) {
+	setTestConfig(t, nil)
+	oldStore := sessionStore
+	sessionStore = NewMemoryStore()
+	defer func() {
+		sessionStore = oldStore
+		deptCache.InvalidateAll()
+	}()
+
+	ssoUserByte, _ := json.Marshal(SsoUserInfoStruct{SsoDingdingUserId: "u1", SsoName: "张三", SsoUserDeptInfo: []SsoUserDeptStruct{{SsoDeptId: "10"}}})
+	MemMap.Store("ticket-u1", ssoUserByte)
+	MemMapTTL.Store("ticket-u1", time.Now().Unix()+600)
+
+	provider, _ := getIdentityProvider("dingtalk")
+	expired := time.Now().Unix() + 600
+	deptCache.InvalidateAll()
+	deptCache.entries["dingtalk:10"] = &deptCacheEntry{provider: provider, dept: ProviderDept{Id: "10"}, expired: expired}
+	deptCache.entries["dingtalk:20"] = &deptCacheEntry{provider: provider, dept: ProviderDept{Id: "20", ManagerUserIds: []string{"u1"}}, expired: expired}
+	deptCache.entries["dingtalk:30"] = &deptCacheEntry{provider: provider, dept: ProviderDept{Id: "30", ManagerUserIds: []string{"u2"}}, expired: expired}
+
+	w := postDingdingCallback(t, newTestCallbackCrypto(), DingdingCallbackEvent{EventType: "user_leave_org", UserId: []string{"u1"}}, time.Now().UnixNano()/1e6, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+	if _, ok := MemMap.Load("ticket-u1"); ok {
+		t.Error("ticket of left user not revoked")
+	}
+	if _, ok := MemForbiddenMap.Load("u1"); !ok {
+		t.Error("left user not forbidden")
+	}
+	for deptId, want := range map[string]bool{"10": false, "20": false, "30": true} {
+		if _, ok := deptCache.entries["dingtalk:"+deptId]; ok != want {
+			t.Errorf("dept %s cached = %v, want %v", deptId, ok, want)
+		}
+	}
+}
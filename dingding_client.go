@@ -0,0 +1,418 @@
+package main
+
+// 钉钉接口客户端, 每个用到的接口都有请求和返回结构体, 不再从map[string]interface{}里断言取值
+// 钉钉返回errcode不是0时返回*DingdingError, 带上errcode/sub_code/request_id, 用errors.As取出来判断
+// 网络错误/返回内容不是json 返回的是普通error
+// 每个方法都把钉钉返回的原始内容一起返回, 调用方记日志和放到DingdingRawStruct里
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DingdingErrUserNotFound       = 60121 // 找不到该用户
+	DingdingErrInvalidAccessToken = 40014 // 不合法的access_token
+	DingdingErrAccessTokenExpired = 42001 // access_token超时
+	DingdingErrDepartmentNotFound = 60003 // 部门不存在
+	DingdingErrInvalidTmpAuthCode = 40078 // 不存在的临时授权码
+)
+
+type DingdingError struct {
+	ErrCode   int64  `json:"errcode"`
+	ErrMsg    string `json:"errmsg"`
+	SubCode   string `json:"sub_code"`
+	SubMsg    string `json:"sub_msg"`
+	RequestId string `json:"request_id"`
+}
+
+func (e *DingdingError) Error() string {
+	msg := "dingtalk errcode " + strconv.FormatInt(e.ErrCode, 10) + " " + e.ErrMsg
+	if e.SubCode != "" {
+		msg += " sub_code " + e.SubCode + " " + e.SubMsg
+	}
+	if e.RequestId != "" {
+		msg += " request_id " + e.RequestId
+	}
+	return msg
+}
+
+// 钉钉接口返回的业务错误码, 不是钉钉业务错误(网络错误等)返回0
+func DingdingErrCode(err error) int64 {
+	var dingdingError *DingdingError
+	if errors.As(err, &dingdingError) {
+		return dingdingError.ErrCode
+	}
+	return 0
+}
+
+func IsDingdingUserNotFound(err error) bool {
+	return DingdingErrCode(err) == DingdingErrUserNotFound
+}
+
+func isDingdingTokenInvalid(err error) bool {
+	var dingdingError *DingdingError
+	if !errors.As(err, &dingdingError) {
+		return false
+	}
+	return dingdingError.ErrCode == DingdingErrInvalidAccessToken || dingdingError.ErrCode == DingdingErrAccessTokenExpired ||
+		dingdingError.SubCode == strconv.Itoa(DingdingErrInvalidAccessToken) || dingdingError.SubCode == strconv.Itoa(DingdingErrAccessTokenExpired)
+}
+
+// 旧版接口都有的errcode/errmsg
+type dingdingResponse interface {
+	dingdingError() *DingdingError
+}
+
+type DingdingBaseResponse struct {
+	DingdingError
+}
+
+func (r *DingdingBaseResponse) dingdingError() *DingdingError {
+	return &r.DingdingError
+}
+
+type DingdingTokenResponse struct {
+	DingdingBaseResponse
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type DingdingSnsUserInfo struct {
+	Nick                 string `json:"nick"`
+	UnionId              string `json:"unionid"`
+	OpenId               string `json:"openid"`
+	DingId               string `json:"dingId"`
+	MainOrgAuthHighLevel bool   `json:"main_org_auth_high_level"`
+}
+
+type DingdingSnsUserInfoResponse struct {
+	DingdingBaseResponse
+	UserInfo *DingdingSnsUserInfo `json:"user_info"`
+}
+
+type DingdingUnionIdResult struct {
+	ContactType *int64 `json:"contact_type"` // 0 内部员工  1 外部联系人
+	UserId      string `json:"userid"`
+}
+
+type DingdingUnionIdResponse struct {
+	DingdingBaseResponse
+	Result *DingdingUnionIdResult `json:"result"`
+}
+
+type DingdingUser struct {
+	UserId     string  `json:"userid"`
+	UnionId    string  `json:"unionid"`
+	Name       string  `json:"name"`
+	Mobile     string  `json:"mobile"`
+	Avatar     string  `json:"avatar"`
+	Title      string  `json:"title"`
+	StateCode  string  `json:"state_code"`
+	JobNumber  string  `json:"job_number"`
+	Email      string  `json:"email"`
+	Admin      bool    `json:"admin"`
+	Active     *bool   `json:"active"`       // 没有这个字段说明接口返回有问题
+	DeptIdList []int64 `json:"dept_id_list"` // 离职员工没有部门
+}
+
+type DingdingUserResponse struct {
+	DingdingBaseResponse
+	Result *DingdingUser `json:"result"`
+}
+
+type DingdingDepartment struct {
+	DeptId                int64    `json:"dept_id"`
+	Name                  *string  `json:"name"`
+	ParentId              int64    `json:"parent_id"`
+	DeptManagerUseridList []string `json:"dept_manager_userid_list"` // 部门管理员, 注意org_dept_owner仅仅是群主userId
+	OrgDeptOwner          string   `json:"org_dept_owner,omitempty"`
+}
+
+type DingdingDepartmentResponse struct {
+	DingdingBaseResponse
+	Result *DingdingDepartment `json:"result"`
+}
+
+type DingdingParentDeptResult struct {
+	ParentIdList []int64 `json:"parent_id_list"` // 从自己到根部门
+}
+
+type DingdingParentDeptResponse struct {
+	DingdingBaseResponse
+	Result *DingdingParentDeptResult `json:"result"`
+}
+
+type DingdingExternalContact struct {
+	UserId         string  `json:"userid"`
+	Name           string  `json:"name"`
+	Mobile         string  `json:"mobile"`
+	Title          string  `json:"title"`
+	StateCode      string  `json:"state_code"`
+	CompanyName    string  `json:"company_name"`
+	Email          string  `json:"email"`
+	Address        string  `json:"address"`
+	Remark         string  `json:"remark"`
+	FollowerUserId string  `json:"follower_user_id"`
+	LabelIds       []int64 `json:"label_ids,omitempty"`
+}
+
+type DingdingExternalContactResponse struct {
+	DingdingBaseResponse
+	Result *DingdingExternalContact `json:"result"`
+}
+
+type DingdingAsyncSendResponse struct {
+	DingdingBaseResponse
+	TaskId int64 `json:"task_id"`
+}
+
+// 新版v1.0接口出错时http状态码不是200, 返回 {"code":"InvalidAuthentication","message":"不合法的临时授权码","requestid":"..."}
+type dingdingV1Error struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"requestid"`
+}
+
+type DingdingUserAccessToken struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpireIn     int64  `json:"expireIn"`
+	CorpId       string `json:"corpId"`
+}
+
+type DingdingContactUser struct {
+	Nick      string `json:"nick"`
+	AvatarUrl string `json:"avatarUrl"`
+	Mobile    string `json:"mobile"`
+	OpenId    string `json:"openId"`
+	UnionId   string `json:"unionId"`
+	Email     string `json:"email"`
+	StateCode string `json:"stateCode"`
+}
+
+type DingdingClient struct {
+	httpClient *http.Client
+}
+
+var dingdingClient = &DingdingClient{httpClient: &http.Client{Timeout: time.Second * 10}}
+
+var dingdingAccessToken = NewAccessTokenManager("dingtalk", func() (string, int64, error) {
+	dingdingAppKey, _ := ConfigMap.Load("dingding_app_key")
+	dingdingAppSecret, _ := ConfigMap.Load("dingding_app_secret")
+	resp, respBody, err := dingdingClient.GetAccessToken(dingdingAppKey.(string), dingdingAppSecret.(string))
+	if err != nil {
+		return "", 0, newProviderError("err:24", http.StatusInternalServerError, respBody, err)
+	}
+	if resp.AccessToken == "" {
+		return "", 0, newProviderError("err:25", http.StatusInternalServerError, respBody, nil)
+	}
+	return resp.AccessToken, resp.ExpiresIn, nil
+})
+
+// 日志里不能出现的参数, 值换成REDACTED
+var redactQueryKeys = []string{"appsecret", "access_token", "signature", "corpsecret"}
+
+// 去掉地址里的密钥和access_token再记日志
+func redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "(invalid url)"
+	}
+	query := u.Query()
+	for _, key := range redactQueryKeys {
+		if query.Get(key) != "" {
+			query.Set(key, "REDACTED")
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// 发请求, 返回原始内容
+func (c *DingdingClient) do(method, rawUrl string, body interface{}, headers map[string]string) ([]byte, int, error) {
+	var postBody []byte
+	if body != nil {
+		var err error
+		if postBody, err = json.Marshal(body); err != nil {
+			return nil, 0, err
+		}
+	}
+	loger.Println("New Request,", method, redactUrl(rawUrl)) // 请求内容里有clientSecret/临时授权码, 不记日志
+	request, err := http.NewRequest(method, rawUrl, bytes.NewReader(postBody))
+	if err != nil {
+		return nil, 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+	respBody, err := ioutil.ReadAll(response.Body)
+	return respBody, response.StatusCode, err
+}
+
+// 调用旧版接口, errcode不是0返回*DingdingError
+func (c *DingdingClient) call(method, path string, query url.Values, body interface{}, resp dingdingResponse) (respBody []byte, err error) {
+	rawUrl := GetDingdingApiBase("oapi") + path
+	if len(query) > 0 {
+		rawUrl += "?" + query.Encode()
+	}
+	defer func(start time.Time) { observeApiRequest(rawUrl, start, err) }(time.Now())
+	respBody, _, err = c.do(method, rawUrl, body, nil)
+	if err != nil {
+		return respBody, err
+	}
+	if err := json.Unmarshal(respBody, resp); err != nil {
+		return respBody, errors.New("dingtalk response not json: " + string(respBody))
+	}
+	if dingdingError := resp.dingdingError(); dingdingError.ErrCode != 0 {
+		return respBody, dingdingError
+	}
+	return respBody, nil
+}
+
+// 带access_token调用, token不合法或者过期(40014 42001)时刷新一次再调
+// 获取token失败返回的是*ProviderError
+func (c *DingdingClient) callWithToken(method, path string, body interface{}, resp dingdingResponse) ([]byte, error) {
+	accessToken, err := dingdingAccessToken.Get()
+	if err != nil {
+		return nil, err
+	}
+	for errCount := 1; ; errCount++ {
+		respBody, err := c.call(method, path, url.Values{"access_token": {accessToken}}, body, resp)
+		// {"errcode":88,"sub_code":"40014","sub_msg":"不合法的access_token","errmsg":"ding talk error[subcode=40014,submsg=不合法的access_token]","request_id":"h4**x7**xjj6"}
+		if isDingdingTokenInvalid(err) && errCount < 2 {
+			if accessToken, err = dingdingAccessToken.Refresh(accessToken); err != nil {
+				return nil, err
+			}
+			*resp.dingdingError() = DingdingError{}
+			continue
+		}
+		return respBody, err
+	}
+}
+
+// 调用新版v1.0接口, http状态码不是200返回*DingdingError, ErrCode是http状态码, SubCode是钉钉返回的code
+func (c *DingdingClient) callV1(method, path string, body interface{}, headers map[string]string, resp interface{}) (respBody []byte, err error) {
+	rawUrl := GetDingdingApiBase("api") + path
+	defer func(start time.Time) { observeApiRequest(rawUrl, start, err) }(time.Now())
+	respBody, status, err := c.do(method, rawUrl, body, headers)
+	if err != nil {
+		return respBody, err
+	}
+	if status != http.StatusOK {
+		var v1Error dingdingV1Error
+		if err := json.Unmarshal(respBody, &v1Error); err != nil {
+			return respBody, errors.New("dingtalk http status " + strconv.Itoa(status) + ": " + string(respBody))
+		}
+		return respBody, &DingdingError{ErrCode: int64(status), ErrMsg: v1Error.Message, SubCode: v1Error.Code, RequestId: v1Error.RequestId}
+	}
+	if err := json.Unmarshal(respBody, resp); err != nil {
+		return respBody, errors.New("dingtalk response not json: " + string(respBody))
+	}
+	return respBody, nil
+}
+
+// {"errcode": 0, "access_token": "96fc7a7axxx", "errmsg": "ok", "expires_in": 7200}
+func (c *DingdingClient) GetAccessToken(appKey, appSecret string) (*DingdingTokenResponse, []byte, error) {
+	var resp DingdingTokenResponse
+	respBody, err := c.call("GET", "/gettoken", url.Values{"appkey": {appKey}, "appsecret": {appSecret}}, nil, &resp)
+	return &resp, respBody, err
+}
+
+// 旧版扫码登录, 用临时授权码换扫码人信息, 需要用appSecret签名
+// {"errcode":0,"errmsg":"ok","user_info":{"nick":"潘**","unionid":"uT19di******HpS5hGk**QiEiE","dingId":"$:LWCP_v1:$**zuci4Nk**g==","openid":"b5B**fR04Xf**AiEiE","main_org_auth_high_level":true}}
+func (c *DingdingClient) GetUserInfoByCode(appKey, appSecret, tmpAuthCode string) (*DingdingSnsUserInfoResponse, []byte, error) {
+	timestamp := strconv.FormatInt(time.Now().UnixNano()/1e6, 10)
+	signature := base64.StdEncoding.EncodeToString(Sha256(timestamp, appSecret))
+	var resp DingdingSnsUserInfoResponse
+	respBody, err := c.call("POST", "/sns/getuserinfo_bycode", url.Values{"accessKey": {appKey}, "timestamp": {timestamp}, "signature": {signature}}, map[string]string{"tmp_auth_code": tmpAuthCode}, &resp)
+	return &resp, respBody, err
+}
+
+// 内部员工 {"errcode":0,"errmsg":"ok","result":{"contact_type":0,"userid":"0138**711**71"},"request_id":"8e7a**vz**uwl"}
+// 外部联系人 {"errcode":0,"errmsg":"ok","result":{"contact_type":1,"userid":"0121281**19**912**8"},"request_id":"fmf**ma**loop0"}
+// 陌生人 {"errcode":60121,"errmsg":"找不到该用户","request_id":"xyv**o2**y4n4"}
+func (c *DingdingClient) GetUserIdByUnionId(unionId string) (*DingdingUnionIdResponse, []byte, error) {
+	var resp DingdingUnionIdResponse
+	respBody, err := c.callWithToken("POST", "/topapi/user/getbyunionid", map[string]string{"unionid": unionId}, &resp)
+	return &resp, respBody, err
+}
+
+// 内部员工 {"errcode":0,"errmsg":"ok","result":{"active":true,"admin":true,"avatar":"","dept_id_list":[**008**187],"mobile":"150**66**01","name":"潘****","state_code":"86","title":"架构师","unionid":"uT1**iPn**HpS5h**QiE**E","userid":"01**110528**03**1"},"request_id":"4mo**qs**p3**h"}
+// 外部联系人 {"errcode":60121,"errmsg":"找不到该用户","request_id":"wgd**pxca**z"}
+func (c *DingdingClient) GetUser(userId string) (*DingdingUserResponse, []byte, error) {
+	var resp DingdingUserResponse
+	respBody, err := c.callWithToken("POST", "/topapi/v2/user/get", map[string]string{"userid": userId}, &resp)
+	return &resp, respBody, err
+}
+
+// {"errcode":0,"errmsg":"ok","result":{"dept_id":**85****,"dept_manager_userid_list":["07*********61"],"name":"****部","org_dept_owner":"0**1711**50**","parent_id":**53**},"request_id":"ij**bn**m"}
+func (c *DingdingClient) GetDepartment(deptId string) (*DingdingDepartmentResponse, []byte, error) {
+	var resp DingdingDepartmentResponse
+	respBody, err := c.callWithToken("POST", "/topapi/v2/department/get", map[string]string{"dept_id": deptId}, &resp)
+	return &resp, respBody, err
+}
+
+// 部门的所有上级部门, 第一个是自己, 最后一个是根部门1
+// {"errcode":0,"errmsg":"ok","result":{"parent_id_list":[**85**7,**53**,1]},"request_id":"ij**bn**m"}
+func (c *DingdingClient) ListParentByDept(deptId string) (*DingdingParentDeptResponse, []byte, error) {
+	var resp DingdingParentDeptResponse
+	respBody, err := c.callWithToken("POST", "/topapi/v2/department/listparentbydept", map[string]string{"dept_id": deptId}, &resp)
+	return &resp, respBody, err
+}
+
+// {"errcode":0,"errmsg":"ok","result":{"address":"地址(非必填)","company_name":"公司名(非必填)","email":"邮箱(非必填)","follower_user_id":"013**11052**371","mobile":"131**87**7","name":"潘潘","remark":"备注(非必填)","state_code":"86","title":"职位名(非必填)","userid":"01**281**291**8"},"request_id":"p**hd**z**n"}
+func (c *DingdingClient) GetExternalContact(userId string) (*DingdingExternalContactResponse, []byte, error) {
+	var resp DingdingExternalContactResponse
+	respBody, err := c.callWithToken("POST", "/topapi/extcontact/get", map[string]string{"user_id": userId}, &resp)
+	return &resp, respBody, err
+}
+
+// 工作通知, markdown格式, userIdList用逗号分割
+func (c *DingdingClient) SendMarkdown(agentId, userIdList, title, text string) (*DingdingAsyncSendResponse, []byte, error) {
+	var resp DingdingAsyncSendResponse
+	respBody, err := c.callWithToken("POST", "/topapi/message/corpconversation/asyncsend_v2", map[string]interface{}{
+		"agent_id":    agentId,
+		"userid_list": userIdList,
+		"to_all_user": false,
+		"msg": map[string]interface{}{
+			"msgtype":  "markdown",
+			"markdown": map[string]string{"title": title, "text": text},
+		},
+	}, &resp)
+	return &resp, respBody, err
+}
+
+// 新版登录, 用authCode换用户的accessToken
+// {"accessToken":"abcd","refreshToken":"abcd","expireIn":7200,"corpId":"corpxxxx"}
+func (c *DingdingClient) GetUserAccessToken(clientId, clientSecret, code string) (*DingdingUserAccessToken, []byte, error) {
+	var resp DingdingUserAccessToken
+	respBody, err := c.callV1("POST", "/v1.0/oauth2/userAccessToken", map[string]string{
+		"clientId":     clientId,
+		"clientSecret": clientSecret,
+		"code":         code,
+		"grantType":    "authorization_code",
+	}, nil, &resp)
+	return &resp, respBody, err
+}
+
+// 新版登录, 用用户的accessToken取扫码人信息
+// {"nick":"zhangsan","avatarUrl":"https://xxx","mobile":"150xxxx9144","openId":"123","unionId":"z21HjQliSzpw0Yxxxx","email":"zhangsan@alibaba-inc.com","stateCode":"86"}
+func (c *DingdingClient) GetContactUserMe(userAccessToken string) (*DingdingContactUser, []byte, error) {
+	var resp DingdingContactUser
+	respBody, err := c.callV1("GET", "/v1.0/contact/users/me", nil, map[string]string{"x-acs-dingtalk-access-token": userAccessToken}, &resp)
+	return &resp, respBody, err
+}
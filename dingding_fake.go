@@ -0,0 +1,309 @@
+package main
+
+// 假钉钉服务, dingding_fake_fixture 配置了fixture文件时启动, 所有钉钉接口都改为调用它
+// 员工/部门/外部联系人从fixture文件读取, 参考demo/dingding_fake.json
+// 扫码页列出fixture里的人, 点击谁就用谁登录, 配置了auto_login_unionid直接跳转回来, CI里用curl就能跑完 扫码 -> 回调 -> fetch 整个流程
+// 不校验appkey/签名, 只用来离线开发和测试, 不能在生产环境开启
+
+import (
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type FakeDingdingFixture struct {
+	AutoLoginUnionId string                        `json:"auto_login_unionid"` // 扫码页直接用这个人登录
+	Users            []FakeDingdingUser            `json:"users"`
+	Departments      []DingdingDepartment          `json:"departments"`
+	ExternalContacts []FakeDingdingExternalContact `json:"external_contacts"`
+	Strangers        []FakeDingdingUser            `json:"strangers"` // 能扫码但是不在通讯录的人
+}
+
+// 接口返回的字段和钉钉客户端用的结构体一样, 另外加上扫码时返回的unionid/openid/昵称
+type FakeDingdingUser struct {
+	DingdingUser
+	OpenId string `json:"openid"`
+	Nick   string `json:"nick"`
+}
+
+type FakeDingdingExternalContact struct {
+	DingdingExternalContact
+	UnionId string `json:"unionid"`
+	OpenId  string `json:"openid"`
+	Nick    string `json:"nick"`
+}
+
+type fakeDingding struct {
+	fixture FakeDingdingFixture
+	mutex   sync.Mutex
+	taskId  int // asyncsend_v2返回的task_id
+}
+
+const fakeDingdingAccessToken = "fake-dingding-access-token"
+
+func startFakeDingding() {
+	temp, ok := ConfigMap.Load("dingding_fake_fixture")
+	if !ok || temp.(string) == "" {
+		return
+	}
+	addr := "127.0.0.1:0"
+	if temp, ok := ConfigMap.Load("dingding_fake_addr"); ok && temp.(string) != "" {
+		addr = temp.(string)
+	}
+	base, err := StartFakeDingding(addr, temp.(string))
+	if err != nil {
+		panic("start fake dingding error: " + err.Error())
+	}
+	dingdingFakeBase = base
+	loger.Println("fake dingding listen on", base)
+}
+
+// 启动假钉钉服务, 返回地址前缀 http://ip:port
+func StartFakeDingding(addr, fixtureFile string) (string, error) {
+	b, err := ioutil.ReadFile(fixtureFile)
+	if err != nil {
+		return "", err
+	}
+	f := &fakeDingding{}
+	if err := json.Unmarshal(b, &f.fixture); err != nil {
+		return "", err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect/qrconnect", f.qrconnectHandler("code"))
+	mux.HandleFunc("/oauth2/auth", f.qrconnectHandler("authCode"))
+	mux.HandleFunc("/gettoken", f.gettokenHandler)
+	mux.HandleFunc("/sns/getuserinfo_bycode", f.getuserinfoBycodeHandler)
+	mux.HandleFunc("/topapi/user/getbyunionid", f.withToken(f.getbyunionidHandler))
+	mux.HandleFunc("/topapi/v2/user/get", f.withToken(f.userGetHandler))
+	mux.HandleFunc("/topapi/v2/department/get", f.withToken(f.departmentGetHandler))
+	mux.HandleFunc("/topapi/v2/department/listparentbydept", f.withToken(f.listParentByDeptHandler))
+	mux.HandleFunc("/topapi/extcontact/get", f.withToken(f.extcontactGetHandler))
+	mux.HandleFunc("/topapi/message/corpconversation/asyncsend_v2", f.withToken(f.asyncsendHandler))
+	mux.HandleFunc("/v1.0/oauth2/userAccessToken", f.userAccessTokenHandler)
+	mux.HandleFunc("/v1.0/contact/users/me", f.usersMeHandler)
+	go http.Serve(listener, mux)
+	return "http://" + listener.Addr().String(), nil
+}
+
+func fakeDingdingJson(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	b, _ := json.Marshal(data)
+	w.Write(b)
+}
+
+func fakeDingdingError(w http.ResponseWriter, errcode int, errmsg string) {
+	fakeDingdingJson(w, map[string]interface{}{"errcode": errcode, "errmsg": errmsg, "request_id": "fake" + GetRandomStr(10)})
+}
+
+// 读POST的json body
+func fakeDingdingBody(req *http.Request) map[string]interface{} {
+	body := make(map[string]interface{})
+	b, _ := ioutil.ReadAll(req.Body)
+	json.Unmarshal(b, &body)
+	return body
+}
+
+// 扫码页, 临时授权码就是扫码人的unionid
+func (f *fakeDingding) qrconnectHandler(codeName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		gets := req.URL.Query()
+		redirectUri := gets.Get("redirect_uri")
+		state := gets.Get("state")
+		callback := func(unionId string) string {
+			q := url.Values{codeName: {unionId}, "state": {state}}
+			if strings.Contains(redirectUri, "?") {
+				return redirectUri + "&" + q.Encode()
+			}
+			return redirectUri + "?" + q.Encode()
+		}
+		if f.fixture.AutoLoginUnionId != "" {
+			http.Redirect(w, req, callback(f.fixture.AutoLoginUnionId), http.StatusFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<h3>假钉钉扫码页, 选择登录的人</h3><ul>"))
+		link := func(unionId, name, kind string) {
+			w.Write([]byte(`<li><a href="` + html.EscapeString(callback(unionId)) + `">` + html.EscapeString(name) + `</a> ` + kind + `</li>`))
+		}
+		for _, user := range f.fixture.Users {
+			link(user.UnionId, user.Name, "员工")
+		}
+		for _, contact := range f.fixture.ExternalContacts {
+			link(contact.UnionId, contact.Name, "外部联系人")
+		}
+		for _, stranger := range f.fixture.Strangers {
+			link(stranger.UnionId, stranger.Nick, "陌生人")
+		}
+		w.Write([]byte("</ul>"))
+	}
+}
+
+func (f *fakeDingding) gettokenHandler(w http.ResponseWriter, req *http.Request) {
+	fakeDingdingJson(w, map[string]interface{}{"errcode": 0, "errmsg": "ok", "access_token": fakeDingdingAccessToken, "expires_in": 7200})
+}
+
+// accessToken不对返回40014, 和钉钉一样
+func (f *fakeDingding) withToken(next func(w http.ResponseWriter, req *http.Request, body map[string]interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("access_token") != fakeDingdingAccessToken {
+			fakeDingdingJson(w, map[string]interface{}{"errcode": 88, "sub_code": "40014", "sub_msg": "不合法的access_token", "errmsg": "ding talk error[subcode=40014,submsg=不合法的access_token]", "request_id": "fake" + GetRandomStr(10)})
+			return
+		}
+		next(w, req, fakeDingdingBody(req))
+	}
+}
+
+// 按unionid查找扫码人, 返回昵称和openid
+func (f *fakeDingding) findByUnionId(unionId string) (nick, openId string, ok bool) {
+	for _, user := range f.fixture.Users {
+		if user.UnionId == unionId {
+			return user.Nick, user.OpenId, true
+		}
+	}
+	for _, contact := range f.fixture.ExternalContacts {
+		if contact.UnionId == unionId {
+			return contact.Nick, contact.OpenId, true
+		}
+	}
+	for _, stranger := range f.fixture.Strangers {
+		if stranger.UnionId == unionId {
+			return stranger.Nick, stranger.OpenId, true
+		}
+	}
+	return "", "", false
+}
+
+func (f *fakeDingding) getuserinfoBycodeHandler(w http.ResponseWriter, req *http.Request) {
+	code := mapString(fakeDingdingBody(req), "tmp_auth_code")
+	nick, openId, ok := f.findByUnionId(code)
+	if !ok {
+		fakeDingdingError(w, 40078, "不存在的临时授权码")
+		return
+	}
+	fakeDingdingJson(w, map[string]interface{}{"errcode": 0, "errmsg": "ok", "user_info": map[string]interface{}{
+		"nick": nick, "unionid": code, "openid": openId, "main_org_auth_high_level": true,
+	}})
+}
+
+func (f *fakeDingding) getbyunionidHandler(w http.ResponseWriter, req *http.Request, body map[string]interface{}) {
+	unionId := mapString(body, "unionid")
+	for _, user := range f.fixture.Users {
+		if user.UnionId == unionId {
+			fakeDingdingJson(w, map[string]interface{}{"errcode": 0, "errmsg": "ok", "result": map[string]interface{}{"contact_type": 0, "userid": user.UserId}})
+			return
+		}
+	}
+	for _, contact := range f.fixture.ExternalContacts {
+		if contact.UnionId == unionId {
+			fakeDingdingJson(w, map[string]interface{}{"errcode": 0, "errmsg": "ok", "result": map[string]interface{}{"contact_type": 1, "userid": contact.UserId}})
+			return
+		}
+	}
+	fakeDingdingError(w, 60121, "找不到该用户")
+}
+
+func (f *fakeDingding) userGetHandler(w http.ResponseWriter, req *http.Request, body map[string]interface{}) {
+	userId := mapString(body, "userid")
+	for _, user := range f.fixture.Users {
+		if user.UserId == userId {
+			fakeDingdingJson(w, map[string]interface{}{"errcode": 0, "errmsg": "ok", "result": user})
+			return
+		}
+	}
+	fakeDingdingError(w, 60121, "找不到该用户")
+}
+
+func (f *fakeDingding) departmentGetHandler(w http.ResponseWriter, req *http.Request, body map[string]interface{}) {
+	deptId, _ := strconv.ParseInt(mapString(body, "dept_id"), 10, 64)
+	if deptId == 0 {
+		deptId = int64(mapFloat(body, "dept_id"))
+	}
+	for _, department := range f.fixture.Departments {
+		if department.DeptId == deptId {
+			fakeDingdingJson(w, map[string]interface{}{"errcode": 0, "errmsg": "ok", "result": department})
+			return
+		}
+	}
+	fakeDingdingError(w, 60003, "部门不存在")
+}
+
+// 沿着parent_id往上找, 第一个是自己
+func (f *fakeDingding) listParentByDeptHandler(w http.ResponseWriter, req *http.Request, body map[string]interface{}) {
+	deptId, _ := strconv.ParseInt(mapString(body, "dept_id"), 10, 64)
+	var parentIdList []int64
+	for len(parentIdList) < 100 {
+		found := false
+		for _, department := range f.fixture.Departments {
+			if department.DeptId == deptId {
+				parentIdList = append(parentIdList, deptId)
+				deptId = department.ParentId
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	if len(parentIdList) == 0 {
+		fakeDingdingError(w, 60003, "部门不存在")
+		return
+	}
+	fakeDingdingJson(w, map[string]interface{}{"errcode": 0, "errmsg": "ok", "result": map[string]interface{}{"parent_id_list": parentIdList}})
+}
+
+func (f *fakeDingding) extcontactGetHandler(w http.ResponseWriter, req *http.Request, body map[string]interface{}) {
+	userId := mapString(body, "user_id")
+	for _, contact := range f.fixture.ExternalContacts {
+		if contact.UserId == userId {
+			fakeDingdingJson(w, map[string]interface{}{"errcode": 0, "errmsg": "ok", "result": contact})
+			return
+		}
+	}
+	fakeDingdingError(w, 60121, "找不到该用户")
+}
+
+// 工作通知只记日志, 不真的发送
+func (f *fakeDingding) asyncsendHandler(w http.ResponseWriter, req *http.Request, body map[string]interface{}) {
+	b, _ := json.Marshal(body)
+	loger.Println("fake dingding asyncsend_v2:", string(b))
+	f.mutex.Lock()
+	f.taskId++
+	taskId := f.taskId
+	f.mutex.Unlock()
+	fakeDingdingJson(w, map[string]interface{}{"errcode": 0, "errmsg": "ok", "task_id": taskId, "request_id": "fake" + GetRandomStr(10)})
+}
+
+// 新版登录, 用户accessToken就是unionid加个前缀
+func (f *fakeDingding) userAccessTokenHandler(w http.ResponseWriter, req *http.Request) {
+	code := mapString(fakeDingdingBody(req), "code")
+	if _, _, ok := f.findByUnionId(code); !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fakeDingdingJson(w, map[string]interface{}{"code": "InvalidAuthentication", "message": "不合法的临时授权码", "requestid": "fake" + GetRandomStr(10)})
+		return
+	}
+	fakeDingdingJson(w, map[string]interface{}{"accessToken": "fake-user-" + code, "refreshToken": "fake-refresh-" + code, "expireIn": 7200, "corpId": "fakecorp"})
+}
+
+func (f *fakeDingding) usersMeHandler(w http.ResponseWriter, req *http.Request) {
+	unionId := strings.TrimPrefix(req.Header.Get("x-acs-dingtalk-access-token"), "fake-user-")
+	nick, openId, ok := f.findByUnionId(unionId)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		fakeDingdingJson(w, map[string]interface{}{"code": "InvalidAuthentication", "message": "不合法的access_token", "requestid": "fake" + GetRandomStr(10)})
+		return
+	}
+	fakeDingdingJson(w, map[string]interface{}{"nick": nick, "unionId": unionId, "openId": openId, "stateCode": "86"})
+}
@@ -0,0 +1,138 @@
+package main
+
+// 健康检查, 给负载均衡和k8s探测用
+// healthz_url 进程活着就返回200
+// readyz_url 检查配置文件/钉钉accessToken/日志目录/会话存储, 有一项不通过返回503, 每项的结果都在json里
+//   readyz_url不限制来源, 错误原因只返回给本机访问, 其它来源只有ok
+// 钉钉gettoken接口有调用频率限制, 检查结果缓存readyzDingtalkCacheSeconds秒
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const readyzDingtalkCacheSeconds = 60
+
+type ReadyCheckResult struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readyzDingtalkCache struct {
+	mutex   sync.Mutex
+	appKey  string // 换了app_key/app_secret马上重新检查
+	secret  string
+	result  ReadyCheckResult
+	expired int64
+}
+
+var readyzDingtalk = &readyzDingtalkCache{}
+
+func newReadyCheckResult(err error) ReadyCheckResult {
+	if err != nil {
+		return ReadyCheckResult{Ok: false, Error: err.Error()}
+	}
+	return ReadyCheckResult{Ok: true}
+}
+
+// 直接用配置的app_key/app_secret调gettoken, 不用AccessTokenManager缓存的token, 密钥被重置后缓存的token还能用一段时间
+func checkDingtalkReady() ReadyCheckResult {
+	appKey, _ := ConfigMap.Load("dingding_app_key")
+	appSecret, _ := ConfigMap.Load("dingding_app_secret")
+	key, _ := appKey.(string)
+	secret, _ := appSecret.(string)
+
+	c := readyzDingtalk
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now().Unix()
+	if now < c.expired && c.appKey == key && c.secret == secret {
+		return c.result
+	}
+	resp, _, err := dingdingClient.GetAccessToken(key, secret)
+	if err == nil && resp.AccessToken == "" {
+		err = errors.New("dingtalk gettoken returned empty access_token")
+	}
+	c.appKey, c.secret = key, secret
+	c.result = newReadyCheckResult(dingtalkReadyError(err))
+	c.expired = now + readyzDingtalkCacheSeconds
+	return c.result
+}
+
+// 连不上钉钉时http.Client返回的*url.Error带着完整的gettoken地址, 里面有appsecret, 只保留钉钉的错误码或者网络错误本身
+func dingtalkReadyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch err := err.(type) {
+	case *DingdingError:
+		return err
+	case *url.Error:
+		return errors.New("dingtalk unreachable: " + err.Err.Error())
+	}
+	if err.Error() == "dingtalk gettoken returned empty access_token" {
+		return err
+	}
+	return errors.New("dingtalk gettoken failed")
+}
+
+func checkLogDirReady() ReadyCheckResult {
+	fd, err := ioutil.TempFile("./logs", ".readyz")
+	if err != nil {
+		return newReadyCheckResult(err)
+	}
+	fd.Close()
+	return newReadyCheckResult(os.Remove(fd.Name()))
+}
+
+func readyChecks() map[string]ReadyCheckResult {
+	checks := map[string]ReadyCheckResult{
+		"config":        newReadyCheckResult(getConfigReloadError()), // 配置文件改错了, 还在用之前的配置
+		"log_dir":       checkLogDirReady(),
+		"session_store": newReadyCheckResult(sessionStore.Ping()),
+	}
+	for _, name := range getEnabledProviders() { // 没有启用钉钉登录时不检查
+		if name == "dingtalk" {
+			checks["dingtalk"] = checkDingtalkReady()
+		}
+	}
+	return checks
+}
+
+func healthzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		w.Write([]byte(`{"status":"ok"}`))
+	}
+}
+
+// {"ready":false,"checks":{"config":{"ok":true},"dingtalk":{"ok":false,"error":"..."},"log_dir":{"ok":true},"session_store":{"ok":true}}}
+func readyzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		checks := readyChecks()
+		ready := true
+		local := isLocalRequest(req)
+		for name, result := range checks {
+			ready = ready && result.Ok
+			if !local { // 错误原因里可能有内网地址等信息
+				result.Error = ""
+				checks[name] = result
+			}
+		}
+		b, _ := json.Marshal(struct {
+			Ready  bool                        `json:"ready"`
+			Checks map[string]ReadyCheckResult `json:"checks"`
+		}{ready, checks})
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(b)
+	}
+}
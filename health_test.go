@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 连不上钉钉时readyz不能输出带appsecret的地址
+func TestReadyzDingtalkUnreachable(t *testing.T) {
+	const secret = "readyz-test-app-secret"
+	setTestConfig(t, map[string]string{"dingding_app_secret": secret, "dingding_oapi_base": "http://127.0.0.1:1", "identity_providers": "dingtalk"})
+	readyzDingtalk.expired = 0
+
+	result := checkDingtalkReady()
+	if result.Ok || !strings.HasPrefix(result.Error, "dingtalk unreachable: ") || strings.Contains(result.Error, secret) {
+		t.Fatalf("dingtalk check = %+v", result)
+	}
+
+	for _, remoteAddr := range []string{"127.0.0.1:50000", "192.0.2.1:50000"} {
+		req := httptest.NewRequest("GET", "/readyz", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		readyzHandler()(w, req)
+		body := w.Body.String()
+		if w.Code != http.StatusServiceUnavailable || strings.Contains(body, secret) || strings.Contains(body, "appsecret") {
+			t.Fatalf("readyz from %s = %d %s", remoteAddr, w.Code, body)
+		}
+		if hasError := strings.Contains(body, `"error"`); hasError != (remoteAddr == "127.0.0.1:50000") {
+			t.Fatalf("readyz from %s = %s", remoteAddr, body)
+		}
+	}
+}
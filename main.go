@@ -44,6 +44,7 @@ var logerFd *os.File
 var loger *log.Logger
 
 func init() {
+	os.MkdirAll("./logs", 0755) // 没有日志目录时自动创建, go test也不用先建目录
 	fileName := "./logs/" + time.Now().Format("2006-01") + "_log" + ".txt"
 	fd, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0766)
 	if err != nil {
@@ -54,11 +55,6 @@ func init() {
 	logerFileName = fileName
 }
 
-var MemMap sync.Map
-var MemMapTTL sync.Map
-var MemTrustIpMap sync.Map
-var MemForbiddenMap sync.Map
-
 type TrustIpStruct struct {
 	TotalLoginCount int64 `json:"total_login_count"` // 总共登录次数
 	Expired         int64 `json:"expired"`           // 过期时间戳 到点会自动删除
@@ -69,34 +65,39 @@ type ForbiddenStruct struct {
 	SsoContactType float64 `json:"sso_contact_type"` // 0 内部联系人     1 外部联系人
 	SsoMobile      string  `json:"sso_mobile"`       // 手机号
 	Expired        int64   `json:"expired"`          // 过期时间戳 到点会自动删除
+	Reason         string  `json:"reason,omitempty"` // 屏蔽原因
 }
 
 type SsoUserInfoStruct struct {
-	SsoName             string              `json:"sso_name"`               // 用户名
-	SsoContactType      float64             `json:"sso_contact_type"`       // 0 内部联系人     1 外部联系人
-	SsoMobile           string              `json:"sso_mobile"`             // 手机号
-	SsoUserDeptInfo     []SsoUserDeptStruct `json:"sso_user_dept_info"`     // 用户部门信息
-	SsoAvatar           string              `json:"sso_avatar"`             // 头像链接
-	SsoJobTitle         string              `json:"sso_job_title"`          // 工作岗位名称
-	SsoStateCode        string              `json:"sso_state_code"`         // 国家编号
-	SsoCompanyName      string              `json:"sso_company_name"`       // 公司名字  外部联系人才有
-	SsoEmail            string              `json:"sso_email"`              // 邮箱  外部联系人才有
-	SsoFollowerUserId   string              `json:"sso_follower_user_id"`   // 负责人userId  外部联系人才有
-	SsoFollowerUser     *SsoUserInfoStruct  `json:"sso_follower_user"`      // 负责人结构体  外部联系人才有
-	SsoAddress          string              `json:"sso_address"`            // 联系地址  外部联系人才有
-	SsoRemark           string              `json:"sso_remark"`             // 备注  外部联系人才有
-	SsoDingdingUnionId  string              `json:"sso_dingding_union_id"`  // 钉钉 公司内 分配的用户id
-	SsoDingdingUserId   string              `json:"sso_dingding_user_id"`   // 钉钉 分配的用户id
-	SsoDingdingOpenId   string              `json:"sso_dingding_open_id"`   // 钉钉 分配的open id
-	SsoDingdingNickName string              `json:"sso_dingding_nick_name"` // 钉钉 设置的用户昵称
-	SsoTicket           string              `json:"sso_ticket"`             // 扫码后业务方请求我的ticket
-	DingdingRaw         DingdingRawStruct   `json:"dingding_raw"`           // 调用钉钉api取到的原始数据
+	SsoProvider         string              `json:"sso_provider"`                // 身份提供方 dingtalk wecom feishu
+	SsoName             string              `json:"sso_name"`                    // 用户名
+	SsoContactType      float64             `json:"sso_contact_type"`            // 0 内部联系人     1 外部联系人
+	SsoMobile           string              `json:"sso_mobile"`                  // 手机号
+	SsoUserDeptInfo     []SsoUserDeptStruct `json:"sso_user_dept_info"`          // 用户部门信息
+	SsoAvatar           string              `json:"sso_avatar"`                  // 头像链接
+	SsoJobTitle         string              `json:"sso_job_title"`               // 工作岗位名称
+	SsoStateCode        string              `json:"sso_state_code"`              // 国家编号
+	SsoCompanyName      string              `json:"sso_company_name"`            // 公司名字  外部联系人才有
+	SsoEmail            string              `json:"sso_email"`                   // 邮箱  外部联系人才有
+	SsoFollowerUserId   string              `json:"sso_follower_user_id"`        // 负责人userId  外部联系人才有
+	SsoFollowerUser     *SsoUserInfoStruct  `json:"sso_follower_user"`           // 负责人结构体  外部联系人才有
+	SsoAddress          string              `json:"sso_address"`                 // 联系地址  外部联系人才有
+	SsoRemark           string              `json:"sso_remark"`                  // 备注  外部联系人才有
+	SsoDingdingUnionId  string              `json:"sso_dingding_union_id"`       // 钉钉 公司内 分配的用户id
+	SsoDingdingUserId   string              `json:"sso_dingding_user_id"`        // 钉钉 分配的用户id
+	SsoDingdingOpenId   string              `json:"sso_dingding_open_id"`        // 钉钉 分配的open id
+	SsoDingdingNickName string              `json:"sso_dingding_nick_name"`      // 钉钉 设置的用户昵称
+	SsoTicket           string              `json:"sso_ticket"`                  // 扫码后业务方请求我的ticket
+	SsoSessionToken     string              `json:"sso_session_token,omitempty"` // session_token = on 时的签名令牌, 见session_token.go
+	DingdingRaw         DingdingRawStruct   `json:"dingding_raw"`                // 调用钉钉api取到的原始数据
 }
 
 type SsoUserDeptStruct struct {
-	SsoDeptId      string `json:"sso_dept_id"`       // 所在部门id
-	SsoDeptName    string `json:"sso_dept_name"`     // 所在部门名称
-	SsoIsDeptOwner string `json:"sso_is_dept_owner"` // 是所在部门名称管理员
+	SsoDeptId        string   `json:"sso_dept_id"`         // 所在部门id
+	SsoDeptName      string   `json:"sso_dept_name"`       // 所在部门名称
+	SsoIsDeptOwner   string   `json:"sso_is_dept_owner"`   // 是所在部门名称管理员
+	SsoDeptPathIds   []string `json:"sso_dept_path_ids"`   // 从根部门(公司)到所在部门的所有部门id
+	SsoDeptPathNames []string `json:"sso_dept_path_names"` // 从根部门(公司)到所在部门的所有部门名称
 }
 
 type DingdingRawStruct struct {
@@ -108,7 +109,10 @@ type DingdingRawStruct struct {
 }
 
 func clearExpiredTicket() {
-	time.Sleep(time.Second * 5)
+	if !loopSleep(time.Second * 5) {
+		return
+	}
+	defer loopDone()
 
 	now := time.Now().Unix()
 	//fmt.Println("start", now)
@@ -121,11 +125,32 @@ func clearExpiredTicket() {
 		}
 		return true
 	})
+	MemTicketClientMap.Range(func(key, value interface{}) bool {
+		if now >= value.(TicketClientStruct).Expired {
+			MemTicketClientMap.Delete(key)
+		}
+		return true
+	})
+	MemSsoSessionMap.Range(func(key, value interface{}) bool {
+		if now >= value.(SsoSessionStruct).Expired {
+			MemSsoSessionMap.Delete(key)
+		}
+		return true
+	})
+	MemRevokedTokenMap.Range(func(key, value interface{}) bool {
+		if now >= value.(RevokedTokenStruct).Expired {
+			MemRevokedTokenMap.Delete(key)
+		}
+		return true
+	})
 	go clearExpiredTicket()
 }
 
 func clearExpiredIp() {
-	time.Sleep(time.Second * 5)
+	if !loopSleep(time.Second * 5) {
+		return
+	}
+	defer loopDone()
 
 	now := time.Now().Unix()
 	MemTrustIpMap.Range(func(key, value interface{}) bool {
@@ -139,7 +164,10 @@ func clearExpiredIp() {
 }
 
 func clearForbiddenIp() {
-	time.Sleep(time.Second * 1)
+	if !loopSleep(time.Second * 1) {
+		return
+	}
+	defer loopDone()
 
 	now := time.Now().Unix()
 	MemForbiddenMap.Range(func(key, value interface{}) bool {
@@ -152,7 +180,10 @@ func clearForbiddenIp() {
 }
 
 func changeLogger() {
-	time.Sleep(time.Second * 60)
+	if !loopSleep(time.Second * 60) {
+		return
+	}
+	defer loopDone()
 	fileName := "./logs/" + time.Now().Format("2006-01") + "_log" + ".txt"
 	if fileName != logerFileName {
 		fd, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0766)
@@ -167,86 +198,65 @@ func changeLogger() {
 }
 
 func main() {
-	ReadFile()              // 读取配置文件
-	go clearExpiredTicket() // 定期清理过期的内存sso用户数据
-	go clearExpiredIp()     // 定期清理过期的可信ip
-	go clearForbiddenIp()   // 定期清理禁止的ip
-	go changeLogger()       // 定期更换日志文件
-
-	// 配置文件校验
-	if _, ok := ConfigMap.Load("domain"); !ok {
-		panic("config domain not found")
+	if len(os.Args) > 1 { // 子命令, 见cli.go
+		os.Exit(runCommand(os.Args[1:]))
 	}
-	if _, ok := ConfigMap.Load("title"); !ok {
-		panic("config title not found")
+	ReadFile()                        // 读取配置文件
+	waitHandover()                    // 不停机重启的新进程, 通知旧进程并等它退出
+	openSessionStore()                // 打开会话存储, file模式会回放上次保存的ticket
+	if !sessionStore.NativeExpiry() { // redis自己会过期key, 不需要清理
+		go clearExpiredTicket() // 定期清理过期的内存sso用户数据
+		go clearExpiredIp()     // 定期清理过期的可信ip
+		go clearForbiddenIp()   // 定期清理禁止的ip
 	}
+	go changeLogger()            // 定期更换日志文件
+	go clearRateLimiters()       // 定期清理限流计数
+	startFakeDingding()          // 配置了dingding_fake_fixture时启动假钉钉服务, 离线开发和测试用
+	MemMap.Delete("accessToken") // 老版本把钉钉accessToken存在ticket里, 现在由AccessTokenManager管理
+	startAccessTokenRefresh()    // accessToken快过期时提前刷新
+	go deptCache.refreshLoop()   // 登录用到的部门信息快过期时提前刷新
+	go revalidateLoop()          // 定期检查持有ticket的用户是否已经离职
 
-	if _, ok := ConfigMap.Load("two_factor_authentication"); !ok {
-		panic("config two_factor_authentication not found")
-	}
-	if _, ok := ConfigMap.Load("trust_ip_store_duration"); !ok {
-		panic("config trust_ip_store_duration not found")
-	}
-	if temp, ok := ConfigMap.Load("ticket_hash_secret"); !ok {
-		if len(temp.(string)) == 0 {
-			panic("config ticket_hash_secret not valid")
-		}
-		panic("config ticket_hash_secret not found")
-	}
-	if _, ok := ConfigMap.Load("ticket_max_ttl"); !ok {
-		panic("config ticket_max_ttl not found")
-	}
-	if temp, ok := ConfigMap.Load("dingding_agent_id"); !ok {
-		if len(temp.(string)) == 0 {
-			panic("config dingding_agent_id not valid")
-		}
-		panic("config dingding_agent_id not found")
-	}
-	if temp, ok := ConfigMap.Load("dingding_app_key"); !ok {
-		if len(temp.(string)) == 0 {
-			panic("config dingding_app_key not valid")
-		}
-		panic("config dingding_app_key not found")
+	config := getConfig() // 路由地址和端口只在启动时读取
+	scanUrl, scanSuccessUrl, ticketUrl, ttlUrl, versionUrl, managerUrl, port := config.ScanUrl, config.ScanSuccessUrl, config.TicketUrl, config.TtlUrl, config.VersionUrl, config.ManagerUrl, config.Port
+
+	http.Handle(scanUrl, scanHandler())               // 钉钉扫码页面 window.open(dingdingUrl, 'dingdingScan', 'height=580, width=608, top=0, left=0, toolbar=no, menubar=no, scrollbars=no, resizable=no, location=no, status=no')
+	http.Handle(scanSuccessUrl, scanSuccessHandler()) // 扫码后, 钉钉服务器跳转回来的地址
+	http.Handle(ticketUrl, fetchByTicketHandler())    // 让业务方调用, 用ticket来获取刚才扫码的用户信息
+	http.Handle(ttlUrl, ttlByTicketHandler())         // 内部测试用, 查看ticket的过期时间秒
+	http.Handle(managerUrl, managerHandler())         // 管理后台, 用来显示有哪些可信ip, 有哪些禁止的用户, 通过删除按钮可以删除它们
+	if clientAdminUrl, ok := ConfigMap.Load("client_admin_url"); ok && len(clientAdminUrl.(string)) > 0 {
+		http.Handle(clientAdminUrl.(string), clientAdminHandler()) // 业务方登记管理接口, 只允许127.0.0.1访问
 	}
-	if temp, ok := ConfigMap.Load("dingding_app_secret"); !ok {
-		if len(temp.(string)) == 0 {
-			panic("config dingding_app_secret not valid")
-		}
-		panic("config dingding_app_secret not found")
+	if auditUrl, ok := ConfigMap.Load("audit_url"); ok && len(auditUrl.(string)) > 0 {
+		http.Handle(auditUrl.(string), auditHandler()) // 审计日志查询接口, 只允许127.0.0.1访问
 	}
-
-	var scanUrl, scanSuccessUrl, ticketUrl, ttlUrl, versionUrl, managerUrl, port string
-	if temp, ok := ConfigMap.Load("scan_url"); ok {
-		scanUrl = temp.(string)
+	if healthzUrl, ok := ConfigMap.Load("healthz_url"); ok && len(healthzUrl.(string)) > 0 {
+		http.Handle(healthzUrl.(string), healthzHandler()) // 存活检查, 进程活着就返回200
 	}
-	if temp, ok := ConfigMap.Load("scan_success_url"); ok {
-		scanSuccessUrl = temp.(string)
+	if readyzUrl, ok := ConfigMap.Load("readyz_url"); ok && len(readyzUrl.(string)) > 0 {
+		http.Handle(readyzUrl.(string), readyzHandler()) // 就绪检查, 负载均衡用它探测, 钉钉密钥错误等登录不了的情况返回503
 	}
-	if temp, ok := ConfigMap.Load("ticket_url"); ok {
-		ticketUrl = temp.(string)
+	if metricsUrl, ok := ConfigMap.Load("metrics_url"); ok && len(metricsUrl.(string)) > 0 {
+		http.Handle(metricsUrl.(string), metricsHandler()) // Prometheus监控指标, 只允许本机和内网访问
+		countStoreEntries()
+		go metricStoreLoop() // 存储大小每分钟统计一次
 	}
-	if temp, ok := ConfigMap.Load("ttl_url"); ok {
-		ttlUrl = temp.(string)
+	if isOidcOn() {
+		registerOidcHandlers() // OpenID Connect 服务端, 给只支持oidc的系统接入
 	}
-	if temp, ok := ConfigMap.Load("version_url"); ok {
-		versionUrl = temp.(string)
+	if isSamlOn() {
+		registerSamlHandlers() // SAML 2.0 IdP, 给只支持saml的外采系统接入
 	}
-	if temp, ok := ConfigMap.Load("manager_url"); ok {
-		managerUrl = temp.(string)
+	if isCasOn() {
+		registerCasHandlers() // CAS 2.0/3.0 server, 给已经有CAS客户端的老系统接入
 	}
-	if temp, ok := ConfigMap.Load("port"); ok {
-		port = temp.(string)
+	if isSessionTokenOn() {
+		registerSessionTokenHandlers() // 无状态会话令牌, 业务方可以用公钥自己校验
 	}
-
-	if len(scanUrl) == 0 || len(scanSuccessUrl) == 0 || len(ticketUrl) == 0 || len(ttlUrl) == 0 || len(versionUrl) == 0 || len(managerUrl) == 0 || len(port) == 0 {
-		panic("config param not valid")
+	if isDingdingCallbackOn() {
+		registerDingdingCallbackHandlers() // 钉钉通讯录事件推送, 员工离职立即删除ticket
 	}
-
-	http.Handle(scanUrl, scanHandler())               // 钉钉扫码页面 window.open(dingdingUrl, 'dingdingScan', 'height=580, width=608, top=0, left=0, toolbar=no, menubar=no, scrollbars=no, resizable=no, location=no, status=no')
-	http.Handle(scanSuccessUrl, scanSuccessHandler()) // 扫码后, 钉钉服务器跳转回来的地址
-	http.Handle(ticketUrl, fetchByTicketHandler())    // 让业务方调用, 用ticket来获取刚才扫码的用户信息
-	http.Handle(ttlUrl, ttlByTicketHandler())         // 内部测试用, 查看ticket的过期时间秒
-	http.Handle(managerUrl, managerHandler())         // 管理后台, 用来显示有哪些可信ip, 有哪些禁止的用户, 通过删除按钮可以删除它们
 	http.HandleFunc(versionUrl, func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("0.31"))
 	})
@@ -259,10 +269,7 @@ func main() {
 	})
 
 	loger.Println("dingding sso server start listen on ", port)
-	err := http.ListenAndServe(port, nil) // 开始监听端口
-	if err != nil {
-		panic("can not listen the port " + port + ", program exit now!")
-	}
+	serve(port) // 开始监听端口, 收到SIGINT/SIGTERM优雅退出, SIGUSR2不停机重启
 }
 
 func ttlByTicketHandler() http.HandlerFunc {
@@ -283,7 +290,7 @@ func ttlByTicketHandler() http.HandlerFunc {
 			}
 
 			userAgent := req.Form.Get("user_agent")
-			userIp := req.Form.Get("client_ip")
+			userIp := normalizeIp(req.Form.Get("client_ip"))
 			ok, _ := checkTicket(ticket, userAgent, userIp, "fetch")
 			if !ok {
 				w.WriteHeader(http.StatusGone)
@@ -322,6 +329,24 @@ func fetchByTicketHandler() http.HandlerFunc {
 				fmt.Println(err.Error())
 				return
 			}
+			callerIp := GetIp(req)
+			if _, ok := MemForbiddenMap.Load(callerIp); ok {
+				w.WriteHeader(http.StatusForbidden)
+				EchoJson(w, "err:31", nil)
+				return
+			}
+			// 认证通过的按业务方限流, 否则按调用方ip
+			caller, authenticated := authenticateClient(req)
+			appKey := "ip:" + callerIp
+			if authenticated {
+				appKey = "client:" + caller.ClientId
+			}
+			if !appRateLimiter.Allow(appKey) {
+				w.WriteHeader(http.StatusTooManyRequests)
+				EchoJson(w, "err:53", nil)
+				return
+			}
+
 			ticket := req.Form.Get("sso_ticket")
 			renew := req.Form.Get("renew")
 			if ticket == "" {
@@ -331,37 +356,66 @@ func fetchByTicketHandler() http.HandlerFunc {
 			}
 
 			userAgent := req.Form.Get("user_agent")
-			userIp := req.Form.Get("client_ip")
+			userIp := normalizeIp(req.Form.Get("client_ip"))
 			ok, ttl := checkTicket(ticket, userAgent, userIp, "fetch")
 			if !ok {
+				auditTicket(AuditTicketFetchFailed, ticket, userIp, userAgent, "err:28", "")
+				recordFetchFailure(callerIp)
 				w.WriteHeader(http.StatusGone)
 				EchoJson(w, "err:28", nil)
 				return
 			}
 
+			// 绑定了业务方的ticket只有这个业务方能取
+			var client ClientStruct
+			temp, bound := MemTicketClientMap.Load(ticket)
+			if bound || isClientRequired() {
+				if !authenticated {
+					auditTicket(AuditTicketFetchFailed, ticket, userIp, userAgent, "err:49", "")
+					w.WriteHeader(http.StatusUnauthorized)
+					EchoJson(w, "err:49", nil)
+					return
+				}
+				client = caller
+				if !bound || temp.(TicketClientStruct).ClientId != client.ClientId {
+					auditTicket(AuditTicketFetchFailed, ticket, userIp, userAgent, "err:51", "client: "+client.ClientId)
+					w.WriteHeader(http.StatusForbidden)
+					EchoJson(w, "err:51", nil)
+					return
+				}
+			}
+
 			now := time.Now().Unix()
 			if jsonByte, ok := MemMap.Load(ticket); ok {
 				if expire, ok := MemMapTTL.Load(ticket); ok {
 					if now >= expire.(int64) {
+						auditTicket(AuditTicketFetchFailed, ticket, userIp, userAgent, "err:22", "")
+						recordFetchFailure(callerIp)
 						MemMap.Delete(ticket)
 						MemMapTTL.Delete(ticket)
 						EchoJson(w, "err:22", nil)
 						return
 					}
 					if renew == "1" {
-						if allowTicketRenew, ok := ConfigMap.Load("allow_ticket_renew"); ok {
-							if allowTicketRenew.(string) == "yes" {
-								remoteIp := strings.Split(req.RemoteAddr, ":")[0]
-								if isInnerIp(remoteIp) { // 内网发起才允许续期过期时间
-									MemMapTTL.Store(ticket, now+int64(ttl))
+						if getConfig().AllowTicketRenew {
+							if isInnerIp(getRemoteIp(req)) { // 内网发起才允许续期过期时间
+								MemMapTTL.Store(ticket, now+int64(ttl))
+								if bound {
+									ticketClient := temp.(TicketClientStruct)
+									ticketClient.Expired = now + int64(ttl)
+									MemTicketClientMap.Store(ticket, ticketClient)
 								}
+								auditTicket(AuditTicketRenewed, ticket, userIp, userAgent, "", "ttl: "+strconv.Itoa(ttl))
 							}
 						}
 					}
-					EchoJson(w, "0", jsonByte.([]byte)) // 无异常
+					auditTicket(AuditTicketFetched, ticket, userIp, userAgent, "", "")
+					EchoJson(w, "0", filterClientClaims(client, jsonByte.([]byte))) // 无异常
 					return
 				}
 			}
+			auditTicket(AuditTicketFetchFailed, ticket, userIp, userAgent, "err:22", "")
+			recordFetchFailure(callerIp)
 			EchoJson(w, "err:22", nil)
 			return
 		default:
@@ -382,8 +436,11 @@ func scanSuccessHandler() http.HandlerFunc {
 		case "POST":
 			gets := req.URL.Query()
 			if _, ok := gets["code"]; !ok {
-				w.WriteHeader(http.StatusNotImplemented)
-				return
+				if _, ok := gets["authCode"]; !ok { // 钉钉新版登录回调带的是authCode
+					w.WriteHeader(http.StatusNotImplemented)
+					return
+				}
+				gets["code"] = gets["authCode"]
 			}
 			code := gets["code"][0]
 			if _, ok := gets["state"]; !ok {
@@ -393,406 +450,97 @@ func scanSuccessHandler() http.HandlerFunc {
 			ticket := gets["state"][0]
 			userAgent := req.Header.Get("User-Agent")
 			userIp := GetIp(req)
+			if !ipRateLimiter.Allow(userIp) {
+				w.WriteHeader(http.StatusTooManyRequests)
+				EchoJs(w, "err:53", nil)
+				return
+			}
 
 			ok, ttl := checkTicket(ticket, userAgent, userIp, "scan")
 			if !ok {
+				audit(AuditEvent{Event: AuditLoginFailed, CorrelationId: auditCorrelationId(ticket), Ip: userIp, UserAgent: userAgent, ErrCode: "err:23"})
 				w.WriteHeader(http.StatusGone)
 				EchoJs(w, "err:23", nil)
 				return
 			}
 
-			dingdingRawStruct := DingdingRawStruct{}
-
-			timestamp := strconv.FormatInt(time.Now().UnixNano()/1e6, 10)
-			dingdingAppSecretTemp, _ := ConfigMap.Load("dingding_app_secret")
-			dingdingAppSecret := dingdingAppSecretTemp.(string)
-			signature := GetDingdingSignature(timestamp, dingdingAppSecret)
-
-			dingdingAppKeyTemp, _ := ConfigMap.Load("dingding_app_key")
-			dingdingAppKey := dingdingAppKeyTemp.(string)
-			postUrl := fmt.Sprintf("https://oapi.dingtalk.com%s?accessKey=%s&timestamp=%s&signature=%s", "/sns/getuserinfo_bycode", dingdingAppKey, timestamp, signature)
-			respBody, respMap, err := FetchDingApi(postUrl, `{"tmp_auth_code":"`+code+`"}`, "POST")
-			loger.Println(string(respBody))
-			dingdingRawStruct.UserInfo = string(respBody)
-			// {"errcode":0,"errmsg":"ok","user_info":{"nick":"潘**","unionid":"uT19di******HpS5hGk**QiEiE","dingId":"$:LWCP_v1:$**zuci4Nk**g==","openid":"b5B**fR04Xf**AiEiE","main_org_auth_high_level":true}}
-			// {"errcode":0,"errmsg":"ok","user_info":{"nick":"潘潘😎","unionid":"2r08DW******3i**iEiE","dingId":"$:LWCP_v1:$1A**7AaNwShqJx**rRNO","openid":"TPM0**D**XwiEiE","main_org_auth_high_level":false}}
-			if err != nil {
-				w.WriteHeader(http.StatusForbidden)
-				EchoJs(w, "err:1", respBody)
-				loger.Println(err.Error())
-				return
-			}
-			if _, isset := respMap["user_info"]; !isset {
-				w.WriteHeader(http.StatusInternalServerError)
-				EchoJs(w, "err:2", respBody)
-				return
-			}
-			userInfo := respMap["user_info"].(map[string]interface{})
-			if _, isset := userInfo["unionid"]; !isset {
-				w.WriteHeader(http.StatusInternalServerError)
-				EchoJs(w, "err:3", respBody)
+			provider, ok := getIdentityProvider(gets.Get("provider"))
+			if !ok {
+				audit(AuditEvent{Event: AuditLoginFailed, CorrelationId: auditCorrelationId(ticket), App: getTicketApp(ticket), Ip: userIp, UserAgent: userAgent, ErrCode: "err:45"})
+				w.WriteHeader(http.StatusNotImplemented)
+				EchoJs(w, "err:45", nil)
 				return
 			}
-			ssoDingdingUnionId := userInfo["unionid"].(string)
-
-			var ssoDingdingOpenId string
-			if _, isset := userInfo["openid"]; !isset {
-				ssoDingdingOpenId = ""
-			} else {
-				ssoDingdingOpenId = userInfo["openid"].(string)
-			}
-			var ssoDingdingNickName string
-			if _, isset := userInfo["nick"]; !isset {
-				ssoDingdingNickName = ""
-			} else {
-				ssoDingdingNickName = userInfo["nick"].(string)
-			}
-
-			//MemMap.Store("accessToken", "7e139c**bec2f7e2") // 调试用
-
-			var accessToken string
-			if accessTokenLoaded, ok := MemMap.Load("accessToken"); ok {
-				accessToken = accessTokenLoaded.(string)
-			} else {
-				respBody, accessToken, ok = GetDingdingAccessToken(dingdingAppKey, dingdingAppSecret)
-				if !ok {
-					w.WriteHeader(http.StatusInternalServerError)
-					EchoJs(w, accessToken, respBody)
-					return
-				}
-				MemMap.Store("accessToken", accessToken)
-			}
 
-			errCount := 1
-		retoken:
-			postUrl = fmt.Sprintf("https://oapi.dingtalk.com/topapi/user/getbyunionid?access_token=%s", accessToken)
-			respBody, respMap, err = FetchDingApi(postUrl, `{"unionid":"`+ssoDingdingUnionId+`"}`, "POST")
-			loger.Println(string(respBody))
-			dingdingRawStruct.UserUnion = string(respBody)
-			// 内部员工 {"errcode":0,"errmsg":"ok","result":{"contact_type":0,"userid":"0138**711**71"},"request_id":"8e7a**vz**uwl"}
-			// 外部联系人 {"errcode":0,"errmsg":"ok","result":{"contact_type":1,"userid":"0121281**19**912**8"},"request_id":"fmf**ma**loop0"}
-			// 陌生人 {"errcode":60121,"errmsg":"找不到该用户","request_id":"xyv**o2**y4n4"}
+			dingdingRawStruct := DingdingRawStruct{}
+			identity, err := provider.ExchangeCode(code, &dingdingRawStruct)
 			if err != nil {
-				// {"errcode":88,"sub_code":"40014","sub_msg":"不合法的access_token","errmsg":"ding talk error[subcode=40014,submsg=不合法的access_token]","request_id":"h4**x7**xjj6"}
-				if respMap != nil {
-					if _, isset := respMap["sub_code"]; isset {
-						if respMap["sub_code"].(string) == "40014" { // access token 过期   重新生成一个
-							errCount++
-							if errCount < 3 {
-								var ok bool
-								respBody, accessToken, ok = GetDingdingAccessToken(dingdingAppKey, dingdingAppSecret)
-								if !ok {
-									w.WriteHeader(http.StatusInternalServerError)
-									EchoJs(w, accessToken, respBody)
-									return
-								}
-								MemMap.Store("accessToken", accessToken)
-								loger.Println("------------------ accessToken refresh:", accessToken)
-								goto retoken
-							}
-						}
-					}
-
-					if _, isset := respMap["errcode"]; isset {
-						if respMap["errcode"].(float64) == 60121 { // 找不到该用户
-							w.WriteHeader(http.StatusInternalServerError)
-							EchoJs(w, "err:3:1", respBody)
-							loger.Println(err.Error())
-							return
-						}
-					}
-				}
-
-				w.WriteHeader(http.StatusInternalServerError)
-				EchoJs(w, "err:4", respBody)
-				loger.Println(err.Error())
-				return
-			}
-			if _, isset := respMap["result"]; !isset {
-				w.WriteHeader(http.StatusInternalServerError)
-				EchoJs(w, "err:5", respBody)
+				auditLoginError(err, ticket, provider.Name(), "", userIp, userAgent)
+				echoProviderError(w, err)
 				return
 			}
-			result := respMap["result"].(map[string]interface{})
-			if _, isset := result["contact_type"]; !isset {
-				w.WriteHeader(http.StatusInternalServerError)
-				EchoJs(w, "err:6", respBody)
+			ssoUserId, ssoContactType, err := provider.ResolveUser(identity, &dingdingRawStruct)
+			if err != nil {
+				auditLoginError(err, ticket, provider.Name(), "", userIp, userAgent)
+				echoProviderError(w, err)
 				return
 			}
-
-			if _, isset := result["userid"]; !isset {
-				w.WriteHeader(http.StatusInternalServerError)
-				EchoJs(w, "err:7", respBody)
+			audit(AuditEvent{Event: AuditCodeExchanged, CorrelationId: auditCorrelationId(ticket), UserId: ssoUserId, UserName: identity.NickName, Provider: provider.Name(), App: getTicketApp(ticket), Ip: userIp, UserAgent: userAgent})
+			if isUserForbidden(ssoUserId, identity.OpenId) {
+				audit(AuditEvent{Event: AuditLoginFailed, CorrelationId: auditCorrelationId(ticket), UserId: ssoUserId, Provider: provider.Name(), App: getTicketApp(ticket), Ip: userIp, UserAgent: userAgent, ErrCode: "err:33"})
+				w.WriteHeader(http.StatusForbidden)
+				EchoJs(w, "err:33", nil)
 				return
 			}
-			ssoDingdingUserId := result["userid"].(string)
 
-			var ssoContactType float64
-			ssoContactType = result["contact_type"].(float64)
-
-			var externalUser SsoUserInfoStruct
-			var isExternalUser bool
-		fetchNeibuUser:
 			if ssoContactType == 0 { // 0 内部联系人     1 外部联系人
-				postUrl = fmt.Sprintf("https://oapi.dingtalk.com/topapi/v2/user/get?access_token=%s", accessToken)
-				respBody, respMap, err = FetchDingApi(postUrl, `{"userid":"`+ssoDingdingUserId+`"}`, "POST")
-				// 内部员工调这个接口返回 {"errcode":0,"errmsg":"ok","result":{"active":true,"admin":true,"avatar":"","boss":false,"dept_id_list":[**008**187],"dept_order_list":[{"dept_id":**008**187,"order":**62921**72512}],"exclusive_account":false,"hide_mobile":false,"hired_date":1**506880**00,"job_number":"00021116","leader_in_dept":[{"dept_id":**00**4187,"leader":false}],"mobile":"150**66**01","name":"潘****","real_authed":true,"role_list":[{"group_name":"默认","id":57**22**0,"name":"子管理员"}],"senior":false,"state_code":"86","title":"架构师","union_emp_ext":{},"unionid":"uT1**iPn**HpS5h**QiE**E","userid":"01**110528**03**1"},"request_id":"4mo**qs**p3**h"}
-				// 外部联系人调这个接口返回 {"errcode":60121,"errmsg":"找不到该用户","request_id":"wgd**pxca**z"}
-				loger.Println(string(respBody))
-				dingdingRawStruct.User = string(respBody)
+				ssoUserInfo, err := buildInternalSsoUser(provider, ssoUserId, identity, &dingdingRawStruct)
 				if err != nil {
-					if _, isset := respMap["errcode"]; isset {
-						if respMap["errcode"].(float64) == 60121 { // 找不到该用户
-							w.WriteHeader(http.StatusInternalServerError)
-							EchoJs(w, "err:9:1", respBody)
-							loger.Println(err.Error())
-							return
-						}
-					}
-
-					w.WriteHeader(http.StatusInternalServerError)
-					EchoJs(w, "err:9", respBody)
-					loger.Println(err.Error())
-					return
-				}
-				if _, isset := respMap["result"]; !isset {
-					w.WriteHeader(http.StatusInternalServerError)
-					EchoJs(w, "err:10", respBody)
-					return
-				}
-				result = respMap["result"].(map[string]interface{})
-				if _, isset := result["active"]; !isset {
-					w.WriteHeader(http.StatusInternalServerError)
-					EchoJs(w, "err:11", respBody)
-					return
-				}
-				if result["active"].(bool) != true {
-					w.WriteHeader(http.StatusForbidden)
-					EchoJs(w, "err:12", nil)
+					auditLoginError(err, ticket, provider.Name(), ssoUserId, userIp, userAgent)
+					echoProviderError(w, err)
 					return
 				}
-				if _, isset := result["dept_id_list"]; !isset {
-					w.WriteHeader(http.StatusInternalServerError)
-					EchoJs(w, "err:13", respBody)
+				if doTwoFactorAuthenticationCheck(w, req, ssoUserInfo, isGet, userIp, userAgent) == "exit" {
 					return
 				}
-				var ssoStateCode string
-				if _, isset := result["state_code"]; !isset {
-					ssoStateCode = ""
-				} else {
-					ssoStateCode = result["state_code"].(string)
-				}
-				var ssoAvatar string
-				if _, isset := result["avatar"]; !isset {
-					ssoAvatar = ""
-				} else {
-					ssoAvatar = result["avatar"].(string)
-				}
-				var ssoJobTitle string
-				if _, isset := result["title"]; !isset {
-					ssoJobTitle = ""
-				} else {
-					ssoJobTitle = result["title"].(string)
-				}
-				var ssoName string
-				if _, isset := result["name"]; !isset {
-					ssoName = ""
-				} else {
-					ssoName = result["name"].(string)
-				}
-				var ssoMobile string
-				if _, isset := result["mobile"]; !isset {
-					ssoMobile = ""
-				} else {
-					ssoMobile = result["mobile"].(string)
-				}
-				deptIdList := result["dept_id_list"].([]interface{})
-				if len(deptIdList) == 0 {
-					w.WriteHeader(http.StatusInternalServerError)
-					EchoJs(w, "err:14", respBody)
+				successReturn(w, false, ssoUserInfo, ticket, ttl, userIp, userAgent)
+				return
+			} else if ssoContactType == 1 { // 外部联系人(管理员在钉钉后台通讯录设置的)
+				externalContact, err := provider.GetExternalContact(ssoUserId, &dingdingRawStruct)
+				if err != nil {
+					auditLoginError(err, ticket, provider.Name(), ssoUserId, userIp, userAgent)
+					echoProviderError(w, err)
 					return
 				}
-				// [427922115,447795618,487643026,427876169,427831197]
-				var ssoUserDeptInfo []SsoUserDeptStruct
-				var ssoDeptId string
-				var ssoIsDeptOwner string
-				for _, temp := range deptIdList {
-					postUrl = fmt.Sprintf("https://oapi.dingtalk.com/topapi/v2/department/get?access_token=%s", accessToken)
-					ssoDeptId = strconv.FormatInt(int64(temp.(float64)), 10)
-					respBody, respMap, err = FetchDingApi(postUrl, `{"dept_id":"`+ssoDeptId+`"}`, "POST")
-					// {"errcode":0,"errmsg":"ok","result":{"auto_add_user":true,"brief":"","create_dept_group":true,"dept_group_chat_id":"chat3b**550d137f8d5d7**15a56**","dept_id":**85****,"dept_manager_userid_list":["07*********61"],"dept_permits":[],"group_contain_sub_dept":false,"hide_dept":false,"name":"****部","order":**08**87,"org_dept_owner":"0**1711**50**","outer_dept":false,"outer_permit_depts":[],"outer_permit_users":[],"parent_id":**53**,"user_permits":[]},"request_id":"ij**bn**m"}
-					loger.Println(string(respBody))
-					dingdingRawStruct.Departments = append(dingdingRawStruct.Departments, string(respBody))
-					if err != nil {
-						w.WriteHeader(http.StatusInternalServerError)
-						EchoJs(w, "err:15", respBody)
-						loger.Println(err.Error())
-						return
-					}
-					if _, isset := respMap["result"]; !isset {
-						w.WriteHeader(http.StatusInternalServerError)
-						EchoJs(w, "err:16", respBody)
-						return
-					}
-					result = respMap["result"].(map[string]interface{})
-					if _, isset := result["name"]; !isset {
-						w.WriteHeader(http.StatusInternalServerError)
-						EchoJs(w, "err:17", respBody)
-						return
-					}
-					deptName := result["name"].(string)
-
-					ssoIsDeptOwner = "0"
-					if _, isset := result["dept_manager_userid_list"]; !isset {
-
-					} else {
-						for _, temp2 := range result["dept_manager_userid_list"].([]interface{}) {
-							if temp2.(string) == ssoDingdingUserId {
-								ssoIsDeptOwner = "1"
-								break
-							}
-						}
-					}
-					ssoUserDeptInfo = append(ssoUserDeptInfo, SsoUserDeptStruct{
-						SsoDeptId:      ssoDeptId,
-						SsoDeptName:    deptName,
-						SsoIsDeptOwner: ssoIsDeptOwner,
-					})
-					// fix 判断是否是部门管理员不用org_dept_owner字段 2021-12-07
-					// if _, isset := result["org_dept_owner"]; isset { // 注意这个仅仅是群主userId, 不是部门管理员id
-					// 	if ssoDingdingUserId == result["org_dept_owner"].(string) {
-					// 		ssoIsDeptOwner = "1"
-					// 	}
-					// }
-				}
-
-				ssoUserInfo := SsoUserInfoStruct{
-					SsoName:             ssoName,
+				externalUser := SsoUserInfoStruct{
+					SsoProvider:         provider.Name(),
+					SsoName:             externalContact.Name,
 					SsoContactType:      ssoContactType,
-					SsoMobile:           ssoMobile,
-					SsoUserDeptInfo:     ssoUserDeptInfo,
-					SsoAvatar:           ssoAvatar,
-					SsoJobTitle:         ssoJobTitle,
-					SsoStateCode:        ssoStateCode,
-					SsoDingdingUnionId:  ssoDingdingUnionId,
-					SsoDingdingUserId:   ssoDingdingUserId,
-					SsoDingdingOpenId:   ssoDingdingOpenId,
-					SsoDingdingNickName: ssoDingdingNickName,
+					SsoMobile:           externalContact.Mobile,
+					SsoCompanyName:      externalContact.CompanyName,
+					SsoEmail:            externalContact.Email,
+					SsoAddress:          externalContact.Address,
+					SsoRemark:           externalContact.Remark,
+					SsoFollowerUserId:   externalContact.FollowerUserId,
+					SsoJobTitle:         externalContact.JobTitle,
+					SsoStateCode:        externalContact.StateCode,
+					SsoDingdingUnionId:  identity.UnionId,
+					SsoDingdingUserId:   ssoUserId,
+					SsoDingdingOpenId:   identity.OpenId,
+					SsoDingdingNickName: identity.NickName,
 					DingdingRaw:         dingdingRawStruct,
 				}
 
-				if isExternalUser == false { // 内部员工
-					if doTwoFactorAuthenticationCheck(w, req, ssoUserInfo, isGet, userIp, userAgent) == "exit" {
-						return
-					}
-					successReturn(w, isExternalUser, ssoUserInfo, ticket, ttl, userIp, userAgent)
-					return
-				} else { // 外部联系人
-					externalUser.SsoFollowerUser = &ssoUserInfo // 设置外部联系人的内部follow员工
-					successReturn(w, isExternalUser, externalUser, ticket, ttl, userIp, userAgent)
-					return
-				}
-
-			} else if ssoContactType == 1 { // 外部联系人(管理员在钉钉后台通讯录设置的)
-				postUrl = fmt.Sprintf("https://oapi.dingtalk.com/topapi/extcontact/get?access_token=%s", accessToken)
-				respBody, respMap, err = FetchDingApi(postUrl, `{"user_id":"`+ssoDingdingUserId+`"}`, "POST")
-				// {"errcode":0,"errmsg":"ok","result":{"address":"地址(非必填)","company_name":"公司名(非必填)","email":"邮箱(非必填)","follower_user_id":"013**11052**371","label_ids":[94**085188,94**5190],"mobile":"131**87**7","name":"潘潘","remark":"备注(非必填)","share_dept_ids":[**85**7],"share_user_ids":[],"state_code":"86","title":"职位名(非必填)","userid":"01**281**291**8"},"request_id":"p**hd**z**n"}
-				loger.Println(string(respBody))
-				dingdingRawStruct.ExternalContactInfo = string(respBody)
+				followerRawStruct := DingdingRawStruct{}
+				followerUser, err := buildInternalSsoUser(provider, externalContact.FollowerUserId, ProviderIdentity{}, &followerRawStruct)
 				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					EchoJs(w, "err:26", respBody)
-					loger.Println(err.Error())
-					return
-				}
-				if _, isset := respMap["result"]; !isset {
-					w.WriteHeader(http.StatusInternalServerError)
-					EchoJs(w, "err:27", respBody)
+					auditLoginError(err, ticket, provider.Name(), ssoUserId, userIp, userAgent)
+					echoProviderError(w, err)
 					return
 				}
-				result = respMap["result"].(map[string]interface{})
-				var ssoStateCode string
-				if _, isset := result["state_code"]; !isset {
-					ssoStateCode = ""
-				} else {
-					ssoStateCode = result["state_code"].(string)
-				}
-
-				var ssoJobTitle string
-				if _, isset := result["title"]; !isset {
-					ssoJobTitle = ""
-				} else {
-					ssoJobTitle = result["title"].(string)
-				}
-				var ssoName string
-				if _, isset := result["name"]; !isset {
-					ssoName = ""
-				} else {
-					ssoName = result["name"].(string)
-				}
-				var ssoMobile string
-				if _, isset := result["mobile"]; !isset {
-					ssoMobile = ""
-				} else {
-					ssoMobile = result["mobile"].(string)
-				}
-				var ssoCompanyName string
-				if _, isset := result["company_name"]; !isset {
-					ssoCompanyName = ""
-				} else {
-					ssoCompanyName = result["company_name"].(string)
-				}
-				var ssoEmail string
-				if _, isset := result["email"]; !isset {
-					ssoEmail = ""
-				} else {
-					ssoEmail = result["email"].(string)
-				}
-				var ssoAddress string
-				if _, isset := result["address"]; !isset {
-					ssoAddress = ""
-				} else {
-					ssoAddress = result["address"].(string)
-				}
-				var ssoRemark string
-				if _, isset := result["remark"]; !isset {
-					ssoRemark = ""
-				} else {
-					ssoRemark = result["remark"].(string)
-				}
-				var ssoFollowerUserId string
-				if _, isset := result["follower_user_id"]; !isset {
-					ssoFollowerUserId = ""
-				} else {
-					ssoFollowerUserId = result["follower_user_id"].(string)
-				}
-
-				isExternalUser = true
-				externalUser = SsoUserInfoStruct{
-					SsoName:             ssoName,
-					SsoContactType:      ssoContactType,
-					SsoMobile:           ssoMobile,
-					SsoCompanyName:      ssoCompanyName,
-					SsoEmail:            ssoEmail,
-					SsoAddress:          ssoAddress,
-					SsoRemark:           ssoRemark,
-					SsoFollowerUserId:   ssoFollowerUserId,
-					SsoJobTitle:         ssoJobTitle,
-					SsoStateCode:        ssoStateCode,
-					SsoDingdingUnionId:  ssoDingdingUnionId,
-					SsoDingdingUserId:   ssoDingdingUserId,
-					SsoDingdingOpenId:   ssoDingdingOpenId,
-					SsoDingdingNickName: ssoDingdingNickName,
-					DingdingRaw:         dingdingRawStruct,
-				}
-
-				ssoDingdingUserId = ssoFollowerUserId
-				ssoDingdingOpenId = ""
-				ssoDingdingUnionId = ""
-				ssoDingdingNickName = ""
-				ssoContactType = 0
-				dingdingRawStruct = DingdingRawStruct{}
-				goto fetchNeibuUser
+				externalUser.SsoFollowerUser = &followerUser // 设置外部联系人的内部follow员工
+				successReturn(w, true, externalUser, ticket, ttl, userIp, userAgent)
+				return
 			}
 			return
 		default:
@@ -825,16 +573,10 @@ func scanHandler() http.HandlerFunc {
 				if err != nil {
 					ttlIntt = 30
 				} else {
-					ticketMaxTTL, _ := ConfigMap.Load("ticket_max_ttl")
-					ticketMaxTTLInt, err2 := strconv.Atoi(ticketMaxTTL.(string))
-					if err2 != nil {
+					if ttlInt <= 0 || int64(ttlInt) > getConfig().TicketMaxTTL {
 						ttlIntt = 30
 					} else {
-						if ttlInt <= 0 || ttlInt > ticketMaxTTLInt {
-							ttlIntt = 30
-						} else {
-							ttlIntt = ttlInt
-						}
+						ttlIntt = ttlInt
 					}
 				}
 			}
@@ -847,13 +589,50 @@ func scanHandler() http.HandlerFunc {
 				EchoJs(w, "err:31", nil)
 				return
 			}
+			if !ipRateLimiter.Allow(userIp) {
+				w.WriteHeader(http.StatusTooManyRequests)
+				EchoJs(w, "err:53", nil)
+				return
+			}
+
+			var ticketClient *TicketClientStruct
+			var scanClient *ClientStruct
+			if clientId := gets.Get("client_id"); clientId != "" || isClientRequired() {
+				client, ok := getClient(clientId)
+				if !ok {
+					w.WriteHeader(http.StatusForbidden)
+					EchoJs(w, "err:48", nil)
+					return
+				}
+				if !appRateLimiter.Allow("client:" + client.ClientId) {
+					w.WriteHeader(http.StatusTooManyRequests)
+					EchoJs(w, "err:53", nil)
+					return
+				}
+				redirectUri := gets.Get("redirect_uri")
+				if redirectUri != "" && !client.HasRedirectUri(redirectUri) {
+					w.WriteHeader(http.StatusForbidden)
+					EchoJs(w, "err:50", nil)
+					return
+				}
+				origin, ok := client.ResolveOrigin(req)
+				if !ok && redirectUri == "" {
+					w.WriteHeader(http.StatusForbidden)
+					EchoJs(w, "err:50", nil)
+					return
+				}
+				if client.MaxTTL > 0 && ttlIntt > client.MaxTTL {
+					ttlIntt = client.MaxTTL
+				}
+				ticketClient = &TicketClientStruct{ClientId: client.ClientId, Origin: origin, RedirectUri: redirectUri}
+				scanClient = &client // origin或redirect_uri已经校验过
+			}
 
 			domain, _ := ConfigMap.Load("domain")
 			title, _ := ConfigMap.Load("title")
-			scanSuccessUrl, _ := ConfigMap.Load("scan_success_url")
 
 			if _, ok := gets["dev"]; ok { // POST and mock钉钉返回
-				if strings.Split(req.RemoteAddr, ":")[0] == "127.0.0.1" {
+				if isLocalRequest(req) {
 					//time.Sleep(time.Second * 1)
 					ok, ttl := checkTicket(gets["dev"][0], userAgent, userIp, "scan")
 					if !ok {
@@ -878,15 +657,27 @@ func scanHandler() http.HandlerFunc {
 			}
 
 			ticket := generateTicket(userAgent, userIp, ttlIntt)
-			dingdingAppKeyTemp, _ := ConfigMap.Load("dingding_app_key")
-			dingdingAppKey := dingdingAppKeyTemp.(string)
-			dingdingUrl := `https://oapi.dingtalk.com/connect/qrconnect?appid=` + dingdingAppKey + `&response_type=code&scope=snsapi_login&state=` + ticket + `&redirect_uri=` + url.QueryEscape(domain.(string)+scanSuccessUrl.(string))
+			if ticketClient != nil {
+				ticketClient.Expired = time.Now().Unix() + 100 + int64(ttlIntt) // 加上扫码的100秒
+				MemTicketClientMap.Store(ticket, *ticketClient)
+			}
+			audit(AuditEvent{Event: AuditScanStarted, CorrelationId: auditCorrelationId(ticket), Provider: gets.Get("provider"), App: getTicketApp(ticket), Ip: userIp, UserAgent: userAgent})
+			if session, ssoUserInfo, ok := loadSsoSession(req, scanClient, gets.Get("provider"), userAgent); ok {
+				_, trusted := MemTrustIpMap.Load(userIp)
+				if !getConfig().TwoFactorAuthentication || trusted { // 开启二次认证时, 新ip还是要扫码认证
+					audit(AuditEvent{Event: AuditSessionReused, CorrelationId: auditCorrelationId(ticket), UserId: ssoUserInfo.SsoDingdingUserId, UserName: ssoUserInfo.SsoName, Provider: ssoUserInfo.SsoProvider, App: getTicketApp(ticket), Ip: userIp, UserAgent: userAgent, Detail: "auth_time: " + time.Unix(session.AuthTime, 0).Format("2006-01-02 15:04:05")})
+					w.Header().Set("Content-Type", "text/html; charset=utf-8")
+					ticketReturn(w, session.IsExternalUser, ssoUserInfo, ticket, ttlIntt, userIp, userAgent)
+					return
+				}
+			}
+			dingdingUrl := GetQrUrl(ticket, gets.Get("provider"))
 			if autoRedirect == "1" {
 				http.Redirect(w, req, dingdingUrl, http.StatusFound)
 				return
 			}
 
-			if strings.Split(req.RemoteAddr, ":")[0] != "127.0.0.1" {
+			if !isLocalRequest(req) {
 				http.Redirect(w, req, dingdingUrl, http.StatusFound)
 				return
 			}
@@ -973,7 +764,7 @@ ticket: ` + ticket + `
 
 func managerHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		if strings.Split(req.RemoteAddr, ":")[0] != "127.0.0.1" {
+		if !isLocalRequest(req) {
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
@@ -1022,26 +813,41 @@ function del(map_name, map_key) {
 			w.Write([]byte("屏蔽列表<br>"))
 			w.Write([]byte("<table style=\"border-collapse: collapse;border:3px solid #CCC\" cellpadding=\"15\" cellspacing=\"15\">"))
 			w.Write([]byte("<tr>"))
-			w.Write([]byte("<td>IP/OPEN_ID</td><td>用户名</td><td>内外部联系人</td><td>手机号</td><td>过期时间</td><td>剩余秒数</td><td>操作</td>"))
+			w.Write([]byte("<td>IP/OPEN_ID</td><td>用户名</td><td>内外部联系人</td><td>手机号</td><td>过期时间</td><td>剩余秒数</td><td>原因</td><td>操作</td>"))
 			w.Write([]byte("</tr>"))
 			WaibuNeiBu := map[float64]string{0: "内部联系人", 1: "外部联系人"}
 			MemForbiddenMap.Range(func(key, value interface{}) bool {
 				w.Write([]byte("<tr>"))
-				w.Write([]byte(fmt.Sprintf("<td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td><a href=\"javascript:del('MemForbiddenMap','%s')\">删除</a></td>", key.(string), value.(ForbiddenStruct).SsoName, WaibuNeiBu[value.(ForbiddenStruct).SsoContactType], value.(ForbiddenStruct).SsoMobile, time.Unix(value.(ForbiddenStruct).Expired, 0).Format("2006-01-02 15:04:05"), value.(ForbiddenStruct).Expired-now, key.(string))))
+				w.Write([]byte(fmt.Sprintf("<td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%s</td><td><a href=\"javascript:del('MemForbiddenMap','%s')\">删除</a></td>", key.(string), value.(ForbiddenStruct).SsoName, WaibuNeiBu[value.(ForbiddenStruct).SsoContactType], value.(ForbiddenStruct).SsoMobile, time.Unix(value.(ForbiddenStruct).Expired, 0).Format("2006-01-02 15:04:05"), value.(ForbiddenStruct).Expired-now, value.(ForbiddenStruct).Reason, key.(string))))
 				w.Write([]byte("</tr>"))
 				return true
 			})
 			w.Write([]byte("</table><br><br>"))
 
+			if isSsoSessionOn() {
+				w.Write([]byte("登录会话<br>"))
+				w.Write([]byte("<table style=\"border-collapse: collapse;border:3px solid #CCC\" cellpadding=\"15\" cellspacing=\"15\">"))
+				w.Write([]byte("<tr>"))
+				w.Write([]byte("<td>会话</td><td>用户名</td><td>ip</td><td>扫码时间</td><td>过期时间</td><td>剩余秒数</td><td>操作</td>"))
+				w.Write([]byte("</tr>"))
+				MemSsoSessionMap.Range(func(key, value interface{}) bool {
+					session := value.(SsoSessionStruct)
+					var ssoUserInfo SsoUserInfoStruct
+					json.Unmarshal(session.SsoUser, &ssoUserInfo)
+					w.Write([]byte("<tr>"))
+					w.Write([]byte(fmt.Sprintf("<td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td><a href=\"javascript:del('MemSsoSessionMap','%s')\">删除</a></td>", key.(string)[:16], ssoUserInfo.SsoName, session.Ip, time.Unix(session.AuthTime, 0).Format("2006-01-02 15:04:05"), time.Unix(session.Expired, 0).Format("2006-01-02 15:04:05"), session.Expired-now, key.(string))))
+					w.Write([]byte("</tr>"))
+					return true
+				})
+				w.Write([]byte("</table><br><br>"))
+			}
+
 			w.Write([]byte("在线列表<br>"))
 			w.Write([]byte("<table style=\"border-collapse: collapse;border:3px solid #CCC\" cellpadding=\"15\" cellspacing=\"15\">"))
 			w.Write([]byte("<tr>"))
 			w.Write([]byte("<td>ticket</td><td>操作</td><td>过期时间</td><td>剩余秒数</td><td>json</td>"))
 			w.Write([]byte("</tr>"))
 			MemMap.Range(func(key, value interface{}) bool {
-				if key == "accessToken" {
-					return true
-				}
 				w.Write([]byte("<tr>"))
 				MemMapTTL.Load(key.(string))
 				var expired int64 = 0
@@ -1065,13 +871,19 @@ function del(map_name, map_key) {
 				w.WriteHeader(http.StatusNotImplemented)
 				return
 			}
+			audit(AuditEvent{Event: AuditAdminAction, Ip: getRemoteIp(req), UserAgent: req.Header.Get("User-Agent"), Detail: "manager delete " + mapName})
 			if mapName == "MemTrustIpMap" {
 				MemTrustIpMap.Delete(mapKey)
 			}
 			if mapName == "MemForbiddenMap" {
 				MemForbiddenMap.Delete(mapKey)
 			}
+			if mapName == "MemSsoSessionMap" {
+				MemSsoSessionMap.Delete(mapKey)
+			}
 			if mapName == "MemMap" {
+				auditTicket(AuditTicketRevoked, mapKey, "", "", "", "manager delete")
+				revokeTicketSessionToken(mapKey)
 				MemMap.Delete(mapKey)
 				MemMapTTL.Delete(mapKey)
 			}
@@ -1084,44 +896,23 @@ function del(map_name, map_key) {
 	}
 }
 
-func generateTicket(userAgent, userIp string, ttl int) string {
-	now := time.Now().UnixNano() / 1e6
-	key, _ := ConfigMap.Load("ticket_hash_secret")
-	counter := GetCounterInt()
-	checksum := hex.EncodeToString(Sha256(fmt.Sprintf("%d %d %s %s %d", now, counter, userAgent, userIp, 10000+ttl), key.(string)))
-	//fmt.Println(fmt.Sprintf("%d %d %s %s %d", now, counter, userAgent, userIp, 10000+ttl))
-	return fmt.Sprintf("%d%d%s%d", now, counter, checksum, 10000+ttl)
-}
-
-func checkTicket(tocheck, userAgent, userIp, where string) (bool, int) {
-	key, _ := ConfigMap.Load("ticket_hash_secret")
+var dingdingFakeBase string // 假钉钉服务的地址, 启动了假钉钉服务时所有钉钉接口都调它
 
-	if len(tocheck) != 86 {
-		return false, 0
+// 钉钉接口地址前缀, oapi: 旧版接口  api: 新版v1.0接口  login: 新版登录页
+// 可以配置成内网代理地址, 没有配置用钉钉官方地址
+func GetDingdingApiBase(host string) string {
+	if dingdingFakeBase != "" {
+		return dingdingFakeBase
 	}
-	if where == "scan" {
-		old, err := strconv.Atoi(tocheck[:10])
-		if err != nil {
-			return false, 0
-		}
-		now2 := int(time.Now().Unix())
-		if old+100 < now2 { // 给扫码的用户100秒扫码时间
-			return false, 0
-		}
+	defaults := map[string]string{
+		"oapi":  "https://oapi.dingtalk.com",
+		"api":   "https://api.dingtalk.com",
+		"login": "https://login.dingtalk.com",
 	}
-	// 16290920600601001cae543b91ca4278a80d8a3519550e2113ea609bb8e5604376cbacd95e845c8ae10300
-	now := tocheck[:13]
-	counter := tocheck[13:17]
-	ttl := tocheck[17+64:]
-	realCheckSum := hex.EncodeToString(Sha256(fmt.Sprintf("%s %s %s %s %s", now, counter, userAgent, userIp, ttl), key.(string)))
-	//fmt.Println(fmt.Sprintf("%s %s %s %s %s", now, counter, userAgent, userIp, ttl))
-
-	ttlInt, err := strconv.Atoi(ttl)
-	if err != nil {
-		return false, 0
+	if temp, ok := ConfigMap.Load("dingding_" + host + "_base"); ok && temp.(string) != "" {
+		return strings.TrimRight(temp.(string), "/")
 	}
-
-	return realCheckSum == tocheck[17:17+64], ttlInt - 10000
+	return defaults[host]
 }
 
 func Sha256(src, key string) []byte {
@@ -1130,12 +921,9 @@ func Sha256(src, key string) []byte {
 	return m.Sum(nil)
 }
 
-func GetDingdingSignature(time, key string) string {
-	return url.QueryEscape(base64.StdEncoding.EncodeToString(Sha256(time, key)))
-}
-
-func FetchDingApi(postUrl, postBody, method string) ([]byte, map[string]interface{}, error) {
-	loger.Println("New Request,", postUrl, postBody)
+func FetchDingApi(postUrl, postBody, method string) (body []byte, respMap map[string]interface{}, err error) {
+	loger.Println("New Request,", method, redactUrl(postUrl)) // 返回内容有用户信息和token, 请求内容可能有密钥, 都不记
+	defer func(start time.Time) { observeApiRequest(postUrl, start, err) }(time.Now())
 	client := &http.Client{}
 	request, err := http.NewRequest(method, postUrl, strings.NewReader(postBody))
 	if err != nil {
@@ -1148,8 +936,8 @@ func FetchDingApi(postUrl, postBody, method string) ([]byte, map[string]interfac
 		return nil, nil, err
 	}
 	defer response.Body.Close()
-	body, _ := ioutil.ReadAll(response.Body)
-	respMap := make(map[string]interface{})
+	body, _ = ioutil.ReadAll(response.Body)
+	respMap = make(map[string]interface{})
 	err2 := json.Unmarshal(body, &respMap)
 	if err2 != nil {
 		return body, nil, errors.New(string(body))
@@ -1165,21 +953,15 @@ func FetchDingApi(postUrl, postBody, method string) ([]byte, map[string]interfac
 	return body, respMap, nil
 }
 
-func GetDingdingAccessToken(appKey, appSecret string) ([]byte, string, bool) {
-	postUrl := fmt.Sprintf("https://oapi.dingtalk.com/gettoken?appkey=%s&appsecret=%s", appKey, appSecret)
-	respBody, respMap, err := FetchDingApi(postUrl, `{}`, "GET")
-	// {"errcode": 0, "access_token": "96fc7a7axxx", "errmsg": "ok", "expires_in": 7200}
-	if err != nil {
-		return respBody, "err:24", false
-	}
-	if _, isset := respMap["access_token"]; !isset {
-		return respBody, "err:25", false
+func successReturn(w http.ResponseWriter, isExternalUser bool, ssoUserInfo SsoUserInfoStruct, ticket string, ttl int, userIp string, userAgent string) {
+	if isSsoSessionOn() { // 扫码成功, 这个浏览器之后打开扫码页不用再扫码
+		startSsoSession(w, isExternalUser, ssoUserInfo, userIp, userAgent)
 	}
-
-	return nil, respMap["access_token"].(string), true
+	ticketReturn(w, isExternalUser, ssoUserInfo, ticket, ttl, userIp, userAgent)
 }
 
-func successReturn(w http.ResponseWriter, isExternalUser bool, ssoUserInfo SsoUserInfoStruct, ticket string, ttl int, userIp string, userAgent string) {
+// 保存ticket对应的用户信息, 返回给业务方, 扫码成功和单点登录会话都走这里
+func ticketReturn(w http.ResponseWriter, isExternalUser bool, ssoUserInfo SsoUserInfoStruct, ticket string, ttl int, userIp string, userAgent string) {
 	ssoUserInfo.SsoTicket = ticket
 
 	ssoUserByte, err := json.Marshal(ssoUserInfo)
@@ -1188,28 +970,38 @@ func successReturn(w http.ResponseWriter, isExternalUser bool, ssoUserInfo SsoUs
 		EchoJs(w, "err:19", nil)
 		return
 	}
+	if isSessionTokenOn() { // 令牌里的用户信息按业务方登记的claims过滤
+		var client ClientStruct
+		if temp, ok := MemTicketClientMap.Load(ticket); ok {
+			client, _ = getClient(temp.(TicketClientStruct).ClientId)
+		}
+		if token, err := issueSessionToken(ticket, ssoUserInfo, filterClientClaims(client, ssoUserByte), ttl, userIp, userAgent); err != nil {
+			loger.Println("session token sign error:", err.Error())
+		} else {
+			ssoUserInfo.SsoSessionToken = token
+			ssoUserByte, _ = json.Marshal(ssoUserInfo)
+		}
+	}
 
 	now := time.Now().Unix()
 	MemMap.Store(ticket, ssoUserByte)
 	MemMapTTL.Store(ticket, now+int64(ttl))
 
-	if accessTokenLoaded, ok := MemMap.Load("accessToken"); ok {
-		accessToken := accessTokenLoaded.(string)
-
+	if _, ok := getIdentityProvider("dingtalk"); ok {
 		if temp, ok := ConfigMap.Load("notify_user_id"); ok {
 			notifyUserId := temp.(string)
 			if notifyUserId != "" {
 				title, _ := ConfigMap.Load("title")
 				if isExternalUser == false { // 内部员工
 					for _, _notifyUserId := range strings.Split(notifyUserId, ",") {
-						SendDingdingText(title.(string), "  员工登录行为通知！姓名：**"+ssoUserInfo.SsoName+"**  登录ip："+userIp+"  手机号："+ssoUserInfo.SsoMobile+"  登录设备："+userAgent, _notifyUserId, accessToken)
+						SendDingdingText(title.(string), "  员工登录行为通知！姓名：**"+ssoUserInfo.SsoName+"**  登录ip："+userIp+"  手机号："+ssoUserInfo.SsoMobile+"  登录设备："+userAgent, _notifyUserId)
 					}
-				} else { // 外部联系人
+				} else if ssoUserInfo.SsoProvider == "dingtalk" { // 外部联系人, 负责人userId是钉钉的才能推送
 					if temp, ok := ConfigMap.Load("notify_dingding_id"); ok {
 						notifyDingId := temp.(string)
 						if notifyDingId != "" {
-							SendDingdingText(title.(string), "  外部联系人登录行为通知，请注意！姓名：**"+ssoUserInfo.SsoName+"**  登录ip："+userIp+"  手机号："+ssoUserInfo.SsoMobile+"  有异常情况请立即[联系IT部门](dingtalk://dingtalkclient/action/sendmsg?dingtalk_id="+notifyDingId+")", ssoUserInfo.SsoFollowerUser.SsoDingdingUserId, accessToken)
-							SendDingdingText(title.(string), "  外部联系人登录行为通知！姓名：**"+ssoUserInfo.SsoName+"**  登录ip："+userIp+"  手机号："+ssoUserInfo.SsoMobile+"  内部负责人："+ssoUserInfo.SsoFollowerUser.SsoName+"  登录设备："+userAgent, notifyUserId, accessToken)
+							SendDingdingText(title.(string), "  外部联系人登录行为通知，请注意！姓名：**"+ssoUserInfo.SsoName+"**  登录ip："+userIp+"  手机号："+ssoUserInfo.SsoMobile+"  有异常情况请立即[联系IT部门](dingtalk://dingtalkclient/action/sendmsg?dingtalk_id="+notifyDingId+")", ssoUserInfo.SsoFollowerUser.SsoDingdingUserId)
+							SendDingdingText(title.(string), "  外部联系人登录行为通知！姓名：**"+ssoUserInfo.SsoName+"**  登录ip："+userIp+"  手机号："+ssoUserInfo.SsoMobile+"  内部负责人："+ssoUserInfo.SsoFollowerUser.SsoName+"  登录设备："+userAgent, notifyUserId)
 						}
 					}
 				}
@@ -1217,26 +1009,51 @@ func successReturn(w http.ResponseWriter, isExternalUser bool, ssoUserInfo SsoUs
 		}
 	}
 
-	trustIpStoreDuration, _ := ConfigMap.Load("trust_ip_store_duration")
-	trustIpStoreDurationInt, err := strconv.Atoi(trustIpStoreDuration.(string))
-	if err == nil && trustIpStoreDurationInt > 0 {
+	if trustIpStoreDuration := getConfig().TrustIpStoreDuration; trustIpStoreDuration > 0 {
 		if trustIpStruct, ok := MemTrustIpMap.Load(userIp); !ok {
-			MemTrustIpMap.Store(userIp, TrustIpStruct{TotalLoginCount: 1, Expired: now + int64(trustIpStoreDurationInt)})
+			MemTrustIpMap.Store(userIp, TrustIpStruct{TotalLoginCount: 1, Expired: now + trustIpStoreDuration})
 		} else {
-			MemTrustIpMap.Store(userIp, TrustIpStruct{TotalLoginCount: trustIpStruct.(TrustIpStruct).TotalLoginCount + 1, Expired: now + int64(trustIpStoreDurationInt)})
+			MemTrustIpMap.Store(userIp, TrustIpStruct{TotalLoginCount: trustIpStruct.(TrustIpStruct).TotalLoginCount + 1, Expired: now + trustIpStoreDuration})
 			trustIpStruct = nil
 		}
 		loger.Println("Add trust ip:", userIp)
 	}
 
 	loger.Println("Scan Success,", ssoUserInfo.SsoName, "登录成功, ip:", userIp, ", 登录设备:", userAgent)
+	audit(AuditEvent{Event: AuditTicketIssued, CorrelationId: auditCorrelationId(ticket), UserId: ssoUserInfo.SsoDingdingUserId, UserName: ssoUserInfo.SsoName, Provider: ssoUserInfo.SsoProvider, App: getTicketApp(ticket), Ip: userIp, UserAgent: userAgent, Detail: "ttl: " + strconv.Itoa(ttl)})
+	if oidcAuthorizeReturn(w, ticket) { // oidc发起的扫码, 跳转回业务方
+		return
+	}
+	if samlAuthorizeReturn(w, ticket, ssoUserInfo, now+int64(ttl)) { // saml发起的扫码, POST回SP
+		return
+	}
+	if casAuthorizeReturn(w, ticket, ssoUserByte) { // cas发起的扫码, 带ST跳转回service
+		return
+	}
+	if temp, ok := MemTicketClientMap.Load(ticket); ok { // 业务方发起的扫码, 只给它登记的origin
+		ticketClient := temp.(TicketClientStruct)
+		if ticketClient.RedirectUri != "" {
+			w.Header().Set("Location", appendQuery(ticketClient.RedirectUri, url.Values{"sso_ticket": {ticket}}))
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		client, _ := getClient(ticketClient.ClientId)
+		EchoJsToOrigin(w, ticketClient.Origin, "0", filterClientClaims(client, ssoUserByte))
+		return
+	}
 	EchoJs(w, "0", ssoUserByte) // 无异常
 }
 
 func EchoJs(w http.ResponseWriter, err string, detail []byte) {
+	EchoJsToOrigin(w, "*", err, detail)
+}
+
+// 只有origin是打开扫码页的业务方页面时, 浏览器才会把消息发给它
+func EchoJsToOrigin(w http.ResponseWriter, origin string, err string, detail []byte) {
+	targetOrigin, _ := json.Marshal(origin)
 	w.Write([]byte(`<script>window.opener.postMessage(`))
 	EchoJson(w, err, detail)
-	w.Write([]byte(`, '*');window.close()</script>`))
+	w.Write([]byte(`, ` + string(targetOrigin) + `);window.close()</script>`))
 	EchoJson(w, err, detail)
 }
 
@@ -1267,63 +1084,38 @@ func GetRandomStr(len int) string {
 	return hex.EncodeToString(nonce)
 }
 
-func GetIp(req *http.Request) string {
-	remoteIp := strings.Split(req.RemoteAddr, ":")[0]
-	userIp := req.Header.Get("X-Real-IP")
-	if len(userIp) > 0 {
-		if trustedProxies, ok := ConfigMap.Load("trusted_proxies"); ok {
-			if len(trustedProxies.(string)) > 0 {
-				for _, trustIp := range strings.Split(trustedProxies.(string), ",") {
-					if remoteIp == trustIp || trustIp == "0.0.0.0" {
-						return userIp
-					}
-				}
-			}
-		}
-	}
-	return remoteIp
-}
-
-func isInnerIp(ip string) bool {
-	if ip == "127.0.0.1" {
-		return true
-	}
-	ipArr := strings.Split(ip, ",")
-	switch true {
-	case ipArr[0] == "10":
-		return true
-	case ipArr[0] == "172" && (ipArr[1] == "16" || ipArr[1] == "17" || ipArr[1] == "18" || ipArr[1] == "19" || ipArr[1] == "20" || ipArr[1] == "21" || ipArr[1] == "22" || ipArr[1] == "23" || ipArr[1] == "24" || ipArr[1] == "25" || ipArr[1] == "26" || ipArr[1] == "27" || ipArr[1] == "28" || ipArr[1] == "29" || ipArr[1] == "30" || ipArr[1] == "31"):
-		return true
-	case ipArr[0] == "192" && ipArr[1] == "168":
-		return true
-	default:
-		return false
-	}
-}
-
-func SendDingdingText(title, msg string, userid string, accessToken string) bool {
-	postUrl := fmt.Sprintf("https://oapi.dingtalk.com/topapi/message/corpconversation/asyncsend_v2?access_token=%s", accessToken)
+func SendDingdingText(title, msg string, userid string) bool {
 	dingdingAgentId, _ := ConfigMap.Load("dingding_agent_id")
-	respBody, _, err := FetchDingApi(postUrl, `{"agent_id":"`+dingdingAgentId.(string)+`","msg":{"msgtype":"markdown","markdown":{"title":"`+title+`","text":"`+msg+`"}},"userid_list":"`+userid+`","to_all_user":false}`, "POST")
+	_, respBody, err := dingdingClient.SendMarkdown(dingdingAgentId.(string), userid, title, msg)
 
 	loger.Println(string(respBody))
 
 	if err != nil {
-		//w.WriteHeader(http.StatusInternalServerError)
-		//EchoJs(w, "err:26", respBody)
 		loger.Println(err.Error())
+		metricNotifyFailures.Inc()
 		return false
 	}
 
 	return true
 }
 
+// 二次认证失败被限制的open id, 钉钉推送离职事件被限制的user id
+func isUserForbidden(userId, openId string) bool {
+	if _, ok := MemForbiddenMap.Load(userId); ok && userId != "" {
+		return true
+	}
+	if _, ok := MemForbiddenMap.Load(openId); ok && openId != "" {
+		return true
+	}
+	return false
+}
+
 func doTwoFactorAuthenticationCheck(w http.ResponseWriter, req *http.Request, ssoUserInfo SsoUserInfoStruct, isGet bool, userIp string, userAgent string) string {
 	if _, ok := MemTrustIpMap.Load(userIp); !ok {
-		twoFactorAuthentication, _ := ConfigMap.Load("two_factor_authentication")
-		if twoFactorAuthentication.(string) == "on" {
+		if getConfig().TwoFactorAuthentication {
 			if isGet == true {
 				loger.Println(fmt.Sprintf("twoFactorAuthenticationCheck step 1 echoForm ip: %s, userAgent: %s", userIp, userAgent))
+				audit(AuditEvent{Event: AuditTwoFactorChallenge, CorrelationId: auditCorrelationId(req.URL.Query().Get("state")), UserId: ssoUserInfo.SsoDingdingUserId, UserName: ssoUserInfo.SsoName, Provider: ssoUserInfo.SsoProvider, Ip: userIp, UserAgent: userAgent})
 				echoTwoFactorAuthenticationForm(w, ssoUserInfo)
 				return "exit"
 			} else {
@@ -1338,17 +1130,17 @@ func doTwoFactorAuthenticationCheck(w http.ResponseWriter, req *http.Request, ss
 				}
 				if twoFactorAuthenticationCheck != "--success--" { // 验证失败
 					loger.Println(fmt.Sprintf("twoFactorAuthenticationCheck step 2 fail \"%s\" ip: %s, userAgent: %s", twoFactorAuthenticationCheck, userIp, userAgent))
+					audit(AuditEvent{Event: AuditTwoFactorFailed, CorrelationId: auditCorrelationId(req.URL.Query().Get("state")), UserId: ssoUserInfo.SsoDingdingUserId, UserName: ssoUserInfo.SsoName, Provider: ssoUserInfo.SsoProvider, Ip: userIp, UserAgent: userAgent, ErrCode: twoFactorAuthenticationCheck})
 					EchoJs(w, twoFactorAuthenticationCheck, nil)
 					now := time.Now().Unix()
-					twoFactorAuthenticationBlockDuration, _ := ConfigMap.Load("two_factor_authentication_block_duration")
-					twoFactorAuthenticationBlockDurationInt, err := strconv.Atoi(twoFactorAuthenticationBlockDuration.(string))
-					if err == nil && twoFactorAuthenticationBlockDurationInt > 0 {
-						MemForbiddenMap.Store(ssoUserInfo.SsoDingdingOpenId, ForbiddenStruct{SsoName: ssoUserInfo.SsoName, SsoContactType: ssoUserInfo.SsoContactType, SsoMobile: ssoUserInfo.SsoMobile, Expired: now + int64(twoFactorAuthenticationBlockDurationInt)})
-						//MemForbiddenMap.Store(userIp, ForbiddenStruct{SsoName: ssoUserInfo.SsoName, SsoContactType: ssoUserInfo.SsoContactType, SsoMobile: ssoUserInfo.SsoMobile, Expired: now + int64(twoFactorAuthenticationBlockDurationInt)})
+					if blockDuration := getConfig().TwoFactorAuthenticationBlockDuration; blockDuration > 0 {
+						MemForbiddenMap.Store(ssoUserInfo.SsoDingdingOpenId, ForbiddenStruct{SsoName: ssoUserInfo.SsoName, SsoContactType: ssoUserInfo.SsoContactType, SsoMobile: ssoUserInfo.SsoMobile, Expired: now + blockDuration, Reason: "二次认证失败"})
+						//MemForbiddenMap.Store(userIp, ForbiddenStruct{SsoName: ssoUserInfo.SsoName, SsoContactType: ssoUserInfo.SsoContactType, SsoMobile: ssoUserInfo.SsoMobile, Expired: now + blockDuration})
 					}
 					return "exit"
 				}
 				loger.Println(fmt.Sprintf("twoFactorAuthenticationCheck step 2 success ip: %s, userAgent: %s", userIp, userAgent))
+				audit(AuditEvent{Event: AuditTwoFactorPassed, CorrelationId: auditCorrelationId(req.URL.Query().Get("state")), UserId: ssoUserInfo.SsoDingdingUserId, UserName: ssoUserInfo.SsoName, Provider: ssoUserInfo.SsoProvider, Ip: userIp, UserAgent: userAgent})
 			}
 		}
 	}
@@ -1448,34 +1240,3 @@ func GetCounterInt() int {
 }
 
 var ConfigMap sync.Map
-
-func ReadFile() {
-	goReadFile()
-}
-
-func goReadFile() {
-	b, err := ioutil.ReadFile("config.ini") // just pass the file name
-	if err != nil {
-		panic("config.ini read error")
-	}
-
-	str := string(b) // convert content to a 'string'
-
-	var sendContentArr = strings.Split(strings.Trim(strings.Trim(strings.Trim(strings.Replace(str, "\r\n", "\n", -1), "\n"), "\t"), " "), "\n")
-	if len(sendContentArr) < 2 {
-		panic("config.ini read error")
-	}
-
-	for _, line := range sendContentArr {
-		kv := strings.SplitN(line, " = ", 2)
-
-		if len(kv) == 2 {
-			ConfigMap.Store(kv[0], kv[1])
-			//fmt.Println(kv[0], kv[1])
-		}
-	}
-
-	time.Sleep(time.Second * 5)
-
-	go goReadFile()
-}
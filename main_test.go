@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 用仓库里的config.ini加上覆盖的配置项, 不经过配置文件直接生效
+func setTestConfig(t *testing.T, overrides map[string]string) *Config {
+	t.Helper()
+	b, err := ioutil.ReadFile("config.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, problems := parseConfig(b)
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	for key, value := range overrides {
+		values[key] = value
+	}
+	config, err := newConfig(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ConfigMap.Range(func(key, value interface{}) bool {
+		ConfigMap.Delete(key)
+		return true
+	})
+	for key, value := range config.Values {
+		ConfigMap.Store(key, value)
+	}
+	currentConfig.Store(config)
+	return config
+}
+
+// 假钉钉 + auto_login_unionid 走完 扫码页 -> 钉钉回调 -> fetch 整个流程
+func TestScanFetchWithFakeDingding(t *testing.T) {
+	b, err := ioutil.ReadFile("demo/dingding_fake.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixture map[string]interface{}
+	if err := json.Unmarshal(b, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	fixture["auto_login_unionid"] = "fakeunion0001"
+	b, _ = json.Marshal(fixture)
+	fixtureFile := filepath.Join(t.TempDir(), "dingding_fake.json")
+	if err := ioutil.WriteFile(fixtureFile, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := setTestConfig(t, map[string]string{"dingding_fake_fixture": fixtureFile, "notify_user_id": "", "session_store": "memory"})
+	oldStore, oldBase := sessionStore, dingdingFakeBase
+	sessionStore = NewMemoryStore()
+	defer func() {
+		sessionStore, dingdingFakeBase = oldStore, oldBase
+	}()
+	startFakeDingding()
+
+	const userAgent = "test-browser"
+	const userIp = "192.0.2.10"
+	newRequest := func(method, target string, body io.Reader) *http.Request {
+		req := httptest.NewRequest(method, target, body)
+		req.RemoteAddr = userIp + ":50000"
+		req.Header.Set("User-Agent", userAgent)
+		return req
+	}
+
+	// 扫码页跳转到假钉钉的扫码页
+	w := httptest.NewRecorder()
+	scanHandler()(w, newRequest("GET", config.ScanUrl+"?auto=1&ttl=60", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("scan status = %d, body = %s", w.Code, w.Body.String())
+	}
+	qrUrl := w.Header().Get("Location")
+	if !strings.HasPrefix(qrUrl, dingdingFakeBase+"/") {
+		t.Fatalf("scan redirect = %s, want fake dingding %s", qrUrl, dingdingFakeBase)
+	}
+
+	// 假钉钉直接用auto_login_unionid登录, 跳转回scan_success_url
+	noRedirect := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.Get(qrUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || callback.Path != config.ScanSuccessUrl {
+		t.Fatalf("fake dingding redirect = %s", resp.Header.Get("Location"))
+	}
+	ticket := callback.Query().Get("state")
+
+	w = httptest.NewRecorder()
+	scanSuccessHandler()(w, newRequest("GET", callback.RequestURI(), nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"sso_ticket":"`+ticket+`"`) {
+		t.Fatalf("scan success status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	// 业务方用ticket取用户信息
+	form := url.Values{"sso_ticket": {ticket}, "user_agent": {userAgent}, "client_ip": {userIp}}
+	req := newRequest("POST", config.TicketUrl, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	fetchByTicketHandler()(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("fetch status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var result struct {
+		Err    string            `json:"err"`
+		Detail SsoUserInfoStruct `json:"detail"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("fetch body = %s, %v", w.Body.String(), err)
+	}
+	user := result.Detail
+	if user.SsoTicket != ticket || user.SsoProvider != "dingtalk" || user.SsoName != "张三" || user.SsoMobile != "13800000001" || user.SsoJobTitle != "架构师" {
+		t.Fatalf("fetch user = %+v", user)
+	}
+	if user.SsoDingdingUserId != "fake0001" || user.SsoDingdingUnionId != "fakeunion0001" || user.SsoDingdingOpenId != "fakeopen0001" || user.SsoContactType != 0 {
+		t.Fatalf("fetch user ids = %+v", user)
+	}
+	if len(user.SsoUserDeptInfo) != 2 {
+		t.Fatalf("fetch user depts = %+v", user.SsoUserDeptInfo)
+	}
+	depts := map[string]SsoUserDeptStruct{}
+	for _, dept := range user.SsoUserDeptInfo {
+		depts[dept.SsoDeptId] = dept
+	}
+	if dept := depts["1001"]; dept.SsoDeptName != "技术部" || dept.SsoIsDeptOwner != "1" || strings.Join(dept.SsoDeptPathNames, "/") != "某某公司/技术部" {
+		t.Fatalf("dept 1001 = %+v", dept)
+	}
+	if dept := depts["1002"]; dept.SsoDeptName != "客服部" || dept.SsoIsDeptOwner != "0" {
+		t.Fatalf("dept 1002 = %+v", dept)
+	}
+
+	// 换了浏览器的ticket取不到
+	form.Set("user_agent", "other-browser")
+	req = newRequest("POST", config.TicketUrl, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	fetchByTicketHandler()(w, req)
+	if w.Code != http.StatusGone {
+		t.Fatalf("fetch with other user agent status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+// Prometheus监控指标
+// 不引入client_golang, 按Prometheus文本格式自己输出, 只有counter/gauge/histogram三种
+// 登录相关的计数从审计事件统计, 接口耗时在调用钉钉/企业微信/飞书接口的地方统计
+// metrics_url 只允许本机和内网访问
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metricCounter struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]float64 // 标签值用\xff连起来做key
+}
+
+type metricHistogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*metricHistogramSeries
+}
+
+type metricHistogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newMetricCounter(name, help string, labels ...string) *metricCounter {
+	return &metricCounter{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func newMetricHistogram(name, help string, buckets []float64, labels ...string) *metricHistogram {
+	return &metricHistogram{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*metricHistogramSeries{}}
+}
+
+func (c *metricCounter) Inc(labelValues ...string) {
+	c.mutex.Lock()
+	c.values[strings.Join(labelValues, "\xff")]++
+	c.mutex.Unlock()
+}
+
+func (h *metricHistogram) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mutex.Lock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &metricHistogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			series.counts[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+	h.mutex.Unlock()
+}
+
+var (
+	metricScansStarted   = newMetricCounter("sso_scans_started_total", "打开扫码页生成的ticket数")
+	metricCallbacks      = newMetricCounter("sso_callbacks_total", "扫码回调结果", "outcome", "err_code")
+	metricTwoFactor      = newMetricCounter("sso_two_factor_total", "二次认证结果", "result")
+	metricFetchByTicket  = newMetricCounter("sso_fetch_by_ticket_total", "业务方fetch结果, hit取到 miss没取到 renewed续期", "result", "err_code")
+	metricTicketsRevoked = newMetricCounter("sso_tickets_revoked_total", "离职/管理员删除的ticket事件数")
+	metricApiRequests    = newMetricCounter("sso_api_requests_total", "调用钉钉/企业微信/飞书接口的次数", "host", "endpoint", "result")
+	metricApiDuration    = newMetricHistogram("sso_api_request_duration_seconds", "调用钉钉/企业微信/飞书接口的耗时", []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "host", "endpoint")
+	metricTokenRefreshes = newMetricCounter("sso_access_token_refreshes_total", "accessToken刷新次数", "name", "result")
+	metricNotifyFailures = newMetricCounter("sso_notification_failures_total", "钉钉工作通知发送失败次数")
+	metricSessionTokens  = newMetricCounter("sso_session_token_verifications_total", "session_token_url校验结果", "result", "err_code")
+	metricRateLimited    = newMetricCounter("sso_rate_limited_total", "被限流拒绝的请求数, fetch_fail是fetch失败计数超限", "limit")
+	metricStoreMaps      = map[string]*StoreMap{"ticket": MemMap, "ticket_ttl": MemMapTTL, "trust_ip": MemTrustIpMap, "forbidden": MemForbiddenMap, "token_revoked": MemRevokedTokenMap, "sso_session": MemSsoSessionMap}
+	metricCounters       = []*metricCounter{metricScansStarted, metricCallbacks, metricTwoFactor, metricFetchByTicket, metricTicketsRevoked, metricApiRequests, metricTokenRefreshes, metricNotifyFailures, metricRateLimited, metricSessionTokens}
+	metricApiIdSegments  = map[string]bool{"users": true, "departments": true} // 这些路径后面一段是id, 换成:id, 防止标签太多
+)
+
+// 审计事件同时计数
+func observeAuditEvent(event AuditEvent) {
+	switch event.Event {
+	case AuditScanStarted:
+		metricScansStarted.Inc()
+	case AuditTicketIssued:
+		metricCallbacks.Inc("success", "")
+	case AuditUserNotFound, AuditUserInactive, AuditLoginFailed:
+		metricCallbacks.Inc("failed", event.ErrCode)
+	case AuditTwoFactorChallenge:
+		metricTwoFactor.Inc("challenged")
+	case AuditTwoFactorPassed:
+		metricTwoFactor.Inc("passed")
+	case AuditTwoFactorFailed:
+		metricTwoFactor.Inc("failed")
+	case AuditTicketFetched:
+		metricFetchByTicket.Inc("hit", "")
+	case AuditTicketRenewed:
+		metricFetchByTicket.Inc("renewed", "")
+	case AuditTicketFetchFailed:
+		metricFetchByTicket.Inc("miss", event.ErrCode)
+	case AuditTicketRevoked:
+		metricTicketsRevoked.Inc()
+	}
+}
+
+// 接口地址去掉参数和id后作为endpoint标签
+func metricApiEndpoint(rawUrl string) (string, string) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", ""
+	}
+	segments := strings.Split(u.Path, "/")
+	for i := 1; i < len(segments); i++ {
+		if metricApiIdSegments[segments[i-1]] && segments[i] != "" {
+			segments[i] = ":id"
+		}
+	}
+	return u.Host, strings.Join(segments, "/")
+}
+
+func observeApiRequest(rawUrl string, start time.Time, err error) {
+	host, endpoint := metricApiEndpoint(rawUrl)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metricApiRequests.Inc(host, endpoint, result)
+	metricApiDuration.Observe(time.Since(start).Seconds(), host, endpoint)
+}
+
+func escapeMetricLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatMetricLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+`="`+escapeMetricLabel(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeMetricLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (c *metricCounter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatMetricValue(c.values[""]))
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatMetricLabels(c.labels, key), formatMetricValue(c.values[key]))
+	}
+}
+
+func (h *metricHistogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		for i, bucket := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatMetricLabels(h.labels, key, "le", formatMetricValue(bucket)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatMetricLabels(h.labels, key, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatMetricLabels(h.labels, key), formatMetricValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatMetricLabels(h.labels, key), series.count)
+	}
+}
+
+var metricStoreCounts struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+// 数一遍存储的大小, redis要SCAN全部key, 不能每次抓取都数
+func countStoreEntries() {
+	counts := make(map[string]int, len(metricStoreMaps))
+	for name, storeMap := range metricStoreMaps {
+		count := 0
+		sessionStore.Range(storeMap.bucket, func(key string, value []byte) bool {
+			count++
+			return true
+		})
+		counts[name] = count
+	}
+	metricStoreCounts.mutex.Lock()
+	metricStoreCounts.counts = counts
+	metricStoreCounts.mutex.Unlock()
+}
+
+// 每分钟数一次, 抓取时输出上次数的结果
+func metricStoreLoop() {
+	if !loopSleep(time.Second * 60) {
+		return
+	}
+	defer loopDone()
+	countStoreEntries()
+	go metricStoreLoop()
+}
+
+func writeStoreMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP sso_store_entries 存储里的条目数, 每分钟统计一次, ticket是在线的ticket, trust_ip是可信ip, forbidden是禁止的ip/用户\n# TYPE sso_store_entries gauge\n")
+	metricStoreCounts.mutex.Lock()
+	defer metricStoreCounts.mutex.Unlock()
+	names := make([]string, 0, len(metricStoreCounts.counts))
+	for name := range metricStoreCounts.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "sso_store_entries{map=%q} %d\n", name, metricStoreCounts.counts[name])
+	}
+}
+
+func metricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isInnerIp(getRemoteIp(req)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch req.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			for _, counter := range metricCounters {
+				counter.write(w)
+			}
+			metricApiDuration.write(w)
+			writeStoreMetrics(w)
+			return
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+	}
+}
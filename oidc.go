@@ -0,0 +1,678 @@
+package main
+
+// OpenID Connect 服务端
+// 让只支持OIDC的系统(Grafana/GitLab/Jenkins/Kubernetes dashboard等)也能接入钉钉扫码登录
+// 流程: /authorize 生成ticket -> 钉钉扫码 -> scan_success_url 回调 -> 302跳转回业务方redirect_uri?code=xx&state=xx -> 业务方用code换/token
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var oidcPrivateKey *rsa.PrivateKey
+var oidcKeyId string
+
+var MemOidcAuthMap = &StoreMap{bucket: "oidc_auth", encode: encodeJson, decode: decodeOidcAuthRequest, expired: expiredOidcAuthRequest} // ticket => OidcAuthRequestStruct, 等待扫码的授权请求
+var MemOidcCodeMap = &StoreMap{bucket: "oidc_code", encode: encodeJson, decode: decodeOidcCode, expired: expiredOidcCode}               // code => OidcCodeStruct, 一次性授权码
+var MemOidcTokenMap = &StoreMap{bucket: "oidc_token", encode: encodeJson, decode: decodeOidcToken, expired: expiredOidcToken}           // access_token => OidcTokenStruct
+
+type OidcAuthRequestStruct struct {
+	ClientId            string `json:"client_id"`
+	RedirectUri         string `json:"redirect_uri"`
+	RedirectUriSent     bool   `json:"redirect_uri_sent"` // authorize时带了redirect_uri, /token时也必须带上相同的
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Expired             int64  `json:"expired"` // 过期时间戳 到点会自动删除
+}
+
+type OidcCodeStruct struct {
+	Ticket      string                `json:"ticket"`
+	AuthRequest OidcAuthRequestStruct `json:"auth_request"`
+	AuthTime    int64                 `json:"auth_time"`
+	Expired     int64                 `json:"expired"`
+}
+
+type OidcTokenStruct struct {
+	Ticket   string `json:"ticket"`
+	ClientId string `json:"client_id"`
+	Scope    string `json:"scope"`
+	Expired  int64  `json:"expired"`
+}
+
+func decodeOidcAuthRequest(b []byte) (interface{}, error) {
+	var authRequest OidcAuthRequestStruct
+	err := json.Unmarshal(b, &authRequest)
+	return authRequest, err
+}
+
+func expiredOidcAuthRequest(value interface{}) int64 {
+	return value.(OidcAuthRequestStruct).Expired
+}
+
+func decodeOidcCode(b []byte) (interface{}, error) {
+	var code OidcCodeStruct
+	err := json.Unmarshal(b, &code)
+	return code, err
+}
+
+func expiredOidcCode(value interface{}) int64 {
+	return value.(OidcCodeStruct).Expired
+}
+
+func decodeOidcToken(b []byte) (interface{}, error) {
+	var token OidcTokenStruct
+	err := json.Unmarshal(b, &token)
+	return token, err
+}
+
+func expiredOidcToken(value interface{}) int64 {
+	return value.(OidcTokenStruct).Expired
+}
+
+type OidcDepartmentClaim struct {
+	Id      string   `json:"id"`
+	Name    string   `json:"name"`
+	IsOwner bool     `json:"is_owner"`
+	Path    []string `json:"path,omitempty"` // 从根部门到所在部门的部门名称
+}
+
+func isOidcOn() bool {
+	oidc, ok := ConfigMap.Load("oidc")
+	return ok && oidc.(string) == "on"
+}
+
+// issuer默认是 domain, 可以用oidc_issuer覆盖, 例如 https://sso.xx.com/bms-sso
+func getOidcIssuer() string {
+	if temp, ok := ConfigMap.Load("oidc_issuer"); ok && temp.(string) != "" {
+		return strings.TrimRight(temp.(string), "/")
+	}
+	domain, _ := ConfigMap.Load("domain")
+	return strings.TrimRight(domain.(string), "/")
+}
+
+// 配置格式 oidc_client:grafana = secret哈希|https://grafana.xx.com/login/generic_oauth,https://grafana2.xx.com/login/generic_oauth
+// secret哈希和client:一样是 sha256$盐$hex(sha256(盐+secret)), 用 gen-secret client 生成
+// 没有配置oidc_client的, 用client.go登记的业务方(client:配置或管理接口), redirect_uri用它登记的
+func getOidcClient(clientId string) (ClientStruct, bool) {
+	if clientId == "" {
+		return ClientStruct{}, false
+	}
+	temp, ok := ConfigMap.Load("oidc_client:" + clientId)
+	if !ok {
+		return getClient(clientId)
+	}
+	hashAndUris := strings.SplitN(temp.(string), "|", 2)
+	if len(hashAndUris) != 2 || hashAndUris[0] == "" {
+		return ClientStruct{}, false
+	}
+	if !strings.HasPrefix(hashAndUris[0], "sha256$") {
+		loger.Println("oidc_client:"+clientId, "secret is not a sha256$salt$hash, generate one with: gen-secret client")
+	}
+	return ClientStruct{ClientId: clientId, SecretHash: hashAndUris[0], RedirectUris: splitList(hashAndUris[1]), Source: "config"}, true
+}
+
+func getOidcTokenTTL() int {
+	ttl := 3600
+	if temp, ok := ConfigMap.Load("oidc_token_ttl"); ok {
+		if ttlInt, err := strconv.Atoi(temp.(string)); err == nil && ttlInt > 0 {
+			ttl = ttlInt
+		}
+	}
+	if ticketMaxTTL := int(getConfig().TicketMaxTTL); ttl > ticketMaxTTL {
+		ttl = ticketMaxTTL
+	}
+	return ttl
+}
+
+// 读取签名用的RSA私钥
+func loadOidcPrivateKey() error {
+	keyFile := "./oidc_private_key.pem"
+	if temp, ok := ConfigMap.Load("oidc_private_key_file"); ok && temp.(string) != "" {
+		keyFile = temp.(string)
+	}
+	key, err := loadRsaPrivateKey(keyFile)
+	if err != nil {
+		return err
+	}
+	kid := sha256.Sum256(key.PublicKey.N.Bytes())
+	oidcPrivateKey = key
+	oidcKeyId = hex.EncodeToString(kid[:8])
+	return nil
+}
+
+// 读取pem格式的RSA私钥, 文件不存在则生成一个新的写入文件
+func loadRsaPrivateKey(keyFile string) (*rsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		if err := ioutil.WriteFile(keyFile, b, 0600); err != nil {
+			return nil, err
+		}
+		loger.Println("rsa private key generated:", keyFile)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("private key pem decode error: " + keyFile)
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not rsa: " + keyFile)
+	}
+	return key, nil
+}
+
+func base64UrlEncode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// 生成RS256签名的jwt
+func SignJwt(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": oidcKeyId})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64UrlEncode(header) + "." + base64UrlEncode(payload)
+	hashed := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, oidcPrivateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64UrlEncode(signature), nil
+}
+
+// 用户信息映射成标准claims, scope决定输出哪些字段
+func getOidcClaims(ssoUserInfo SsoUserInfoStruct, scope string) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": ssoUserInfo.SsoDingdingUserId,
+	}
+	scopes := strings.Fields(scope)
+	for _, s := range scopes {
+		switch s {
+		case "profile":
+			claims["name"] = ssoUserInfo.SsoName
+			claims["nickname"] = ssoUserInfo.SsoDingdingNickName
+			claims["preferred_username"] = ssoUserInfo.SsoDingdingUserId
+			claims["picture"] = ssoUserInfo.SsoAvatar
+			claims["job_title"] = ssoUserInfo.SsoJobTitle
+			claims["contact_type"] = ssoUserInfo.SsoContactType
+			claims["union_id"] = ssoUserInfo.SsoDingdingUnionId
+			departments := []OidcDepartmentClaim{}
+			groups := []string{}
+			for _, dept := range ssoUserInfo.SsoUserDeptInfo {
+				departments = append(departments, OidcDepartmentClaim{Id: dept.SsoDeptId, Name: dept.SsoDeptName, IsOwner: dept.SsoIsDeptOwner == "1", Path: dept.SsoDeptPathNames})
+				groups = append(groups, dept.SsoDeptName)
+			}
+			claims["departments"] = departments
+			claims["groups"] = groups
+			if ssoUserInfo.SsoCompanyName != "" {
+				claims["company_name"] = ssoUserInfo.SsoCompanyName
+			}
+		case "phone":
+			claims["phone_number"] = ssoUserInfo.SsoMobile
+			claims["phone_number_verified"] = ssoUserInfo.SsoMobile != ""
+		case "email":
+			if ssoUserInfo.SsoEmail != "" {
+				claims["email"] = ssoUserInfo.SsoEmail
+				claims["email_verified"] = false
+			}
+		}
+	}
+	return claims
+}
+
+func oidcError(w http.ResponseWriter, status int, errCode, description string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	b, _ := json.Marshal(map[string]string{"error": errCode, "error_description": description})
+	w.Write(b)
+}
+
+func oidcJson(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		oidcError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b)
+}
+
+// 授权失败时跳转回业务方, 带上error参数
+func oidcRedirectError(w http.ResponseWriter, req *http.Request, redirectUri, state, errCode, description string) {
+	q := url.Values{}
+	q.Set("error", errCode)
+	q.Set("error_description", description)
+	if state != "" {
+		q.Set("state", state)
+	}
+	http.Redirect(w, req, appendQuery(redirectUri, q), http.StatusFound)
+}
+
+func appendQuery(rawUrl string, q url.Values) string {
+	if strings.Contains(rawUrl, "?") {
+		return rawUrl + "&" + q.Encode()
+	}
+	return rawUrl + "?" + q.Encode()
+}
+
+func oidcDiscoveryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		domain, _ := ConfigMap.Load("domain")
+		authorizeUrl, _ := ConfigMap.Load("oidc_authorize_url")
+		tokenUrl, _ := ConfigMap.Load("oidc_token_url")
+		userinfoUrl, _ := ConfigMap.Load("oidc_userinfo_url")
+		jwksUrl, _ := ConfigMap.Load("oidc_jwks_url")
+		oidcJson(w, map[string]interface{}{
+			"issuer":                                getOidcIssuer(),
+			"authorization_endpoint":                domain.(string) + authorizeUrl.(string),
+			"token_endpoint":                        domain.(string) + tokenUrl.(string),
+			"userinfo_endpoint":                     domain.(string) + userinfoUrl.(string),
+			"jwks_uri":                              domain.(string) + jwksUrl.(string),
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"scopes_supported":                      []string{"openid", "profile", "phone", "email"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+			"code_challenge_methods_supported":      []string{"plain", "S256"},
+			"claims_supported":                      []string{"sub", "name", "nickname", "preferred_username", "picture", "job_title", "contact_type", "union_id", "departments", "groups", "company_name", "phone_number", "email", "nonce", "auth_time"},
+		})
+	}
+}
+
+func oidcJwksHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		pub := oidcPrivateKey.PublicKey
+		oidcJson(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": oidcKeyId,
+				"n":   base64UrlEncode(pub.N.Bytes()),
+				"e":   base64UrlEncode(big.NewInt(int64(pub.E)).Bytes()),
+			}},
+		})
+	}
+}
+
+// 校验业务方参数, 生成ticket后直接跳转钉钉扫码页, 扫码回调复用scan_success_url
+func oidcAuthorizeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "POST":
+			if err := req.ParseForm(); err != nil {
+				oidcError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			clientId := req.Form.Get("client_id")
+			redirectUri := req.Form.Get("redirect_uri")
+			redirectUriSent := redirectUri != ""
+			client, ok := getOidcClient(clientId)
+			if !ok {
+				oidcError(w, http.StatusBadRequest, "unauthorized_client", "client_id not registered")
+				return
+			}
+			if redirectUri == "" && len(client.RedirectUris) == 1 {
+				redirectUri = client.RedirectUris[0]
+			}
+			redirectUriValid := false
+			for _, registered := range client.RedirectUris {
+				if registered == redirectUri {
+					redirectUriValid = true
+					break
+				}
+			}
+			if !redirectUriValid { // redirect_uri不对时不能跳转, 直接输出错误
+				oidcError(w, http.StatusBadRequest, "invalid_request", "redirect_uri not registered")
+				return
+			}
+
+			state := req.Form.Get("state")
+			if req.Form.Get("response_type") != "code" {
+				oidcRedirectError(w, req, redirectUri, state, "unsupported_response_type", "only code flow is supported")
+				return
+			}
+			scope := req.Form.Get("scope")
+			if !strings.Contains(" "+scope+" ", " openid ") {
+				oidcRedirectError(w, req, redirectUri, state, "invalid_scope", "scope must contain openid")
+				return
+			}
+			codeChallengeMethod := req.Form.Get("code_challenge_method")
+			codeChallenge := req.Form.Get("code_challenge")
+			if codeChallenge != "" && codeChallengeMethod == "" {
+				codeChallengeMethod = "plain"
+			}
+			if codeChallengeMethod != "" && codeChallengeMethod != "plain" && codeChallengeMethod != "S256" {
+				oidcRedirectError(w, req, redirectUri, state, "invalid_request", "code_challenge_method not supported")
+				return
+			}
+
+			userAgent := req.Header.Get("User-Agent")
+			userIp := GetIp(req)
+			if _, ok := MemForbiddenMap.Load(userIp); ok {
+				oidcRedirectError(w, req, redirectUri, state, "access_denied", "ip forbidden")
+				return
+			}
+
+			ticket := generateTicket(userAgent, userIp, getOidcTokenTTL())
+			MemOidcAuthMap.Store(ticket, OidcAuthRequestStruct{
+				ClientId:            clientId,
+				RedirectUri:         redirectUri,
+				RedirectUriSent:     redirectUriSent,
+				Scope:               scope,
+				State:               state,
+				Nonce:               req.Form.Get("nonce"),
+				CodeChallenge:       codeChallenge,
+				CodeChallengeMethod: codeChallengeMethod,
+				Expired:             time.Now().Unix() + 300,
+			})
+			http.Redirect(w, req, GetQrUrl(ticket, req.URL.Query().Get("provider")), http.StatusFound)
+			return
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+	}
+}
+
+// 扫码成功后由successReturn调用, 如果这个ticket是oidc发起的, 生成code跳回业务方, 返回true
+func oidcAuthorizeReturn(w http.ResponseWriter, ticket string) bool {
+	temp, ok := MemOidcAuthMap.Load(ticket)
+	if !ok {
+		return false
+	}
+	MemOidcAuthMap.Delete(ticket)
+	authRequest := temp.(OidcAuthRequestStruct)
+
+	now := time.Now().Unix()
+	code := GetRandomStr(64)
+	MemOidcCodeMap.Store(code, OidcCodeStruct{
+		Ticket:      ticket,
+		AuthRequest: authRequest,
+		AuthTime:    now,
+		Expired:     now + 60,
+	})
+
+	q := url.Values{}
+	q.Set("code", code)
+	if authRequest.State != "" {
+		q.Set("state", authRequest.State)
+	}
+	w.Header().Set("Location", appendQuery(authRequest.RedirectUri, q))
+	w.WriteHeader(http.StatusFound)
+	return true
+}
+
+// 业务方用code换id_token和access_token
+func oidcTokenHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		if err := req.ParseForm(); err != nil {
+			oidcError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		clientId, clientSecret, hasBasic := req.BasicAuth()
+		if !hasBasic {
+			clientId = req.PostForm.Get("client_id")
+			clientSecret = req.PostForm.Get("client_secret")
+		} else {
+			clientId, _ = url.QueryUnescape(clientId)
+			clientSecret, _ = url.QueryUnescape(clientSecret)
+		}
+		client, ok := getOidcClient(clientId)
+		if !ok || !client.VerifySecret(clientSecret) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oidc"`)
+			oidcError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+			return
+		}
+		if req.PostForm.Get("grant_type") != "authorization_code" {
+			oidcError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+			return
+		}
+
+		code := req.PostForm.Get("code")
+		temp, ok := MemOidcCodeMap.LoadAndDelete(code) // code只能用一次, 同一个code并发兑换只有一个能取到
+		if code == "" || !ok {
+			oidcError(w, http.StatusBadRequest, "invalid_grant", "code not found")
+			return
+		}
+		codeStruct := temp.(OidcCodeStruct)
+		now := time.Now().Unix()
+		if now >= codeStruct.Expired {
+			oidcError(w, http.StatusBadRequest, "invalid_grant", "code expired")
+			return
+		}
+		if codeStruct.AuthRequest.ClientId != clientId {
+			oidcError(w, http.StatusBadRequest, "invalid_grant", "code was issued to another client")
+			return
+		}
+		// authorize时省略了redirect_uri(只登记了一个)的, /token也可以省略, 带了就必须相同
+		if tokenRedirectUri := req.PostForm.Get("redirect_uri"); (codeStruct.AuthRequest.RedirectUriSent || tokenRedirectUri != "") && codeStruct.AuthRequest.RedirectUri != tokenRedirectUri {
+			oidcError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri mismatch")
+			return
+		}
+		if codeStruct.AuthRequest.CodeChallenge != "" {
+			verifier := req.PostForm.Get("code_verifier")
+			if codeStruct.AuthRequest.CodeChallengeMethod == "S256" {
+				sum := sha256.Sum256([]byte(verifier))
+				verifier = base64UrlEncode(sum[:])
+			}
+			if verifier == "" || subtle.ConstantTimeCompare([]byte(verifier), []byte(codeStruct.AuthRequest.CodeChallenge)) != 1 {
+				oidcError(w, http.StatusBadRequest, "invalid_grant", "code_verifier mismatch")
+				return
+			}
+		}
+
+		ssoUserInfo, expired, ok := loadSsoUserInfoByTicket(codeStruct.Ticket)
+		if !ok {
+			oidcError(w, http.StatusBadRequest, "invalid_grant", "login session expired")
+			return
+		}
+
+		claims := getOidcClaims(ssoUserInfo, codeStruct.AuthRequest.Scope)
+		claims["iss"] = getOidcIssuer()
+		claims["aud"] = clientId
+		claims["iat"] = now
+		claims["exp"] = expired
+		claims["auth_time"] = codeStruct.AuthTime
+		if codeStruct.AuthRequest.Nonce != "" {
+			claims["nonce"] = codeStruct.AuthRequest.Nonce
+		}
+		idToken, err := SignJwt(claims)
+		if err != nil {
+			oidcError(w, http.StatusInternalServerError, "server_error", err.Error())
+			loger.Println(err.Error())
+			return
+		}
+
+		accessToken := GetRandomStr(64)
+		MemOidcTokenMap.Store(accessToken, OidcTokenStruct{
+			Ticket:   codeStruct.Ticket,
+			ClientId: clientId,
+			Scope:    codeStruct.AuthRequest.Scope,
+			Expired:  expired,
+		})
+
+		loger.Println("Oidc token issued,", ssoUserInfo.SsoName, "client:", clientId)
+		oidcJson(w, map[string]interface{}{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+			"expires_in":   expired - now,
+			"id_token":     idToken,
+			"scope":        codeStruct.AuthRequest.Scope,
+		})
+	}
+}
+
+func oidcUserinfoHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "POST":
+			var accessToken string
+			if parts := strings.SplitN(strings.TrimSpace(req.Header.Get("Authorization")), " ", 2); len(parts) == 2 && strings.EqualFold(parts[0], "Bearer") { // 认证方式不区分大小写
+				accessToken = strings.TrimSpace(parts[1])
+			}
+			if accessToken == "" {
+				if err := req.ParseForm(); err == nil {
+					accessToken = req.PostForm.Get("access_token")
+				}
+			}
+			temp, ok := MemOidcTokenMap.Load(accessToken)
+			if accessToken == "" || !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				oidcError(w, http.StatusUnauthorized, "invalid_token", "access token not found")
+				return
+			}
+			token := temp.(OidcTokenStruct)
+			ssoUserInfo, _, ok := loadSsoUserInfoByTicket(token.Ticket)
+			if !ok || time.Now().Unix() >= token.Expired {
+				MemOidcTokenMap.Delete(accessToken)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				oidcError(w, http.StatusUnauthorized, "invalid_token", "access token expired")
+				return
+			}
+			oidcJson(w, getOidcClaims(ssoUserInfo, token.Scope))
+			return
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+	}
+}
+
+// 从内存取出扫码时保存的用户信息和过期时间
+func loadSsoUserInfoByTicket(ticket string) (SsoUserInfoStruct, int64, bool) {
+	var ssoUserInfo SsoUserInfoStruct
+	jsonByte, ok := MemMap.Load(ticket)
+	if !ok {
+		return ssoUserInfo, 0, false
+	}
+	expire, ok := MemMapTTL.Load(ticket)
+	if !ok || time.Now().Unix() >= expire.(int64) {
+		return ssoUserInfo, 0, false
+	}
+	if err := json.Unmarshal(jsonByte.([]byte), &ssoUserInfo); err != nil {
+		return ssoUserInfo, 0, false
+	}
+	return ssoUserInfo, expire.(int64), true
+}
+
+func clearExpiredOidc() {
+	if !loopSleep(time.Second * 5) {
+		return
+	}
+	defer loopDone()
+
+	now := time.Now().Unix()
+	MemOidcAuthMap.Range(func(key, value interface{}) bool {
+		if now >= value.(OidcAuthRequestStruct).Expired {
+			MemOidcAuthMap.Delete(key)
+		}
+		return true
+	})
+	MemOidcCodeMap.Range(func(key, value interface{}) bool {
+		if now >= value.(OidcCodeStruct).Expired {
+			MemOidcCodeMap.Delete(key)
+		}
+		return true
+	})
+	MemOidcTokenMap.Range(func(key, value interface{}) bool {
+		if now >= value.(OidcTokenStruct).Expired {
+			MemOidcTokenMap.Delete(key)
+		}
+		return true
+	})
+	go clearExpiredOidc()
+}
+
+// 注册oidc相关的地址, discovery地址跟随issuer的path
+func registerOidcHandlers() {
+	if err := loadOidcPrivateKey(); err != nil {
+		panic("oidc private key error: " + err.Error())
+	}
+
+	var authorizeUrl, tokenUrl, userinfoUrl, jwksUrl string
+	if temp, ok := ConfigMap.Load("oidc_authorize_url"); ok {
+		authorizeUrl = temp.(string)
+	}
+	if temp, ok := ConfigMap.Load("oidc_token_url"); ok {
+		tokenUrl = temp.(string)
+	}
+	if temp, ok := ConfigMap.Load("oidc_userinfo_url"); ok {
+		userinfoUrl = temp.(string)
+	}
+	if temp, ok := ConfigMap.Load("oidc_jwks_url"); ok {
+		jwksUrl = temp.(string)
+	}
+	if len(authorizeUrl) == 0 || len(tokenUrl) == 0 || len(userinfoUrl) == 0 || len(jwksUrl) == 0 {
+		panic("config oidc param not valid")
+	}
+
+	issuerUrl, err := url.Parse(getOidcIssuer())
+	if err != nil {
+		panic("config oidc_issuer not valid")
+	}
+
+	if !sessionStore.NativeExpiry() {
+		go clearExpiredOidc() // 定期清理过期的code和access_token
+	}
+
+	http.Handle(strings.TrimRight(issuerUrl.Path, "/")+"/.well-known/openid-configuration", oidcDiscoveryHandler())
+	http.Handle(authorizeUrl, oidcAuthorizeHandler())
+	http.Handle(tokenUrl, oidcTokenHandler())
+	http.Handle(userinfoUrl, oidcUserinfoHandler())
+	http.Handle(jwksUrl, oidcJwksHandler())
+}
@@ -0,0 +1,301 @@
+package main
+
+// 身份提供方
+// scanSuccessHandler只依赖IdentityProvider接口, 钉钉/企业微信/飞书各自实现, 输出同样的SsoUserInfoStruct
+// identity_providers 配置启用哪些, 第一个是默认的, 扫码地址带上 provider=wecom 参数可以选择其它的
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+type IdentityProvider interface {
+	Name() string
+	QrUrl(ticket, redirectUri string) string                                                // 扫码页地址
+	ExchangeCode(code string, raw *DingdingRawStruct) (ProviderIdentity, error)             // 扫码回调的code换扫码人身份
+	ResolveUser(identity ProviderIdentity, raw *DingdingRawStruct) (string, float64, error) // 扫码人在组织内的userId, 0 内部员工  1 外部联系人
+	GetUser(userId string, raw *DingdingRawStruct) (ProviderUser, error)                    // 内部员工信息
+	GetExternalContact(userId string, raw *DingdingRawStruct) (ProviderUser, error)         // 外部联系人信息
+	GetDepartment(deptId string, raw *DingdingRawStruct) (ProviderDept, error)              // 部门信息
+	GetDepartmentParentIds(deptId string) ([]string, error)                                 // 从自己到根部门的所有部门id
+	IsActive(userId string, contactType float64) (bool, error)                              // 是否还在组织内, 离职/删除返回false
+}
+
+type ProviderIdentity struct {
+	UnionId  string
+	OpenId   string
+	NickName string
+	UserId   string // 企业微信和飞书换code时就能拿到企业内的userId, 钉钉要再调getbyunionid
+}
+
+type ProviderUser struct {
+	UserId         string
+	Name           string
+	Mobile         string
+	Avatar         string
+	JobTitle       string
+	StateCode      string
+	Active         bool
+	DeptIds        []string
+	CompanyName    string // 下面几个外部联系人才有
+	Email          string
+	Address        string
+	Remark         string
+	FollowerUserId string
+}
+
+type ProviderDept struct {
+	Id             string
+	Name           string
+	ParentId       string
+	ManagerUserIds []string
+}
+
+type deptResult struct {
+	dept ProviderDept
+	raw  string
+	path []ProviderDept
+	err  error
+}
+
+// 所有部门同时查, 有缓存的直接用, 某个部门查不到只记日志跳过, 全部查不到才算登录失败
+// 部门路径查不到也不影响登录, 只是sso_dept_path_*为空
+func resolveUserDepartments(provider IdentityProvider, userId string, deptIds []string, raw *DingdingRawStruct) ([]SsoUserDeptStruct, error) {
+	results := make([]deptResult, len(deptIds))
+	var wg sync.WaitGroup
+	for i, deptId := range deptIds {
+		wg.Add(1)
+		go func(i int, deptId string) {
+			defer wg.Done()
+			result := &results[i]
+			if result.dept, result.raw, result.err = deptCache.Get(provider, deptId); result.err != nil {
+				return
+			}
+			path, err := deptCache.Path(provider, deptId)
+			if err != nil {
+				loger.Println("department path error:", provider.Name(), deptId, err.Error())
+				return
+			}
+			result.path = path
+		}(i, deptId)
+	}
+	wg.Wait()
+
+	var ssoUserDeptInfo []SsoUserDeptStruct
+	var firstErr error
+	for i, result := range results {
+		if result.raw != "" {
+			raw.Departments = append(raw.Departments, result.raw)
+		}
+		if result.err != nil {
+			loger.Println("department error:", provider.Name(), deptIds[i], result.err.Error())
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			continue
+		}
+		ssoIsDeptOwner := "0"
+		for _, managerUserId := range result.dept.ManagerUserIds {
+			if managerUserId == userId {
+				ssoIsDeptOwner = "1"
+				break
+			}
+		}
+		deptInfo := SsoUserDeptStruct{
+			SsoDeptId:      deptIds[i],
+			SsoDeptName:    result.dept.Name,
+			SsoIsDeptOwner: ssoIsDeptOwner,
+		}
+		for _, pathDept := range result.path {
+			deptInfo.SsoDeptPathIds = append(deptInfo.SsoDeptPathIds, pathDept.Id)
+			deptInfo.SsoDeptPathNames = append(deptInfo.SsoDeptPathNames, pathDept.Name)
+		}
+		ssoUserDeptInfo = append(ssoUserDeptInfo, deptInfo)
+	}
+	if len(ssoUserDeptInfo) == 0 {
+		return nil, firstErr
+	}
+	return ssoUserDeptInfo, nil
+}
+
+// 接口调用失败时带上返回给页面的错误编号, 对应config.ini中的err:xx
+type ProviderError struct {
+	ErrId    string
+	Status   int
+	RespBody []byte
+	Err      error
+}
+
+func (e *ProviderError) Error() string {
+	if e.Err != nil {
+		return e.ErrId + " " + e.Err.Error()
+	}
+	return e.ErrId
+}
+
+func newProviderError(errId string, status int, respBody []byte, err error) *ProviderError {
+	return &ProviderError{ErrId: errId, Status: status, RespBody: respBody, Err: err}
+}
+
+func echoProviderError(w http.ResponseWriter, err error) {
+	providerError, ok := err.(*ProviderError)
+	if !ok {
+		providerError = newProviderError("err:4", http.StatusInternalServerError, nil, err)
+	}
+	w.WriteHeader(providerError.Status)
+	EchoJs(w, providerError.ErrId, providerError.RespBody)
+	if providerError.Err != nil {
+		loger.Println(providerError.Err.Error())
+	}
+}
+
+var identityProviders = map[string]func() IdentityProvider{
+	"dingtalk": func() IdentityProvider { return &DingtalkProvider{} },
+	"wecom":    func() IdentityProvider { return &WecomProvider{} },
+	"feishu":   func() IdentityProvider { return &FeishuProvider{} },
+}
+
+func getEnabledProviders() []string {
+	var names []string
+	if temp, ok := ConfigMap.Load("identity_providers"); ok {
+		for _, name := range strings.Split(temp.(string), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		names = []string{"dingtalk"}
+	}
+	return names
+}
+
+// name为空返回默认的身份提供方, 没有启用的返回false
+func getIdentityProvider(name string) (IdentityProvider, bool) {
+	enabled := getEnabledProviders()
+	if name == "" {
+		name = enabled[0]
+	}
+	for _, enabledName := range enabled {
+		if enabledName == name {
+			if newProvider, ok := identityProviders[name]; ok {
+				return newProvider(), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// 扫码页地址, state带上ticket, 扫码后跳转回scan_success_url, 非默认的身份提供方在回调地址上带provider参数
+func GetQrUrl(ticket, providerName string) string {
+	provider, ok := getIdentityProvider(providerName)
+	if !ok {
+		provider, _ = getIdentityProvider("")
+	}
+	domain, _ := ConfigMap.Load("domain")
+	scanSuccessUrl, _ := ConfigMap.Load("scan_success_url")
+	redirectUri := domain.(string) + scanSuccessUrl.(string)
+	if provider.Name() != getEnabledProviders()[0] {
+		redirectUri += "?provider=" + url.QueryEscape(provider.Name())
+	}
+	return provider.QrUrl(ticket, redirectUri)
+}
+
+// 员工信息和部门信息组装成SsoUserInfoStruct, 外部联系人的负责人也走这里
+func buildInternalSsoUser(provider IdentityProvider, userId string, identity ProviderIdentity, raw *DingdingRawStruct) (SsoUserInfoStruct, error) {
+	user, err := provider.GetUser(userId, raw)
+	if err != nil {
+		return SsoUserInfoStruct{}, err
+	}
+	if !user.Active {
+		return SsoUserInfoStruct{}, newProviderError("err:12", http.StatusForbidden, nil, nil)
+	}
+	if len(user.DeptIds) == 0 {
+		return SsoUserInfoStruct{}, newProviderError("err:14", http.StatusInternalServerError, []byte(raw.User), nil)
+	}
+
+	ssoUserDeptInfo, err := resolveUserDepartments(provider, userId, user.DeptIds, raw)
+	if err != nil {
+		return SsoUserInfoStruct{}, err
+	}
+
+	return SsoUserInfoStruct{
+		SsoProvider:         provider.Name(),
+		SsoName:             user.Name,
+		SsoContactType:      0,
+		SsoMobile:           user.Mobile,
+		SsoUserDeptInfo:     ssoUserDeptInfo,
+		SsoAvatar:           user.Avatar,
+		SsoJobTitle:         user.JobTitle,
+		SsoStateCode:        user.StateCode,
+		SsoEmail:            user.Email,
+		SsoDingdingUnionId:  identity.UnionId,
+		SsoDingdingUserId:   userId,
+		SsoDingdingOpenId:   identity.OpenId,
+		SsoDingdingNickName: identity.NickName,
+		DingdingRaw:         *raw,
+	}, nil
+}
+
+// 通用的json接口调用, 企业微信和飞书用, 返回原始内容和解析后的map
+func FetchJsonApi(method, postUrl string, body interface{}, headers map[string]string) ([]byte, map[string]interface{}, error) {
+	var postBody string
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		postBody = string(b)
+	}
+	loger.Println("New Request,", method, redactUrl(postUrl)) // 请求内容里有app_secret, 不记日志
+	request, err := http.NewRequest(method, postUrl, strings.NewReader(postBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	respBody, _ := ioutil.ReadAll(response.Body)
+	respMap := make(map[string]interface{})
+	if err := json.Unmarshal(respBody, &respMap); err != nil {
+		return respBody, nil, errors.New(string(respBody))
+	}
+	return respBody, respMap, nil
+}
+
+// 下面几个从map里取值, 类型不对返回零值, 不会panic
+func mapString(m map[string]interface{}, key string) string {
+	value, _ := m[key].(string)
+	return value
+}
+
+func mapFloat(m map[string]interface{}, key string) float64 {
+	value, _ := m[key].(float64)
+	return value
+}
+
+func mapBool(m map[string]interface{}, key string) bool {
+	value, _ := m[key].(bool)
+	return value
+}
+
+func mapMap(m map[string]interface{}, key string) map[string]interface{} {
+	value, _ := m[key].(map[string]interface{})
+	return value
+}
+
+func mapSlice(m map[string]interface{}, key string) []interface{} {
+	value, _ := m[key].([]interface{})
+	return value
+}
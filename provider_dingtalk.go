@@ -0,0 +1,242 @@
+package main
+
+// 钉钉扫码登录
+// 钉钉文档 https://developers.dingtalk.com/document/app/scan-qr-code-to-login-3rdapp
+// dingding_login_mode = oauth2 时使用新版登录 https://open.dingtalk.com/document/orgapp/tutorial-obtaining-user-personal-information
+// 新版扫码后回调带的是authCode, 换到的unionid之后的流程和旧版一样
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type DingtalkProvider struct {
+}
+
+func (p *DingtalkProvider) Name() string {
+	return "dingtalk"
+}
+
+// 旧版 /connect/qrconnect + /sns/getuserinfo_bycode 钉钉已经不推荐使用, 配置成oauth2切换到新版
+func (p *DingtalkProvider) isOauth2() bool {
+	loginMode, ok := ConfigMap.Load("dingding_login_mode")
+	return ok && loginMode.(string) == "oauth2"
+}
+
+func (p *DingtalkProvider) QrUrl(ticket, redirectUri string) string {
+	dingdingAppKey, _ := ConfigMap.Load("dingding_app_key")
+	if p.isOauth2() {
+		return GetDingdingApiBase("login") + `/oauth2/auth?client_id=` + dingdingAppKey.(string) + `&response_type=code&scope=openid&prompt=consent&state=` + ticket + `&redirect_uri=` + url.QueryEscape(redirectUri)
+	}
+	return GetDingdingApiBase("oapi") + `/connect/qrconnect?appid=` + dingdingAppKey.(string) + `&response_type=code&scope=snsapi_login&state=` + ticket + `&redirect_uri=` + url.QueryEscape(redirectUri)
+}
+
+func (p *DingtalkProvider) ExchangeCode(code string, raw *DingdingRawStruct) (ProviderIdentity, error) {
+	if p.isOauth2() {
+		return p.exchangeCodeOauth2(code, raw)
+	}
+	dingdingAppKey, _ := ConfigMap.Load("dingding_app_key")
+	dingdingAppSecret, _ := ConfigMap.Load("dingding_app_secret")
+	resp, respBody, err := dingdingClient.GetUserInfoByCode(dingdingAppKey.(string), dingdingAppSecret.(string), code)
+	loger.Println(string(respBody))
+	raw.UserInfo = string(respBody)
+	if err != nil {
+		return ProviderIdentity{}, newProviderError("err:1", http.StatusForbidden, respBody, err)
+	}
+	if resp.UserInfo == nil {
+		return ProviderIdentity{}, newProviderError("err:2", http.StatusInternalServerError, respBody, nil)
+	}
+	if resp.UserInfo.UnionId == "" {
+		return ProviderIdentity{}, newProviderError("err:3", http.StatusInternalServerError, respBody, nil)
+	}
+	return ProviderIdentity{
+		UnionId:  resp.UserInfo.UnionId,
+		OpenId:   resp.UserInfo.OpenId,
+		NickName: resp.UserInfo.Nick,
+	}, nil
+}
+
+func (p *DingtalkProvider) exchangeCodeOauth2(code string, raw *DingdingRawStruct) (ProviderIdentity, error) {
+	dingdingAppKey, _ := ConfigMap.Load("dingding_app_key")
+	dingdingAppSecret, _ := ConfigMap.Load("dingding_app_secret")
+	userAccessToken, respBody, err := dingdingClient.GetUserAccessToken(dingdingAppKey.(string), dingdingAppSecret.(string), code) // 返回内容是用户的accessToken, 不记日志
+	if err != nil {
+		return ProviderIdentity{}, newProviderError("err:1", http.StatusForbidden, respBody, err)
+	}
+	if userAccessToken.AccessToken == "" {
+		return ProviderIdentity{}, newProviderError("err:1", http.StatusForbidden, respBody, nil)
+	}
+
+	me, respBody, err := dingdingClient.GetContactUserMe(userAccessToken.AccessToken)
+	loger.Println(string(respBody))
+	raw.UserInfo = string(respBody)
+	if err != nil {
+		return ProviderIdentity{}, newProviderError("err:2", http.StatusInternalServerError, respBody, err)
+	}
+	if me.UnionId == "" {
+		return ProviderIdentity{}, newProviderError("err:3", http.StatusInternalServerError, respBody, nil)
+	}
+	return ProviderIdentity{
+		UnionId:  me.UnionId,
+		OpenId:   me.OpenId,
+		NickName: me.Nick,
+	}, nil
+}
+
+func (p *DingtalkProvider) ResolveUser(identity ProviderIdentity, raw *DingdingRawStruct) (string, float64, error) {
+	resp, respBody, err := dingdingClient.GetUserIdByUnionId(identity.UnionId)
+	loger.Println(string(respBody))
+	raw.UserUnion = string(respBody)
+	if _, ok := err.(*ProviderError); ok { // accessToken获取失败
+		return "", 0, err
+	}
+	if IsDingdingUserNotFound(err) { // 陌生人
+		return "", 0, newProviderError("err:3:1", http.StatusInternalServerError, respBody, err)
+	}
+	if err != nil {
+		return "", 0, newProviderError("err:4", http.StatusInternalServerError, respBody, err)
+	}
+	if resp.Result == nil {
+		return "", 0, newProviderError("err:5", http.StatusInternalServerError, respBody, nil)
+	}
+	if resp.Result.ContactType == nil {
+		return "", 0, newProviderError("err:6", http.StatusInternalServerError, respBody, nil)
+	}
+	if resp.Result.UserId == "" {
+		return "", 0, newProviderError("err:7", http.StatusInternalServerError, respBody, nil)
+	}
+	return resp.Result.UserId, float64(*resp.Result.ContactType), nil
+}
+
+func (p *DingtalkProvider) GetUser(userId string, raw *DingdingRawStruct) (ProviderUser, error) {
+	resp, respBody, err := dingdingClient.GetUser(userId)
+	loger.Println(string(respBody))
+	raw.User = string(respBody)
+	if _, ok := err.(*ProviderError); ok { // accessToken获取失败
+		return ProviderUser{}, err
+	}
+	if IsDingdingUserNotFound(err) { // 外部联系人调这个接口返回找不到该用户
+		return ProviderUser{}, newProviderError("err:9:1", http.StatusInternalServerError, respBody, err)
+	}
+	if err != nil {
+		return ProviderUser{}, newProviderError("err:9", http.StatusInternalServerError, respBody, err)
+	}
+	user := resp.Result
+	if user == nil {
+		return ProviderUser{}, newProviderError("err:10", http.StatusInternalServerError, respBody, nil)
+	}
+	if user.Active == nil {
+		return ProviderUser{}, newProviderError("err:11", http.StatusInternalServerError, respBody, nil)
+	}
+	if user.DeptIdList == nil && *user.Active {
+		return ProviderUser{}, newProviderError("err:13", http.StatusInternalServerError, respBody, nil)
+	}
+	// [427922115,447795618,487643026,427876169,427831197]
+	var deptIds []string
+	for _, deptId := range user.DeptIdList {
+		deptIds = append(deptIds, strconv.FormatInt(deptId, 10))
+	}
+	return ProviderUser{
+		UserId:    userId,
+		Name:      user.Name,
+		Mobile:    user.Mobile,
+		Avatar:    user.Avatar,
+		JobTitle:  user.Title,
+		StateCode: user.StateCode,
+		Active:    *user.Active,
+		DeptIds:   deptIds,
+	}, nil
+}
+
+func (p *DingtalkProvider) GetExternalContact(userId string, raw *DingdingRawStruct) (ProviderUser, error) {
+	resp, respBody, err := dingdingClient.GetExternalContact(userId)
+	loger.Println(string(respBody))
+	raw.ExternalContactInfo = string(respBody)
+	if _, ok := err.(*ProviderError); ok { // accessToken获取失败
+		return ProviderUser{}, err
+	}
+	if err != nil {
+		return ProviderUser{}, newProviderError("err:26", http.StatusInternalServerError, respBody, err)
+	}
+	contact := resp.Result
+	if contact == nil {
+		return ProviderUser{}, newProviderError("err:27", http.StatusInternalServerError, respBody, nil)
+	}
+	return ProviderUser{
+		UserId:         userId,
+		Name:           contact.Name,
+		Mobile:         contact.Mobile,
+		JobTitle:       contact.Title,
+		StateCode:      contact.StateCode,
+		Active:         true,
+		CompanyName:    contact.CompanyName,
+		Email:          contact.Email,
+		Address:        contact.Address,
+		Remark:         contact.Remark,
+		FollowerUserId: contact.FollowerUserId,
+	}, nil
+}
+
+func (p *DingtalkProvider) GetDepartment(deptId string, raw *DingdingRawStruct) (ProviderDept, error) {
+	resp, respBody, err := dingdingClient.GetDepartment(deptId)
+	loger.Println(string(respBody))
+	raw.Departments = append(raw.Departments, string(respBody))
+	if _, ok := err.(*ProviderError); ok { // accessToken获取失败
+		return ProviderDept{}, err
+	}
+	if err != nil {
+		return ProviderDept{}, newProviderError("err:15", http.StatusInternalServerError, respBody, err)
+	}
+	department := resp.Result
+	if department == nil {
+		return ProviderDept{}, newProviderError("err:16", http.StatusInternalServerError, respBody, nil)
+	}
+	if department.Name == nil {
+		return ProviderDept{}, newProviderError("err:17", http.StatusInternalServerError, respBody, nil)
+	}
+	// fix 判断是否是部门管理员不用org_dept_owner字段, 注意org_dept_owner仅仅是群主userId, 不是部门管理员id 2021-12-07
+	return ProviderDept{Id: deptId, Name: *department.Name, ParentId: strconv.FormatInt(department.ParentId, 10), ManagerUserIds: department.DeptManagerUseridList}, nil
+}
+
+func (p *DingtalkProvider) GetDepartmentParentIds(deptId string) ([]string, error) {
+	resp, respBody, err := dingdingClient.ListParentByDept(deptId)
+	loger.Println(string(respBody))
+	if _, ok := err.(*ProviderError); ok {
+		return nil, err
+	}
+	if err != nil {
+		return nil, newProviderError("err:15", http.StatusInternalServerError, respBody, err)
+	}
+	if resp.Result == nil {
+		return nil, newProviderError("err:16", http.StatusInternalServerError, respBody, nil)
+	}
+	var parentIds []string
+	for _, parentId := range resp.Result.ParentIdList {
+		parentIds = append(parentIds, strconv.FormatInt(parentId, 10))
+	}
+	return parentIds, nil
+}
+
+// 离职或者从通讯录删除后接口返回60121找不到该用户, 只有找不到和active:false当成离职
+func (p *DingtalkProvider) IsActive(userId string, contactType float64) (bool, error) {
+	if contactType == 1 {
+		_, _, err := dingdingClient.GetExternalContact(userId)
+		if IsDingdingUserNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	resp, _, err := dingdingClient.GetUser(userId)
+	if IsDingdingUserNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if resp.Result == nil || resp.Result.Active == nil { // 返回的格式不对不能当成离职, 否则会把所有人踢下线
+		return false, errors.New("dingtalk user/get response has no result.active")
+	}
+	return *resp.Result.Active, nil
+}
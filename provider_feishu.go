@@ -0,0 +1,215 @@
+package main
+
+// 飞书扫码登录
+// 飞书文档 https://open.feishu.cn/document/common-capabilities/sso/web-application-sso/web-app-overview
+// 飞书接口返回的是 code/msg/data, 不是钉钉的 errcode/errmsg, 用FetchJsonApi调用
+// 飞书没有钉钉那种管理员在通讯录里添加的外部联系人, contactType固定是0
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type FeishuProvider struct {
+}
+
+func (p *FeishuProvider) Name() string {
+	return "feishu"
+}
+
+func (p *FeishuProvider) QrUrl(ticket, redirectUri string) string {
+	appId, _ := ConfigMap.Load("feishu_app_id")
+	return `https://open.feishu.cn/open-apis/authen/v1/index?app_id=` + appId.(string) + `&state=` + ticket + `&redirect_uri=` + url.QueryEscape(redirectUri)
+}
+
+// 换code用app_access_token, 通讯录接口用tenant_access_token
+var feishuAccessTokens = map[string]*AccessTokenManager{
+	"app":    NewAccessTokenManager("feishu_app", func() (string, int64, error) { return fetchFeishuAccessToken("app") }),
+	"tenant": NewAccessTokenManager("feishu_tenant", func() (string, int64, error) { return fetchFeishuAccessToken("tenant") }),
+}
+
+func fetchFeishuAccessToken(kind string) (string, int64, error) {
+	appId, _ := ConfigMap.Load("feishu_app_id")
+	appSecret, _ := ConfigMap.Load("feishu_app_secret")
+	respBody, respMap, err := (&FeishuProvider{}).fetchJson("POST", "/auth/v3/"+kind+"_access_token/internal", map[string]string{
+		"app_id":     appId.(string),
+		"app_secret": appSecret.(string),
+	}, "")
+	// {"code":0,"msg":"ok","tenant_access_token":"t-caecc734c2e3328a62489fe0648c4b98779515d3","expire":7200}
+	if err != nil {
+		return "", 0, newProviderError("err:24", http.StatusInternalServerError, respBody, err)
+	}
+	if mapString(respMap, kind+"_access_token") == "" {
+		return "", 0, newProviderError("err:25", http.StatusInternalServerError, respBody, nil)
+	}
+	return mapString(respMap, kind+"_access_token"), int64(mapFloat(respMap, "expire")), nil
+}
+
+// code不是0的当成错误返回, 和FetchDingApi一样
+func (p *FeishuProvider) fetchJson(method, path string, body interface{}, accessToken string) (respBody []byte, respMap map[string]interface{}, err error) {
+	headers := map[string]string{}
+	if accessToken != "" {
+		headers["Authorization"] = "Bearer " + accessToken
+	}
+	rawUrl := "https://open.feishu.cn/open-apis" + path
+	defer func(start time.Time) { observeApiRequest(rawUrl, start, err) }(time.Now())
+	respBody, respMap, err = FetchJsonApi(method, rawUrl, body, headers)
+	if err != nil {
+		return respBody, respMap, err
+	}
+	if _, isset := respMap["code"]; !isset {
+		return respBody, respMap, errors.New("no code in response")
+	}
+	if mapFloat(respMap, "code") != 0 {
+		return respBody, respMap, errors.New("code not zero " + strconv.FormatInt(int64(mapFloat(respMap, "code")), 10))
+	}
+	return respBody, respMap, nil
+}
+
+// accessToken过期或者不合法(99991661 99991663 99991668)时刷新一次再调
+func (p *FeishuProvider) fetch(kind, method, path string, body interface{}) ([]byte, map[string]interface{}, error) {
+	accessToken, err := feishuAccessTokens[kind].Get()
+	if err != nil {
+		return nil, nil, err
+	}
+	for errCount := 1; ; errCount++ {
+		respBody, respMap, err := p.fetchJson(method, path, body, accessToken)
+		code := mapFloat(respMap, "code")
+		if err != nil && (code == 99991661 || code == 99991663 || code == 99991668) && errCount < 2 {
+			if accessToken, err = feishuAccessTokens[kind].Refresh(accessToken); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		return respBody, respMap, err
+	}
+}
+
+func (p *FeishuProvider) ExchangeCode(code string, raw *DingdingRawStruct) (ProviderIdentity, error) {
+	respBody, respMap, err := p.fetch("app", "POST", "/authen/v1/access_token", map[string]string{
+		"grant_type": "authorization_code",
+		"code":       code,
+	})
+	raw.UserInfo = string(respBody)
+	// {"code":0,"msg":"success","data":{"access_token":"u-5Dak9ZAxJ9tFUn8MaTD_BFM51FNdg5xzO0y010000HWb","token_type":"Bearer","expires_in":7140,"name":"zhangsan","en_name":"Three Zhang","avatar_url":"www.feishu.cn/avatar/icon","open_id":"ou-caecc734c2e3328a62489fe0648c4b98779515d3","union_id":"on-d89jhsdhjsajkda7828enjdj328ydhhw3u43yjhdj","tenant_key":"736588c92lxf175d","user_id":"5d9bdxxx"}}
+	if err != nil {
+		if _, ok := err.(*ProviderError); ok {
+			return ProviderIdentity{}, err
+		}
+		return ProviderIdentity{}, newProviderError("err:1", http.StatusForbidden, respBody, err)
+	}
+	data := mapMap(respMap, "data")
+	if data == nil {
+		return ProviderIdentity{}, newProviderError("err:2", http.StatusInternalServerError, respBody, nil)
+	}
+	if mapString(data, "union_id") == "" {
+		return ProviderIdentity{}, newProviderError("err:3", http.StatusInternalServerError, respBody, nil)
+	}
+	return ProviderIdentity{
+		UnionId:  mapString(data, "union_id"),
+		OpenId:   mapString(data, "open_id"),
+		NickName: mapString(data, "name"),
+		UserId:   mapString(data, "user_id"), // 只有本企业的成员才有
+	}, nil
+}
+
+func (p *FeishuProvider) ResolveUser(identity ProviderIdentity, raw *DingdingRawStruct) (string, float64, error) {
+	if identity.UserId == "" { // 其它企业的飞书用户扫码
+		return "", 0, newProviderError("err:3:1", http.StatusInternalServerError, []byte(raw.UserInfo), nil)
+	}
+	return identity.UserId, 0, nil
+}
+
+func (p *FeishuProvider) GetUser(userId string, raw *DingdingRawStruct) (ProviderUser, error) {
+	respBody, respMap, err := p.fetch("tenant", "GET", "/contact/v3/users/"+url.PathEscape(userId)+"?user_id_type=user_id&department_id_type=open_department_id", nil)
+	// {"code":0,"msg":"success","data":{"user":{"user_id":"5d9bdxxx","name":"张三","mobile":"+8613011111111","email":"zhangsan@gmail.com","job_title":"xxxxx","avatar":{"avatar_240":"https://foo.icon.com/xxxx"},"department_ids":["od-4e6ac4d14bcd5071a37a39de902c7141"],"status":{"is_frozen":false,"is_resigned":false,"is_activated":true,"is_exited":false,"is_unjoin":false}}}}
+	// 不在通讯录 {"code":41012,"msg":"user id invalid"}  不在应用的通讯录权限范围 {"code":41050,"msg":"no user authority error"}
+	raw.User = string(respBody)
+	if err != nil {
+		if _, ok := err.(*ProviderError); ok {
+			return ProviderUser{}, err
+		}
+		if code := mapFloat(respMap, "code"); code == 41012 || code == 41050 {
+			return ProviderUser{}, newProviderError("err:9:1", http.StatusInternalServerError, respBody, err)
+		}
+		return ProviderUser{}, newProviderError("err:9", http.StatusInternalServerError, respBody, err)
+	}
+	user := mapMap(mapMap(respMap, "data"), "user")
+	if user == nil {
+		return ProviderUser{}, newProviderError("err:10", http.StatusInternalServerError, respBody, nil)
+	}
+	status := mapMap(user, "status")
+	if status == nil {
+		return ProviderUser{}, newProviderError("err:11", http.StatusInternalServerError, respBody, nil)
+	}
+	var deptIds []string
+	for _, temp := range mapSlice(user, "department_ids") {
+		if deptId, ok := temp.(string); ok {
+			deptIds = append(deptIds, deptId)
+		}
+	}
+	return ProviderUser{
+		UserId:   userId,
+		Name:     mapString(user, "name"),
+		Mobile:   mapString(user, "mobile"),
+		Avatar:   mapString(mapMap(user, "avatar"), "avatar_240"),
+		JobTitle: mapString(user, "job_title"),
+		Email:    mapString(user, "email"),
+		Active:   mapBool(status, "is_activated") && !mapBool(status, "is_resigned") && !mapBool(status, "is_frozen"),
+		DeptIds:  deptIds,
+	}, nil
+}
+
+func (p *FeishuProvider) GetExternalContact(userId string, raw *DingdingRawStruct) (ProviderUser, error) {
+	return ProviderUser{}, newProviderError("err:26", http.StatusInternalServerError, nil, nil)
+}
+
+func (p *FeishuProvider) GetDepartment(deptId string, raw *DingdingRawStruct) (ProviderDept, error) {
+	respBody, respMap, err := p.fetch("tenant", "GET", "/contact/v3/departments/"+url.PathEscape(deptId)+"?user_id_type=user_id&department_id_type=open_department_id", nil)
+	// {"code":0,"msg":"success","data":{"department":{"name":"DemoName","open_department_id":"od-4e6ac4d14bcd5071a37a39de902c7141","parent_department_id":"od-8756ac4d14bcd5071a37a39de902c7141","leader_user_id":"ou_7dab8a3d3cdcc9da365777c7ad535d62","leaders":[{"leaderType":1,"leaderID":"ou_7dab8a3d3cdcc9da365777c7ad535d62"}]}}}
+	raw.Departments = append(raw.Departments, string(respBody))
+	if err != nil {
+		if _, ok := err.(*ProviderError); ok {
+			return ProviderDept{}, err
+		}
+		return ProviderDept{}, newProviderError("err:15", http.StatusInternalServerError, respBody, err)
+	}
+	department := mapMap(mapMap(respMap, "data"), "department")
+	if department == nil {
+		return ProviderDept{}, newProviderError("err:16", http.StatusInternalServerError, respBody, nil)
+	}
+	if _, isset := department["name"]; !isset {
+		return ProviderDept{}, newProviderError("err:17", http.StatusInternalServerError, respBody, nil)
+	}
+	var managerUserIds []string
+	if leaderUserId := mapString(department, "leader_user_id"); leaderUserId != "" {
+		managerUserIds = append(managerUserIds, leaderUserId)
+	}
+	for _, temp := range mapSlice(department, "leaders") {
+		if leader, ok := temp.(map[string]interface{}); ok && mapString(leader, "leaderID") != "" {
+			managerUserIds = append(managerUserIds, mapString(leader, "leaderID"))
+		}
+	}
+	return ProviderDept{Id: deptId, Name: mapString(department, "name"), ParentId: mapString(department, "parent_department_id"), ManagerUserIds: managerUserIds}, nil
+}
+
+// 一级部门的parent_department_id是"0"
+func (p *FeishuProvider) GetDepartmentParentIds(deptId string) ([]string, error) {
+	return walkDepartmentParents(p, deptId, "0")
+}
+
+// 离职后通讯录接口还能查到, 看status里的is_resigned, 已经从通讯录删除的查不到, 也当成离职
+func (p *FeishuProvider) IsActive(userId string, contactType float64) (bool, error) {
+	var raw DingdingRawStruct
+	user, err := p.GetUser(userId, &raw)
+	if err != nil {
+		if providerError, ok := err.(*ProviderError); ok && providerError.ErrId == "err:9:1" {
+			return false, nil
+		}
+		return false, err
+	}
+	return user.Active, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+// 企业微信扫码登录
+// 企业微信文档 https://developer.work.weixin.qq.com/document/path/98152
+// 企业微信的扫码登录只允许企业成员, 没有钉钉那种管理员在通讯录里添加的外部联系人, contactType固定是0
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type WecomProvider struct {
+}
+
+func (p *WecomProvider) Name() string {
+	return "wecom"
+}
+
+func (p *WecomProvider) QrUrl(ticket, redirectUri string) string {
+	corpId, _ := ConfigMap.Load("wecom_corp_id")
+	agentId, _ := ConfigMap.Load("wecom_agent_id")
+	return `https://login.work.weixin.qq.com/wwlogin/sso/login?login_type=CorpApp&appid=` + corpId.(string) + `&agentid=` + agentId.(string) + `&state=` + ticket + `&redirect_uri=` + url.QueryEscape(redirectUri)
+}
+
+var wecomAccessToken = NewAccessTokenManager("wecom", func() (string, int64, error) {
+	corpId, _ := ConfigMap.Load("wecom_corp_id")
+	secret, _ := ConfigMap.Load("wecom_secret")
+	postUrl := fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/gettoken?corpid=%s&corpsecret=%s", url.QueryEscape(corpId.(string)), url.QueryEscape(secret.(string)))
+	respBody, respMap, err := FetchDingApi(postUrl, "", "GET")
+	// {"errcode":0,"errmsg":"ok","access_token":"accesstoken000001","expires_in":7200}
+	if err != nil {
+		return "", 0, newProviderError("err:24", http.StatusInternalServerError, respBody, err)
+	}
+	if mapString(respMap, "access_token") == "" {
+		return "", 0, newProviderError("err:25", http.StatusInternalServerError, respBody, nil)
+	}
+	return mapString(respMap, "access_token"), int64(mapFloat(respMap, "expires_in")), nil
+})
+
+// accessToken过期(42001)或者不合法(40014)时刷新一次再调
+func (p *WecomProvider) fetch(path string, query url.Values) ([]byte, map[string]interface{}, error) {
+	accessToken, err := wecomAccessToken.Get()
+	if err != nil {
+		return nil, nil, err
+	}
+	for errCount := 1; ; errCount++ {
+		query.Set("access_token", accessToken)
+		respBody, respMap, err := FetchDingApi("https://qyapi.weixin.qq.com"+path+"?"+query.Encode(), "", "GET")
+		errcode := mapFloat(respMap, "errcode")
+		if err != nil && (errcode == 42001 || errcode == 40014) && errCount < 2 {
+			if accessToken, err = wecomAccessToken.Refresh(accessToken); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		return respBody, respMap, err
+	}
+}
+
+func (p *WecomProvider) ExchangeCode(code string, raw *DingdingRawStruct) (ProviderIdentity, error) {
+	respBody, respMap, err := p.fetch("/cgi-bin/auth/getuserinfo", url.Values{"code": {code}})
+	raw.UserInfo = string(respBody)
+	// 企业成员 {"errcode":0,"errmsg":"ok","userid":"USERID","user_ticket":"USER_TICKET"}
+	// 非企业成员 {"errcode":0,"errmsg":"ok","openid":"OPENID","external_userid":"EXTERNAL_USERID"}
+	if err != nil {
+		if _, ok := err.(*ProviderError); ok {
+			return ProviderIdentity{}, err
+		}
+		return ProviderIdentity{}, newProviderError("err:1", http.StatusForbidden, respBody, err)
+	}
+	if mapString(respMap, "userid") == "" {
+		return ProviderIdentity{}, newProviderError("err:3", http.StatusInternalServerError, respBody, nil)
+	}
+	return ProviderIdentity{
+		OpenId: mapString(respMap, "openid"),
+		UserId: mapString(respMap, "userid"),
+	}, nil
+}
+
+func (p *WecomProvider) ResolveUser(identity ProviderIdentity, raw *DingdingRawStruct) (string, float64, error) {
+	return identity.UserId, 0, nil
+}
+
+func (p *WecomProvider) GetUser(userId string, raw *DingdingRawStruct) (ProviderUser, error) {
+	respBody, respMap, err := p.fetch("/cgi-bin/user/get", url.Values{"userid": {userId}})
+	// {"errcode":0,"errmsg":"ok","userid":"zhangsan","name":"张三","department":[1,2],"position":"后台工程师","mobile":"13800000000","email":"zhangsan@gzdev.com","avatar":"http://wx.qlogo.cn/mmopen/ajNVdqHZLLA3WJ6DSZUfiakYe37PKnQhBIeOQBO4czqrnZDS79FH5Wm5m4X69TBicnHFlhiafvDwklOpZeXYQQ2icg/0","status":1}
+	// 不在通讯录 {"errcode":60111,"errmsg":"userid not found"}
+	raw.User = string(respBody)
+	if err != nil {
+		if _, ok := err.(*ProviderError); ok {
+			return ProviderUser{}, err
+		}
+		if mapFloat(respMap, "errcode") == 60111 {
+			return ProviderUser{}, newProviderError("err:9:1", http.StatusInternalServerError, respBody, err)
+		}
+		return ProviderUser{}, newProviderError("err:9", http.StatusInternalServerError, respBody, err)
+	}
+	if _, isset := respMap["status"]; !isset {
+		return ProviderUser{}, newProviderError("err:11", http.StatusInternalServerError, respBody, nil)
+	}
+	var deptIds []string
+	for _, temp := range mapSlice(respMap, "department") {
+		if deptId, ok := temp.(float64); ok {
+			deptIds = append(deptIds, strconv.FormatInt(int64(deptId), 10))
+		}
+	}
+	return ProviderUser{
+		UserId:   userId,
+		Name:     mapString(respMap, "name"),
+		Mobile:   mapString(respMap, "mobile"),
+		Avatar:   mapString(respMap, "avatar"),
+		JobTitle: mapString(respMap, "position"),
+		Email:    mapString(respMap, "email"),
+		Active:   mapFloat(respMap, "status") == 1, // 1 已激活  2 已禁用  4 未激活  5 退出企业
+		DeptIds:  deptIds,
+	}, nil
+}
+
+func (p *WecomProvider) GetExternalContact(userId string, raw *DingdingRawStruct) (ProviderUser, error) {
+	return ProviderUser{}, newProviderError("err:26", http.StatusInternalServerError, nil, nil)
+}
+
+func (p *WecomProvider) GetDepartment(deptId string, raw *DingdingRawStruct) (ProviderDept, error) {
+	respBody, respMap, err := p.fetch("/cgi-bin/department/get", url.Values{"id": {deptId}})
+	// {"errcode":0,"errmsg":"ok","department":{"id":2,"name":"广州研发中心","name_en":"RDGZ","department_leader":["zhangsan","lisi"],"parentid":1,"order":10}}
+	raw.Departments = append(raw.Departments, string(respBody))
+	if err != nil {
+		if _, ok := err.(*ProviderError); ok {
+			return ProviderDept{}, err
+		}
+		return ProviderDept{}, newProviderError("err:15", http.StatusInternalServerError, respBody, err)
+	}
+	department := mapMap(respMap, "department")
+	if department == nil {
+		return ProviderDept{}, newProviderError("err:16", http.StatusInternalServerError, respBody, nil)
+	}
+	if _, isset := department["name"]; !isset {
+		return ProviderDept{}, newProviderError("err:17", http.StatusInternalServerError, respBody, nil)
+	}
+	var managerUserIds []string
+	for _, temp := range mapSlice(department, "department_leader") {
+		if managerUserId, ok := temp.(string); ok {
+			managerUserIds = append(managerUserIds, managerUserId)
+		}
+	}
+	return ProviderDept{Id: deptId, Name: mapString(department, "name"), ParentId: strconv.FormatInt(int64(mapFloat(department, "parentid")), 10), ManagerUserIds: managerUserIds}, nil
+}
+
+// 根部门的parentid是0
+func (p *WecomProvider) GetDepartmentParentIds(deptId string) ([]string, error) {
+	return walkDepartmentParents(p, deptId, "0")
+}
+
+// 从通讯录删除后返回60111, 离职/禁用的status不是1
+func (p *WecomProvider) IsActive(userId string, contactType float64) (bool, error) {
+	var raw DingdingRawStruct
+	user, err := p.GetUser(userId, &raw)
+	if err != nil {
+		if providerError, ok := err.(*ProviderError); ok && providerError.ErrId == "err:9:1" {
+			return false, nil
+		}
+		return false, err
+	}
+	return user.Active, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+// 限流
+// 每次扫码回调要调好几个钉钉接口, 一个循环就能把公司的钉钉接口额度用完, 真正的员工反而登录不了
+// rate_limit_ip: 每个用户ip打开扫码页和扫码回调的频率
+// rate_limit_app: 每个业务方打开扫码页(带client_id)和fetch的频率, fetch认证通过的按client_id, 其它按调用方ip
+// 格式 次数/秒数, 令牌桶, 空闲时最多可以连续请求"次数"次, 0不限制, 超过返回429 err:53
+// fetch_fail_limit: 同一个调用方ip fetch失败(err:28 ticket不对 err:22 已过期)的频率, 超过当成在猜ticket,
+//   加到禁止列表 fetch_fail_block_duration 秒, 这段时间扫码和fetch都返回err:31, 管理后台可以看到和删除
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type RateLimiter struct {
+	name      string // 监控指标的标签
+	configKey string // 配置项, 修改后马上生效
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+}
+
+var ipRateLimiter = NewRateLimiter("ip", "rate_limit_ip")
+var appRateLimiter = NewRateLimiter("app", "rate_limit_app")
+var fetchFailLimiter = NewRateLimiter("fetch_fail", "fetch_fail_limit")
+var rateLimiters = []*RateLimiter{ipRateLimiter, appRateLimiter, fetchFailLimiter}
+
+func NewRateLimiter(name, configKey string) *RateLimiter {
+	return &RateLimiter{name: name, configKey: configKey, buckets: map[string]*tokenBucket{}}
+}
+
+// 次数/秒数, 例如 30/60
+func parseRateLimit(s string) (float64, float64, bool) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	count, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	seconds, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil || count < 1 || seconds <= 0 {
+		return 0, 0, false
+	}
+	return count, seconds, true
+}
+
+func (l *RateLimiter) limit() (float64, float64, bool) {
+	temp, _ := ConfigMap.Load(l.configKey)
+	value, _ := temp.(string)
+	return parseRateLimit(value)
+}
+
+// 拿一个令牌, 没有了返回false
+func (l *RateLimiter) Allow(key string) bool {
+	count, seconds, ok := l.limit()
+	if !ok {
+		return true
+	}
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: count, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * count / seconds
+	if bucket.tokens > count {
+		bucket.tokens = count
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		metricRateLimited.Inc(l.name)
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (l *RateLimiter) Reset(key string) {
+	l.mutex.Lock()
+	delete(l.buckets, key)
+	l.mutex.Unlock()
+}
+
+// 令牌已经加满的桶和新建的一样, 删掉
+func (l *RateLimiter) clean() {
+	_, seconds, ok := l.limit()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, bucket := range l.buckets {
+		if !ok || time.Since(bucket.updated).Seconds() >= seconds {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func clearRateLimiters() {
+	if !loopSleep(time.Second * 60) {
+		return
+	}
+	defer loopDone()
+	for _, l := range rateLimiters {
+		l.clean()
+	}
+	go clearRateLimiters()
+}
+
+// fetch失败计数, 太多了禁止这个ip
+func recordFetchFailure(callerIp string) {
+	if fetchFailLimiter.Allow(callerIp) {
+		return
+	}
+	fetchFailLimiter.Reset(callerIp)
+	blockDuration, _ := strconv.ParseInt(getConfig().Values["fetch_fail_block_duration"], 10, 64)
+	MemForbiddenMap.Store(callerIp, ForbiddenStruct{Reason: "fetch失败过多", Expired: time.Now().Unix() + blockDuration})
+	loger.Println("Block ip:", callerIp, "too many fetch failures")
+	audit(AuditEvent{Event: AuditSourceBlocked, Ip: callerIp, Detail: "too many fetch failures, blocked " + strconv.FormatInt(blockDuration, 10) + "s"})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// 空闲时能连续用完"次数"个令牌, 之后按 次数/秒数 的速度补充, 最多补满
+func TestRateLimiterRefill(t *testing.T) {
+	setTestConfig(t, map[string]string{"rate_limit_ip": "2/10"})
+	limiter := NewRateLimiter("ip", "rate_limit_ip")
+
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow("192.0.2.1") {
+			t.Fatalf("request %d rejected with tokens left", i+1)
+		}
+	}
+	if limiter.Allow("192.0.2.1") {
+		t.Fatal("request allowed after tokens used up")
+	}
+	if !limiter.Allow("192.0.2.2") {
+		t.Fatal("other key shares the bucket")
+	}
+
+	// 5秒补一个令牌
+	limiter.buckets["192.0.2.1"].updated = time.Now().Add(-time.Second * 5)
+	if !limiter.Allow("192.0.2.1") {
+		t.Fatal("token not refilled after 5s")
+	}
+	if limiter.Allow("192.0.2.1") {
+		t.Fatal("refilled more than one token in 5s")
+	}
+
+	// 空闲很久也只补满到"次数"个
+	limiter.buckets["192.0.2.1"].updated = time.Now().Add(-time.Hour)
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow("192.0.2.1") {
+			t.Fatalf("request %d rejected after idle", i+1)
+		}
+	}
+	if limiter.Allow("192.0.2.1") {
+		t.Fatal("bucket refilled over its capacity")
+	}
+
+	// 配置成0不限制, 修改后马上生效
+	setTestConfig(t, map[string]string{"rate_limit_ip": "0"})
+	if !limiter.Allow("192.0.2.1") {
+		t.Fatal("request rejected with rate limit off")
+	}
+}
+
+// fetch失败超过fetch_fail_limit后屏蔽调用方ip fetch_fail_block_duration秒
+func TestRecordFetchFailureBlocks(t *testing.T) {
+	setTestConfig(t, map[string]string{"fetch_fail_limit": "3/60", "fetch_fail_block_duration": "600"})
+	oldStore := sessionStore
+	sessionStore = NewMemoryStore()
+	defer func() {
+		sessionStore = oldStore
+	}()
+	const callerIp = "198.51.100.7"
+	fetchFailLimiter.Reset(callerIp)
+	defer fetchFailLimiter.Reset(callerIp)
+
+	for i := 0; i < 3; i++ {
+		recordFetchFailure(callerIp)
+		if _, ok := MemForbiddenMap.Load(callerIp); ok {
+			t.Fatalf("blocked after %d failures, limit is 3", i+1)
+		}
+	}
+	recordFetchFailure(callerIp)
+	value, ok := MemForbiddenMap.Load(callerIp)
+	if !ok {
+		t.Fatal("not blocked after 4 failures")
+	}
+	forbidden := value.(ForbiddenStruct)
+	if expired := time.Now().Unix() + 600; forbidden.Expired < expired-5 || forbidden.Expired > expired {
+		t.Errorf("blocked until %d, want about %d", forbidden.Expired, expired)
+	}
+	if _, ok := fetchFailLimiter.buckets[callerIp]; ok {
+		t.Error("failure counter not reset after blocking")
+	}
+	if _, ok := MemForbiddenMap.Load("198.51.100.8"); ok {
+		t.Error("other ip blocked")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+// 进程内的redis替身, redis_addr = embedded 时启动
+// 只实现RedisStore用到的命令, 本地开发和测试redis模式用, 不能替代真正的redis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type embeddedRedis struct {
+	mutex sync.Mutex
+	data  map[string]embeddedRedisValue
+}
+
+type embeddedRedisValue struct {
+	value   []byte
+	expired int64 // 过期时间戳, 0表示不过期
+}
+
+// 启动替身, 返回实际监听的地址
+func StartEmbeddedRedis(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	r := &embeddedRedis{data: make(map[string]embeddedRedisValue)}
+	go r.clearExpired()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+func (r *embeddedRedis) clearExpired() {
+	for {
+		time.Sleep(time.Second)
+		now := time.Now().Unix()
+		r.mutex.Lock()
+		for key, value := range r.data {
+			if value.expired > 0 && now >= value.expired {
+				delete(r.data, key)
+			}
+		}
+		r.mutex.Unlock()
+	}
+}
+
+func (r *embeddedRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		items, ok := request.([]interface{})
+		if !ok || len(items) == 0 {
+			io.WriteString(conn, "-ERR protocol error\r\n")
+			return
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			b, _ := item.([]byte)
+			args[i] = string(b)
+		}
+		if _, err := io.WriteString(conn, r.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+// 取值时顺便检查是否过期
+func (r *embeddedRedis) get(key string) (embeddedRedisValue, bool) {
+	value, ok := r.data[key]
+	if ok && value.expired > 0 && time.Now().Unix() >= value.expired {
+		delete(r.data, key)
+		return value, false
+	}
+	return value, ok
+}
+
+func (r *embeddedRedis) exec(args []string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments\r\n"
+		}
+		value, ok := r.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return redisBulk(string(value.value))
+	case "SET":
+		if len(args) < 3 {
+			return "-ERR wrong number of arguments\r\n"
+		}
+		value := embeddedRedisValue{value: []byte(args[2])}
+		for i := 3; i+1 < len(args); i += 2 {
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return "-ERR value is not an integer or out of range\r\n"
+			}
+			switch strings.ToUpper(args[i]) {
+			case "EX": // 不支持6.2才有的EXAT, RedisStore用了会在测试里报错
+				value.expired = time.Now().Unix() + n
+			default:
+				return "-ERR syntax error\r\n"
+			}
+		}
+		r.data[args[1]] = value
+		return "+OK\r\n"
+	case "EXPIREAT":
+		if len(args) != 3 {
+			return "-ERR wrong number of arguments\r\n"
+		}
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		value, ok := r.get(args[1])
+		if !ok {
+			return ":0\r\n"
+		}
+		value.expired = n
+		r.data[args[1]] = value
+		return ":1\r\n"
+	case "GETDEL":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments\r\n"
+		}
+		value, ok := r.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		delete(r.data, args[1])
+		return redisBulk(string(value.value))
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := r.get(key); ok {
+				delete(r.data, key)
+				deleted++
+			}
+		}
+		return ":" + strconv.Itoa(deleted) + "\r\n"
+	case "SCAN": // 一次返回全部匹配的key, cursor固定为0
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var keys []string
+		for key := range r.data {
+			if _, ok := r.get(key); ok && redisGlobMatch(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+		reply := "*2\r\n" + redisBulk("0") + "*" + strconv.Itoa(len(keys)) + "\r\n"
+		for _, key := range keys {
+			reply += redisBulk(key)
+		}
+		return reply
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func redisBulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+// 只支持 * ? 和反斜杠转义, 够RedisStore用
+func redisGlobMatch(pattern, s string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if redisGlobMatch(pattern[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return s != "" && redisGlobMatch(pattern[1:], s[1:])
+	case '\\':
+		if len(pattern) > 1 {
+			pattern = pattern[1:]
+		}
+	}
+	return s != "" && s[0] == pattern[0] && redisGlobMatch(pattern[1:], s[1:])
+}
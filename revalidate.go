@@ -0,0 +1,139 @@
+package main
+
+// 离职校验
+// ticket最长能用ticket_max_ttl秒, 还能一直续期, 员工离职后已经登录的系统不会自动退出
+// 后台每隔 revalidate_interval 秒检查一遍所有持有有效ticket或单点登录会话的用户, 内部员工查 /topapi/v2/user/get, 外部联系人查 extcontact/get
+// 已经离职/被删除的立即删除他的所有ticket(包括CAS的ST, OIDC的access_token也随ticket一起失效), 并写审计日志
+// 接口调用失败时不删, 等下一轮再查, 避免钉钉接口抖动把所有人踢下线
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+type revalidateUser struct {
+	provider    string
+	userId      string
+	contactType float64
+	name        string
+	tickets     []string
+}
+
+func getRevalidateInterval() int64 {
+	return getConfig().RevalidateInterval
+}
+
+// 按用户把ticket归类, 同一个人多个ticket只查一次接口
+func collectTicketUsers() map[string]*revalidateUser {
+	users := map[string]*revalidateUser{}
+	now := time.Now().Unix()
+	MemMap.Range(func(key, value interface{}) bool {
+		ticket := key.(string)
+		if expire, ok := MemMapTTL.Load(ticket); !ok || now >= expire.(int64) {
+			return true
+		}
+		jsonByte, ok := value.([]byte)
+		if !ok {
+			return true
+		}
+		var ssoUserInfo SsoUserInfoStruct
+		if json.Unmarshal(jsonByte, &ssoUserInfo) != nil || ssoUserInfo.SsoDingdingUserId == "" {
+			return true
+		}
+		ssoProvider := ssoUserInfo.SsoProvider
+		if ssoProvider == "" { // 老版本保存的ticket没有sso_provider, 都是钉钉的
+			ssoProvider = "dingtalk"
+		}
+		userKey := ssoProvider + ":" + strconv.FormatFloat(ssoUserInfo.SsoContactType, 'f', 0, 64) + ":" + ssoUserInfo.SsoDingdingUserId
+		user, ok := users[userKey]
+		if !ok {
+			user = &revalidateUser{provider: ssoProvider, userId: ssoUserInfo.SsoDingdingUserId, contactType: ssoUserInfo.SsoContactType, name: ssoUserInfo.SsoName}
+			users[userKey] = user
+		}
+		user.tickets = append(user.tickets, ticket)
+		return true
+	})
+	// 单点登录会话的用户也要查, ticket过期了会话还能生成新的ticket
+	MemSsoSessionMap.Range(func(key, value interface{}) bool {
+		var ssoUserInfo SsoUserInfoStruct
+		if json.Unmarshal(value.(SsoSessionStruct).SsoUser, &ssoUserInfo) != nil || ssoUserInfo.SsoDingdingUserId == "" {
+			return true
+		}
+		ssoProvider := ssoUserInfo.SsoProvider
+		if ssoProvider == "" {
+			ssoProvider = "dingtalk"
+		}
+		userKey := ssoProvider + ":" + strconv.FormatFloat(ssoUserInfo.SsoContactType, 'f', 0, 64) + ":" + ssoUserInfo.SsoDingdingUserId
+		if _, ok := users[userKey]; !ok {
+			users[userKey] = &revalidateUser{provider: ssoProvider, userId: ssoUserInfo.SsoDingdingUserId, contactType: ssoUserInfo.SsoContactType, name: ssoUserInfo.SsoName}
+		}
+		return true
+	})
+	return users
+}
+
+// 删除某个用户的所有ticket, 返回删除的个数
+func revokeUserTickets(ssoProvider string, userId string, contactType float64) int {
+	var tickets []string
+	MemMap.Range(func(key, value interface{}) bool {
+		jsonByte, ok := value.([]byte)
+		if !ok {
+			return true
+		}
+		var ssoUserInfo SsoUserInfoStruct
+		if json.Unmarshal(jsonByte, &ssoUserInfo) != nil {
+			return true
+		}
+		if ssoUserInfo.SsoProvider == "" {
+			ssoUserInfo.SsoProvider = "dingtalk"
+		}
+		if ssoUserInfo.SsoProvider == ssoProvider && ssoUserInfo.SsoDingdingUserId == userId && ssoUserInfo.SsoContactType == contactType {
+			tickets = append(tickets, key.(string))
+		}
+		return true
+	})
+	for _, ticket := range tickets {
+		MemMap.Delete(ticket)
+		MemMapTTL.Delete(ticket)
+	}
+	revokeUserSessionTokens(ssoProvider, userId) // 已经签发的会话令牌也失效
+	revokeUserSsoSessions(ssoProvider, userId)   // 不能再免扫码登录
+	return len(tickets)
+}
+
+func revalidateTickets() {
+	for _, user := range collectTicketUsers() {
+		provider, ok := getIdentityProvider(user.provider)
+		if !ok { // 身份提供方被关掉了, 不管它, 等ticket自然过期
+			continue
+		}
+		active, err := provider.IsActive(user.userId, user.contactType)
+		if err != nil {
+			loger.Println("revalidate", user.provider, user.userId, "error:", err.Error())
+			continue
+		}
+		if active {
+			continue
+		}
+		count := revokeUserTickets(user.provider, user.userId, user.contactType)
+		audit(AuditEvent{Event: AuditTicketRevoked, UserId: user.userId, UserName: user.name, Provider: user.provider, Detail: "left organization, contact_type: " + strconv.FormatFloat(user.contactType, 'f', 0, 64) + ", tickets: " + strconv.Itoa(count)})
+	}
+}
+
+// revalidate_interval 配置成0不检查
+func revalidateLoop() {
+	interval := getRevalidateInterval()
+	sleep := time.Second * time.Duration(interval)
+	if interval == 0 {
+		sleep = time.Second * 60
+	}
+	if !loopSleep(sleep) {
+		return
+	}
+	defer loopDone()
+	if interval > 0 {
+		revalidateTickets()
+	}
+	go revalidateLoop()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 钉钉接口出错或者返回格式不对时不能删ticket, 只有明确离职的才删
+func TestRevalidateOnlyRevokesInactive(t *testing.T) {
+	setTestConfig(t, map[string]string{"identity_providers": "dingtalk"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gettoken" {
+			w.Write([]byte(`{"errcode":0,"errmsg":"ok","access_token":"revalidate-test-token","expires_in":7200}`))
+			return
+		}
+		var body struct {
+			Userid string `json:"userid"`
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &body)
+		switch body.Userid {
+		case "active":
+			w.Write([]byte(`{"errcode":0,"errmsg":"ok","result":{"userid":"active","active":true}}`))
+		case "left":
+			w.Write([]byte(`{"errcode":0,"errmsg":"ok","result":{"userid":"left","active":false}}`))
+		case "deleted":
+			w.Write([]byte(`{"errcode":60121,"errmsg":"找不到该用户"}`))
+		case "no-active":
+			w.Write([]byte(`{"errcode":0,"errmsg":"ok","result":{"userid":"no-active"}}`))
+		case "no-result":
+			w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+		case "api-error":
+			w.Write([]byte(`{"errcode":-1,"errmsg":"系统繁忙"}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	oldStore, oldBase := sessionStore, dingdingFakeBase
+	sessionStore = NewMemoryStore()
+	dingdingFakeBase = server.URL
+	defer func() {
+		sessionStore, dingdingFakeBase = oldStore, oldBase
+	}()
+
+	expired := time.Now().Unix() + 600
+	users := []string{"active", "left", "deleted", "no-active", "no-result", "api-error", "http-error"}
+	for _, userId := range users {
+		jsonByte, _ := json.Marshal(SsoUserInfoStruct{SsoProvider: "dingtalk", SsoDingdingUserId: userId, SsoName: userId})
+		MemMap.Store("ticket-"+userId, jsonByte)
+		MemMapTTL.Store("ticket-"+userId, expired)
+	}
+
+	revalidateTickets()
+
+	revoked := map[string]bool{"left": true, "deleted": true}
+	for _, userId := range users {
+		_, ok := MemMap.Load("ticket-" + userId)
+		if revoked[userId] && ok {
+			t.Errorf("%s: ticket kept, want revoked", userId)
+		}
+		if !revoked[userId] && !ok {
+			t.Errorf("%s: ticket revoked, want kept", userId)
+		}
+	}
+}
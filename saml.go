@@ -0,0 +1,521 @@
+package main
+
+// SAML 2.0 IdP
+// 给只支持SAML的外采系统接入钉钉扫码登录, 和普通扫码一样经过scanSuccessHandler的在职(active)检查
+// 流程: SP发起AuthnRequest(HTTP-Redirect或HTTP-POST) -> 生成ticket -> 钉钉扫码 -> scan_success_url 回调 -> 自动POST签名后的Response到SP的ACS地址
+// 签名: Response和Assertion都用RSA-SHA256签名, 规范化方式exc-c14n, 输出的xml本身就是规范化后的格式, 不需要额外的xml库
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"html"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var samlPrivateKey *rsa.PrivateKey
+var samlCertificate []byte // DER格式的证书
+
+var MemSamlAuthMap = &StoreMap{bucket: "saml_auth", encode: encodeJson, decode: decodeSamlAuthRequest, expired: expiredSamlAuthRequest} // ticket => SamlAuthRequestStruct, 等待扫码的AuthnRequest
+
+const (
+	samlNsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlNsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlNsMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlNsDsig      = "http://www.w3.org/2000/09/xmldsig#"
+	samlExcC14n     = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	samlTimeFormat  = "2006-01-02T15:04:05Z"
+)
+
+type SamlAuthRequestStruct struct {
+	SpEntityId string `json:"sp_entity_id"`
+	AcsUrl     string `json:"acs_url"`
+	RequestId  string `json:"request_id"`
+	RelayState string `json:"relay_state"`
+	Expired    int64  `json:"expired"` // 过期时间戳 到点会自动删除
+}
+
+func decodeSamlAuthRequest(b []byte) (interface{}, error) {
+	var authRequest SamlAuthRequestStruct
+	err := json.Unmarshal(b, &authRequest)
+	return authRequest, err
+}
+
+func expiredSamlAuthRequest(value interface{}) int64 {
+	return value.(SamlAuthRequestStruct).Expired
+}
+
+type samlAuthnRequest struct {
+	XMLName                     xml.Name `xml:"AuthnRequest"`
+	ID                          string   `xml:"ID,attr"`
+	Version                     string   `xml:"Version,attr"`
+	AssertionConsumerServiceURL string   `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string   `xml:"ProtocolBinding,attr"`
+	Issuer                      string   `xml:"Issuer"`
+}
+
+func isSamlOn() bool {
+	saml, ok := ConfigMap.Load("saml")
+	return ok && saml.(string) == "on"
+}
+
+// IdP的entityID, 不配置默认是metadata地址
+func getSamlEntityId() string {
+	if temp, ok := ConfigMap.Load("saml_entity_id"); ok && temp.(string) != "" {
+		return temp.(string)
+	}
+	domain, _ := ConfigMap.Load("domain")
+	metadataUrl, _ := ConfigMap.Load("saml_metadata_url")
+	return domain.(string) + metadataUrl.(string)
+}
+
+// SP会话的有效秒数, 不能超过ticket_max_ttl
+func getSamlSessionTTL() int {
+	ttl := 3600
+	if temp, ok := ConfigMap.Load("saml_session_ttl"); ok {
+		if ttlInt, err := strconv.Atoi(temp.(string)); err == nil && ttlInt > 0 {
+			ttl = ttlInt
+		}
+	}
+	if ticketMaxTTL := int(getConfig().TicketMaxTTL); ttl > ticketMaxTTL {
+		ttl = ticketMaxTTL
+	}
+	return ttl
+}
+
+// 配置格式 saml_sp:SP的entityID = ACS地址,ACS地址2
+func getSamlSpAcsUrls(spEntityId string) ([]string, bool) {
+	if spEntityId == "" {
+		return nil, false
+	}
+	temp, ok := ConfigMap.Load("saml_sp:" + spEntityId)
+	if !ok {
+		return nil, false
+	}
+	var acsUrls []string
+	for _, acsUrl := range strings.Split(temp.(string), ",") {
+		if acsUrl = strings.TrimSpace(acsUrl); acsUrl != "" {
+			acsUrls = append(acsUrls, acsUrl)
+		}
+	}
+	return acsUrls, len(acsUrls) > 0
+}
+
+// 读取签名私钥和证书, 证书不存在则用私钥生成一个10年的自签名证书
+func loadSamlCertificate() error {
+	keyFile := "./saml_private_key.pem"
+	if temp, ok := ConfigMap.Load("saml_private_key_file"); ok && temp.(string) != "" {
+		keyFile = temp.(string)
+	}
+	certFile := "./saml_cert.pem"
+	if temp, ok := ConfigMap.Load("saml_cert_file"); ok && temp.(string) != "" {
+		certFile = temp.(string)
+	}
+
+	key, err := loadRsaPrivateKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err != nil {
+			return err
+		}
+		title, _ := ConfigMap.Load("title")
+		template := &x509.Certificate{
+			SerialNumber:          serial,
+			Subject:               pkix.Name{CommonName: title.(string)},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().AddDate(10, 0, 0),
+			KeyUsage:              x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			return err
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		if err := ioutil.WriteFile(certFile, b, 0644); err != nil {
+			return err
+		}
+		loger.Println("saml certificate generated:", certFile)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("saml certificate pem decode error: " + certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if pub, ok := cert.PublicKey.(*rsa.PublicKey); !ok || pub.N.Cmp(key.PublicKey.N) != 0 {
+		return errors.New("saml certificate does not match private key")
+	}
+
+	samlPrivateKey = key
+	samlCertificate = block.Bytes
+	return nil
+}
+
+// 规范化xml的转义规则, 文本节点
+func samlEscapeText(s string) string {
+	s = strings.Replace(s, "&", "&amp;", -1)
+	s = strings.Replace(s, "<", "&lt;", -1)
+	s = strings.Replace(s, ">", "&gt;", -1)
+	s = strings.Replace(s, "\r", "&#xD;", -1)
+	return s
+}
+
+// 规范化xml的转义规则, 属性值
+func samlEscapeAttr(s string) string {
+	s = strings.Replace(s, "&", "&amp;", -1)
+	s = strings.Replace(s, "<", "&lt;", -1)
+	s = strings.Replace(s, "\"", "&quot;", -1)
+	s = strings.Replace(s, "\t", "&#x9;", -1)
+	s = strings.Replace(s, "\n", "&#xA;", -1)
+	s = strings.Replace(s, "\r", "&#xD;", -1)
+	return s
+}
+
+func samlNewId() string {
+	return "_" + GetRandomStr(40) // ID不能以数字开头
+}
+
+// 生成enveloped签名, element是已经规范化的xml, 签名插入到insertAfter之后
+func samlSign(element, id, insertAfter string) (string, error) {
+	digest := sha256.Sum256([]byte(element))
+	signedInfoContent := `<ds:CanonicalizationMethod Algorithm="` + samlExcC14n + `"></ds:CanonicalizationMethod>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"></ds:SignatureMethod>` +
+		`<ds:Reference URI="#` + id + `">` +
+		`<ds:Transforms>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"></ds:Transform>` +
+		`<ds:Transform Algorithm="` + samlExcC14n + `"></ds:Transform>` +
+		`</ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"></ds:DigestMethod>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue>` +
+		`</ds:Reference>`
+	// 单独规范化SignedInfo时需要带上ds的命名空间声明, 嵌在Signature里面时不能重复声明
+	hashed := sha256.Sum256([]byte(`<ds:SignedInfo xmlns:ds="` + samlNsDsig + `">` + signedInfoContent + `</ds:SignedInfo>`))
+	signatureValue, err := rsa.SignPKCS1v15(rand.Reader, samlPrivateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	signature := `<ds:Signature xmlns:ds="` + samlNsDsig + `"><ds:SignedInfo>` + signedInfoContent + `</ds:SignedInfo>` +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(signatureValue) + `</ds:SignatureValue>` +
+		`<ds:KeyInfo><ds:X509Data><ds:X509Certificate>` + base64.StdEncoding.EncodeToString(samlCertificate) + `</ds:X509Certificate></ds:X509Data></ds:KeyInfo>` +
+		`</ds:Signature>`
+
+	pos := strings.Index(element, insertAfter)
+	if pos < 0 {
+		return "", errors.New("saml sign insert position not found")
+	}
+	pos += len(insertAfter)
+	return element[:pos] + signature + element[pos:], nil
+}
+
+func samlAttribute(name string, values ...string) string {
+	attribute := `<saml:Attribute Name="` + samlEscapeAttr(name) + `" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:basic">`
+	for _, value := range values {
+		attribute += `<saml:AttributeValue>` + samlEscapeText(value) + `</saml:AttributeValue>`
+	}
+	return attribute + `</saml:Attribute>`
+}
+
+// 用户信息生成签名后的Response, 属性值来自SsoUserInfoStruct
+func buildSamlResponse(authRequest SamlAuthRequestStruct, ssoUserInfo SsoUserInfoStruct, sessionExpired int64) (string, error) {
+	now := time.Now().UTC()
+	issueInstant := now.Format(samlTimeFormat)
+	notBefore := now.Add(-time.Minute).Format(samlTimeFormat)
+	notOnOrAfter := now.Add(5 * time.Minute).Format(samlTimeFormat)
+	issuer := samlEscapeText(getSamlEntityId())
+	responseId := samlNewId()
+	assertionId := samlNewId()
+
+	inResponseTo := ""
+	if authRequest.RequestId != "" {
+		inResponseTo = ` InResponseTo="` + samlEscapeAttr(authRequest.RequestId) + `"`
+	}
+
+	var deptNames, deptIds []string
+	for _, dept := range ssoUserInfo.SsoUserDeptInfo {
+		deptNames = append(deptNames, dept.SsoDeptName)
+		deptIds = append(deptIds, dept.SsoDeptId)
+	}
+	contactType := "0"
+	if ssoUserInfo.SsoContactType == 1 {
+		contactType = "1"
+	}
+	attributes := samlAttribute("name", ssoUserInfo.SsoName) +
+		samlAttribute("nickname", ssoUserInfo.SsoDingdingNickName) +
+		samlAttribute("mobile", ssoUserInfo.SsoMobile) +
+		samlAttribute("job_title", ssoUserInfo.SsoJobTitle) +
+		samlAttribute("union_id", ssoUserInfo.SsoDingdingUnionId) +
+		samlAttribute("contact_type", contactType)
+	if ssoUserInfo.SsoEmail != "" {
+		attributes += samlAttribute("email", ssoUserInfo.SsoEmail)
+	}
+	if ssoUserInfo.SsoCompanyName != "" {
+		attributes += samlAttribute("company_name", ssoUserInfo.SsoCompanyName)
+	}
+	if len(deptNames) > 0 {
+		attributes += samlAttribute("departments", deptNames...) + samlAttribute("department_ids", deptIds...)
+	}
+
+	// 属性按规范化要求的字母顺序输出, 元素之间不能有空白
+	assertionIssuer := `<saml:Issuer>` + issuer + `</saml:Issuer>`
+	assertion := `<saml:Assertion xmlns:saml="` + samlNsAssertion + `" ID="` + assertionId + `" IssueInstant="` + issueInstant + `" Version="2.0">` +
+		assertionIssuer +
+		`<saml:Subject>` +
+		`<saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified">` + samlEscapeText(ssoUserInfo.SsoDingdingUserId) + `</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">` +
+		`<saml:SubjectConfirmationData` + inResponseTo + ` NotOnOrAfter="` + notOnOrAfter + `" Recipient="` + samlEscapeAttr(authRequest.AcsUrl) + `"></saml:SubjectConfirmationData>` +
+		`</saml:SubjectConfirmation>` +
+		`</saml:Subject>` +
+		`<saml:Conditions NotBefore="` + notBefore + `" NotOnOrAfter="` + notOnOrAfter + `">` +
+		`<saml:AudienceRestriction><saml:Audience>` + samlEscapeText(authRequest.SpEntityId) + `</saml:Audience></saml:AudienceRestriction>` +
+		`</saml:Conditions>` +
+		`<saml:AuthnStatement AuthnInstant="` + issueInstant + `" SessionIndex="` + samlNewId() + `" SessionNotOnOrAfter="` + time.Unix(sessionExpired, 0).UTC().Format(samlTimeFormat) + `">` +
+		`<saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified</saml:AuthnContextClassRef></saml:AuthnContext>` +
+		`</saml:AuthnStatement>` +
+		`<saml:AttributeStatement>` + attributes + `</saml:AttributeStatement>` +
+		`</saml:Assertion>`
+	assertion, err := samlSign(assertion, assertionId, assertionIssuer)
+	if err != nil {
+		return "", err
+	}
+
+	responseIssuer := `<saml:Issuer xmlns:saml="` + samlNsAssertion + `">` + issuer + `</saml:Issuer>`
+	response := `<samlp:Response xmlns:samlp="` + samlNsProtocol + `" Destination="` + samlEscapeAttr(authRequest.AcsUrl) + `" ID="` + responseId + `"` + inResponseTo + ` IssueInstant="` + issueInstant + `" Version="2.0">` +
+		responseIssuer +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"></samlp:StatusCode></samlp:Status>` +
+		assertion +
+		`</samlp:Response>`
+	return samlSign(response, responseId, responseIssuer)
+}
+
+// 解析SP发来的AuthnRequest, Redirect绑定是deflate+base64, POST绑定是base64
+func parseSamlAuthnRequest(samlRequest string, isRedirectBinding bool) (samlAuthnRequest, error) {
+	var authnRequest samlAuthnRequest
+	raw, err := base64.StdEncoding.DecodeString(samlRequest)
+	if err != nil {
+		return authnRequest, err
+	}
+	if isRedirectBinding {
+		raw, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(raw)))
+		if err != nil {
+			return authnRequest, err
+		}
+	}
+	if err := xml.Unmarshal(raw, &authnRequest); err != nil {
+		return authnRequest, err
+	}
+	if authnRequest.ID == "" || authnRequest.Issuer == "" {
+		return authnRequest, errors.New("AuthnRequest missing ID or Issuer")
+	}
+	return authnRequest, nil
+}
+
+func samlMetadataHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		domain, _ := ConfigMap.Load("domain")
+		ssoUrl, _ := ConfigMap.Load("saml_sso_url")
+		location := samlEscapeAttr(domain.(string) + ssoUrl.(string))
+		w.Header().Set("Content-Type", "application/samlmetadata+xml; charset=utf-8")
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="` + samlNsMetadata + `" entityID="` + samlEscapeAttr(getSamlEntityId()) + `">
+  <md:IDPSSODescriptor WantAuthnRequestsSigned="false" protocolSupportEnumeration="` + samlNsProtocol + `">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo xmlns:ds="` + samlNsDsig + `">
+        <ds:X509Data>
+          <ds:X509Certificate>` + base64.StdEncoding.EncodeToString(samlCertificate) + `</ds:X509Certificate>
+        </ds:X509Data>
+      </ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified</md:NameIDFormat>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="` + location + `"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="` + location + `"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>
+`))
+	}
+}
+
+// 接收SP发起的AuthnRequest, 校验ACS地址后跳转钉钉扫码
+func samlSsoHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var samlRequest, relayState string
+		var isRedirectBinding bool
+		switch req.Method {
+		case "GET":
+			gets := req.URL.Query()
+			samlRequest = gets.Get("SAMLRequest")
+			relayState = gets.Get("RelayState")
+			isRedirectBinding = true
+		case "POST":
+			if err := req.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				EchoJson(w, "err:20", nil)
+				return
+			}
+			samlRequest = req.PostForm.Get("SAMLRequest")
+			relayState = req.PostForm.Get("RelayState")
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		if samlRequest == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			EchoJson(w, "err:21", nil)
+			return
+		}
+
+		authnRequest, err := parseSamlAuthnRequest(samlRequest, isRedirectBinding)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			EchoJson(w, "err:40", nil)
+			loger.Println("saml AuthnRequest parse error:", err.Error())
+			return
+		}
+		acsUrls, ok := getSamlSpAcsUrls(authnRequest.Issuer)
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			EchoJson(w, "err:41", nil)
+			loger.Println("saml sp not registered:", authnRequest.Issuer)
+			return
+		}
+		acsUrl := acsUrls[0]
+		if authnRequest.AssertionConsumerServiceURL != "" {
+			acsUrl = ""
+			for _, registered := range acsUrls {
+				if registered == authnRequest.AssertionConsumerServiceURL {
+					acsUrl = registered
+					break
+				}
+			}
+			if acsUrl == "" {
+				w.WriteHeader(http.StatusForbidden)
+				EchoJson(w, "err:42", nil)
+				loger.Println("saml acs url not registered:", authnRequest.Issuer, authnRequest.AssertionConsumerServiceURL)
+				return
+			}
+		}
+
+		userAgent := req.Header.Get("User-Agent")
+		userIp := GetIp(req)
+		if _, ok := MemForbiddenMap.Load(userIp); ok {
+			w.WriteHeader(http.StatusForbidden)
+			EchoJson(w, "err:31", nil)
+			return
+		}
+
+		ticket := generateTicket(userAgent, userIp, getSamlSessionTTL())
+		MemSamlAuthMap.Store(ticket, SamlAuthRequestStruct{
+			SpEntityId: authnRequest.Issuer,
+			AcsUrl:     acsUrl,
+			RequestId:  authnRequest.ID,
+			RelayState: relayState,
+			Expired:    time.Now().Unix() + 300,
+		})
+		http.Redirect(w, req, GetQrUrl(ticket, req.URL.Query().Get("provider")), http.StatusFound)
+	}
+}
+
+// 扫码成功后由successReturn调用, 如果这个ticket是saml发起的, 输出自动提交的表单把Response POST给SP, 返回true
+func samlAuthorizeReturn(w http.ResponseWriter, ticket string, ssoUserInfo SsoUserInfoStruct, sessionExpired int64) bool {
+	temp, ok := MemSamlAuthMap.Load(ticket)
+	if !ok {
+		return false
+	}
+	MemSamlAuthMap.Delete(ticket)
+	authRequest := temp.(SamlAuthRequestStruct)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	response, err := buildSamlResponse(authRequest, ssoUserInfo, sessionExpired)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		EchoJson(w, "err:43", nil)
+		loger.Println("saml response build error:", err.Error())
+		return true
+	}
+
+	relayState := ""
+	if authRequest.RelayState != "" {
+		relayState = `<input type="hidden" name="RelayState" value="` + html.EscapeString(authRequest.RelayState) + `"/>`
+	}
+	loger.Println("Saml response issued,", ssoUserInfo.SsoName, "sp:", authRequest.SpEntityId)
+	w.Write([]byte(`<html><body onload="document.forms[0].submit()">
+<form method="post" action="` + html.EscapeString(authRequest.AcsUrl) + `">
+<input type="hidden" name="SAMLResponse" value="` + base64.StdEncoding.EncodeToString([]byte(response)) + `"/>
+` + relayState + `
+<noscript><input type="submit" value="继续"/></noscript>
+</form>
+</body></html>`))
+	return true
+}
+
+func clearExpiredSaml() {
+	if !loopSleep(time.Second * 5) {
+		return
+	}
+	defer loopDone()
+
+	now := time.Now().Unix()
+	MemSamlAuthMap.Range(func(key, value interface{}) bool {
+		if now >= value.(SamlAuthRequestStruct).Expired {
+			MemSamlAuthMap.Delete(key)
+		}
+		return true
+	})
+	go clearExpiredSaml()
+}
+
+func registerSamlHandlers() {
+	if err := loadSamlCertificate(); err != nil {
+		panic("saml certificate error: " + err.Error())
+	}
+
+	var metadataUrl, ssoUrl string
+	if temp, ok := ConfigMap.Load("saml_metadata_url"); ok {
+		metadataUrl = temp.(string)
+	}
+	if temp, ok := ConfigMap.Load("saml_sso_url"); ok {
+		ssoUrl = temp.(string)
+	}
+	if len(metadataUrl) == 0 || len(ssoUrl) == 0 {
+		panic("config saml param not valid")
+	}
+
+	if !sessionStore.NativeExpiry() {
+		go clearExpiredSaml() // 定期清理没有完成扫码的AuthnRequest
+	}
+
+	http.Handle(metadataUrl, samlMetadataHandler())
+	http.Handle(ssoUrl, samlSsoHandler())
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试里独立实现的exc-c14n, 和SP验签时一样先解析xml再规范化, 不依赖buildSamlResponse拼字符串的方式
+// 只支持SAML Response用到的部分: 元素/属性/文本, 没有注释和处理指令
+type c14nNode struct {
+	prefix   string
+	local    string
+	attrs    []xml.Attr        // Name.Space是前缀
+	nsDecls  map[string]string // 前缀 => 命名空间, 默认命名空间的前缀是""
+	children []interface{}     // *c14nNode 或 string
+	parent   *c14nNode
+}
+
+func parseC14nTree(t *testing.T, s string) *c14nNode {
+	t.Helper()
+	decoder := xml.NewDecoder(strings.NewReader(s))
+	root := &c14nNode{}
+	current := root
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			node := &c14nNode{prefix: token.Name.Space, local: token.Name.Local, nsDecls: map[string]string{}, parent: current}
+			for _, attr := range token.Attr {
+				switch {
+				case attr.Name.Space == "xmlns":
+					node.nsDecls[attr.Name.Local] = attr.Value
+				case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+					node.nsDecls[""] = attr.Value
+				default:
+					node.attrs = append(node.attrs, attr)
+				}
+			}
+			current.children = append(current.children, node)
+			current = node
+		case xml.EndElement:
+			current = current.parent
+		case xml.CharData:
+			current.children = append(current.children, string(token))
+		}
+	}
+	for _, child := range root.children {
+		if node, ok := child.(*c14nNode); ok {
+			node.parent = nil
+			return node
+		}
+	}
+	t.Fatal("no root element")
+	return nil
+}
+
+// 祖先元素声明的命名空间
+func (n *c14nNode) inScope() map[string]string {
+	var chain []*c14nNode
+	for node := n.parent; node != nil; node = node.parent {
+		chain = append(chain, node)
+	}
+	scope := map[string]string{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for prefix, uri := range chain[i].nsDecls {
+			scope[prefix] = uri
+		}
+	}
+	return scope
+}
+
+func (n *c14nNode) find(local string) *c14nNode {
+	for _, child := range n.children {
+		if node, ok := child.(*c14nNode); ok {
+			if node.local == local {
+				return node
+			}
+			if found := node.find(local); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+func (n *c14nNode) child(local string) *c14nNode {
+	for _, child := range n.children {
+		if node, ok := child.(*c14nNode); ok && node.local == local {
+			return node
+		}
+	}
+	return nil
+}
+
+func (n *c14nNode) text() string {
+	var s string
+	for _, child := range n.children {
+		if text, ok := child.(string); ok {
+			s += text
+		}
+	}
+	return s
+}
+
+func (n *c14nNode) attr(local string) string {
+	for _, attr := range n.attrs {
+		if attr.Name.Space == "" && attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func (n *c14nNode) qname() string {
+	if n.prefix == "" {
+		return n.local
+	}
+	return n.prefix + ":" + n.local
+}
+
+func c14nEscapeText(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;").Replace(s)
+}
+
+func c14nEscapeAttr(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", "\"", "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;").Replace(s)
+}
+
+// exc-c14n: 只输出元素和属性实际用到的前缀的声明, 输出过的祖先已经声明了相同的就不再输出
+func (n *c14nNode) canonicalize(buf *bytes.Buffer, scope, rendered map[string]string, skip *c14nNode) {
+	elementScope := map[string]string{}
+	for prefix, uri := range scope {
+		elementScope[prefix] = uri
+	}
+	for prefix, uri := range n.nsDecls {
+		elementScope[prefix] = uri
+	}
+	used := map[string]bool{n.prefix: true}
+	for _, attr := range n.attrs {
+		if attr.Name.Space != "" && attr.Name.Space != "xml" {
+			used[attr.Name.Space] = true
+		}
+	}
+	var prefixes []string
+	for prefix := range used {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	elementRendered := map[string]string{}
+	for prefix, uri := range rendered {
+		elementRendered[prefix] = uri
+	}
+
+	buf.WriteString("<" + n.qname())
+	for _, prefix := range prefixes {
+		uri := elementScope[prefix]
+		if renderedUri, ok := rendered[prefix]; (ok && renderedUri == uri) || (!ok && prefix == "" && uri == "") {
+			continue
+		}
+		elementRendered[prefix] = uri
+		if prefix == "" {
+			buf.WriteString(` xmlns="` + c14nEscapeAttr(uri) + `"`)
+		} else {
+			buf.WriteString(` xmlns:` + prefix + `="` + c14nEscapeAttr(uri) + `"`)
+		}
+	}
+	attrs := append([]xml.Attr{}, n.attrs...)
+	attrUri := func(attr xml.Attr) string {
+		if attr.Name.Space == "" {
+			return ""
+		}
+		return elementScope[attr.Name.Space]
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrUri(attrs[i]) != attrUri(attrs[j]) {
+			return attrUri(attrs[i]) < attrUri(attrs[j])
+		}
+		return attrs[i].Name.Local < attrs[j].Name.Local
+	})
+	for _, attr := range attrs {
+		name := attr.Name.Local
+		if attr.Name.Space != "" {
+			name = attr.Name.Space + ":" + name
+		}
+		buf.WriteString(" " + name + `="` + c14nEscapeAttr(attr.Value) + `"`)
+	}
+	buf.WriteString(">")
+	for _, child := range n.children {
+		switch child := child.(type) {
+		case string:
+			buf.WriteString(c14nEscapeText(child))
+		case *c14nNode:
+			if child != skip {
+				child.canonicalize(buf, elementScope, elementRendered, skip)
+			}
+		}
+	}
+	buf.WriteString("</" + n.qname() + ">")
+}
+
+func (n *c14nNode) canonical(skip *c14nNode) []byte {
+	var buf bytes.Buffer
+	n.canonicalize(&buf, n.inScope(), map[string]string{}, skip)
+	return buf.Bytes()
+}
+
+// 按SP的方式验证element的enveloped签名
+func verifySamlSignature(t *testing.T, element *c14nNode, cert *x509.Certificate) {
+	t.Helper()
+	signature := element.child("Signature")
+	if signature == nil {
+		t.Fatalf("%s not signed", element.local)
+	}
+	signedInfo := signature.child("SignedInfo")
+	reference := signedInfo.child("Reference")
+	if reference.attr("URI") != "#"+element.attr("ID") {
+		t.Fatalf("reference %s, element ID %s", reference.attr("URI"), element.attr("ID"))
+	}
+	for _, node := range []*c14nNode{signedInfo.child("CanonicalizationMethod"), reference.child("Transforms").children[1].(*c14nNode)} {
+		if node.attr("Algorithm") != samlExcC14n {
+			t.Fatalf("%s algorithm %s", node.local, node.attr("Algorithm"))
+		}
+	}
+
+	digest := sha256.Sum256(element.canonical(signature)) // enveloped-signature: 去掉签名本身
+	if got := reference.child("DigestValue").text(); got != base64.StdEncoding.EncodeToString(digest[:]) {
+		t.Fatalf("%s digest %s, canonical xml:\n%s", element.local, got, element.canonical(signature))
+	}
+
+	signatureValue, err := base64.StdEncoding.DecodeString(signature.child("SignatureValue").text())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256(signedInfo.canonical(nil))
+	if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, hashed[:], signatureValue); err != nil {
+		t.Fatalf("%s signature: %v, canonical SignedInfo:\n%s", element.local, err, signedInfo.canonical(nil))
+	}
+
+	keyInfoCert := signature.child("KeyInfo").child("X509Data").child("X509Certificate").text()
+	if keyInfoCert != base64.StdEncoding.EncodeToString(cert.Raw) {
+		t.Fatalf("%s KeyInfo certificate is not the published one", element.local)
+	}
+}
+
+func setTestSamlConfig(t *testing.T) *x509.Certificate {
+	t.Helper()
+	dir := t.TempDir()
+	setTestConfig(t, map[string]string{"saml": "on", "saml_private_key_file": filepath.Join(dir, "saml_private_key.pem"), "saml_cert_file": filepath.Join(dir, "saml_cert.pem")})
+	if err := loadSamlCertificate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 从metadata取证书, 和SP配置IdP时一样
+	w := httptest.NewRecorder()
+	samlMetadataHandler()(w, httptest.NewRequest("GET", "/bms-sso/saml/metadata", nil))
+	metadata := parseC14nTree(t, w.Body.String())
+	der, err := base64.StdEncoding.DecodeString(metadata.find("X509Certificate").text())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestSamlResponseSignature(t *testing.T) {
+	cert := setTestSamlConfig(t)
+
+	authRequest := SamlAuthRequestStruct{
+		SpEntityId: "https://sp.example.com/saml?a=1&b=<2>",
+		AcsUrl:     "https://sp.example.com/acs?tenant=\"x\"&next=/a\tb",
+		RequestId:  "_req\"<&>'1",
+	}
+	ssoUserInfo := SsoUserInfoStruct{
+		SsoName:             `张三 & "李四" <admin> 'x'`,
+		SsoDingdingNickName: "昵称\r\n第二行\t制表",
+		SsoMobile:           "13800000001",
+		SsoJobTitle:         "R&D <架构师>",
+		SsoDingdingUnionId:  "union&<>",
+		SsoDingdingUserId:   "user<&>\"1",
+		SsoCompanyName:      "某某 & 公司 ]]>",
+		SsoUserDeptInfo:     []SsoUserDeptStruct{{SsoDeptId: "1001", SsoDeptName: "技术部 <R&D>"}, {SsoDeptId: "1002", SsoDeptName: `客服"部"`}},
+	}
+	response, err := buildSamlResponse(authRequest, ssoUserInfo, time.Now().Unix()+3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := parseC14nTree(t, response)
+	if root.local != "Response" {
+		t.Fatalf("root element %s", root.qname())
+	}
+	assertion := root.child("Assertion")
+	verifySamlSignature(t, assertion, cert)
+	verifySamlSignature(t, root, cert)
+
+	// 转义后解析出来的值和原来的一样
+	attributes := map[string][]string{}
+	for _, child := range assertion.child("AttributeStatement").children {
+		attribute := child.(*c14nNode)
+		for _, value := range attribute.children {
+			attributes[attribute.attr("Name")] = append(attributes[attribute.attr("Name")], value.(*c14nNode).text())
+		}
+	}
+	want := map[string][]string{
+		"name":         {ssoUserInfo.SsoName},
+		"nickname":     {ssoUserInfo.SsoDingdingNickName},
+		"job_title":    {ssoUserInfo.SsoJobTitle},
+		"union_id":     {ssoUserInfo.SsoDingdingUnionId},
+		"company_name": {ssoUserInfo.SsoCompanyName},
+		"departments":  {"技术部 <R&D>", `客服"部"`},
+	}
+	for name, values := range want {
+		if strings.Join(attributes[name], "|") != strings.Join(values, "|") {
+			t.Fatalf("attribute %s = %q, want %q", name, attributes[name], values)
+		}
+	}
+	if got := assertion.find("NameID").text(); got != ssoUserInfo.SsoDingdingUserId {
+		t.Fatalf("NameID = %q", got)
+	}
+	if got := assertion.find("SubjectConfirmationData").attr("Recipient"); got != authRequest.AcsUrl {
+		t.Fatalf("Recipient = %q", got)
+	}
+	if got := root.attr("InResponseTo"); got != authRequest.RequestId {
+		t.Fatalf("InResponseTo = %q", got)
+	}
+	if got := assertion.find("Audience").text(); got != authRequest.SpEntityId {
+		t.Fatalf("Audience = %q", got)
+	}
+
+	// 改了属性值签名就不对了, 确认上面的验证真的校验了内容
+	tampered := strings.Replace(response, "13800000001", "13800000002", 1)
+	tamperedAssertion := parseC14nTree(t, tampered).child("Assertion")
+	signature := tamperedAssertion.child("Signature")
+	digest := sha256.Sum256(tamperedAssertion.canonical(signature))
+	if signature.child("SignedInfo").child("Reference").child("DigestValue").text() == base64.StdEncoding.EncodeToString(digest[:]) {
+		t.Fatal("tampered assertion digest still matches")
+	}
+}
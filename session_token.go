@@ -0,0 +1,334 @@
+package main
+
+// 无状态会话令牌
+// session_token = on 时扫码成功除了ticket还返回 sso_session_token, 是EdDSA(Ed25519)签名的jwt, 带用户信息/过期时间/业务方/绑定哈希
+// 业务方可以用 session_token_jwks_url 的公钥自己校验, 每次打开页面不用再调fetch, 也可以调 session_token_url 让本服务校验, 不查MemMap
+// 多个实例部署时配置同一个私钥文件, 不需要共享ticket存储
+// claims:
+//   iss domain   sub 身份提供方:用户id   aud 发起扫码的业务方client_id, 没有登记的业务方不带   iat/exp 和ticket的ttl一样
+//   jti 和审计日志的correlation_id一样   bnd base64url(sha256(UA + " " + ip)), 和ticket一样绑定扫码的浏览器和ip   sso_user 按业务方claims过滤后的用户信息, 不带dingding_raw
+// 吊销列表: 离职/管理后台删除ticket时自动吊销, 也可以调 session_token_revoke_url 吊销, 记录保存到令牌最长有效期(ticket_max_ttl)后自动删除
+//   业务方自己校验时拿不到吊销列表, 需要及时失效的业务方用 session_token_url 校验或者把ttl设短一些
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sessionTokenPrivateKey ed25519.PrivateKey
+var sessionTokenKeyId string
+
+type RevokedTokenStruct struct {
+	IssuedBefore int64 `json:"issued_before"` // 吊销用户时, 这个时间之前签发的令牌都无效
+	Expired      int64 `json:"expired"`       // 过期时间戳 之前签发的令牌都过期了, 到点会自动删除
+}
+
+// jti:令牌id 或者 user:身份提供方:用户id => RevokedTokenStruct
+var MemRevokedTokenMap = &StoreMap{bucket: "token_revoked", encode: encodeJson, decode: decodeRevokedToken, expired: expiredRevokedToken}
+
+type SessionTokenClaims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience string          `json:"aud,omitempty"`
+	IssuedAt int64           `json:"iat"`
+	Expires  int64           `json:"exp"`
+	Id       string          `json:"jti"`
+	Binding  string          `json:"bnd"`
+	SsoUser  json.RawMessage `json:"sso_user"`
+}
+
+func decodeRevokedToken(b []byte) (interface{}, error) {
+	var revoked RevokedTokenStruct
+	err := json.Unmarshal(b, &revoked)
+	return revoked, err
+}
+
+func expiredRevokedToken(value interface{}) int64 {
+	return value.(RevokedTokenStruct).Expired
+}
+
+func isSessionTokenOn() bool {
+	sessionToken, ok := ConfigMap.Load("session_token")
+	return ok && sessionToken.(string) == "on"
+}
+
+// 读取签名用的Ed25519私钥, 文件不存在则生成一个新的写入文件
+func loadSessionTokenKey() error {
+	keyFile := "./session_token_key.pem"
+	if temp, ok := ConfigMap.Load("session_token_key_file"); ok && temp.(string) != "" {
+		keyFile = temp.(string)
+	}
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(keyFile, b, 0600); err != nil {
+			return err
+		}
+		loger.Println("ed25519 private key generated:", keyFile)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return errors.New("private key pem decode error: " + keyFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return errors.New("private key is not ed25519: " + keyFile)
+	}
+	kid := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	sessionTokenPrivateKey = key
+	sessionTokenKeyId = hex.EncodeToString(kid[:8])
+	return nil
+}
+
+func sessionTokenBinding(userAgent, userIp string) string {
+	sum := sha256.Sum256([]byte(userAgent + " " + userIp))
+	return base64UrlEncode(sum[:])
+}
+
+// 扫码成功时签发, ssoUserByte是按业务方claims过滤后的用户信息
+func issueSessionToken(ticket string, ssoUserInfo SsoUserInfoStruct, ssoUserByte []byte, ttl int, userIp, userAgent string) (string, error) {
+	var user map[string]json.RawMessage
+	if err := json.Unmarshal(ssoUserByte, &user); err != nil {
+		return "", err
+	}
+	delete(user, "sso_ticket")
+	delete(user, "sso_session_token")
+	delete(user, "dingding_raw") // 太大, 需要的业务方调fetch
+	userByte, err := json.Marshal(user)
+	if err != nil {
+		return "", err
+	}
+	domain, _ := ConfigMap.Load("domain")
+	now := time.Now().Unix()
+	claims := SessionTokenClaims{
+		Issuer:   domain.(string),
+		Subject:  ssoUserInfo.SsoProvider + ":" + ssoUserInfo.SsoDingdingUserId,
+		IssuedAt: now,
+		Expires:  now + int64(ttl),
+		Id:       auditCorrelationId(ticket),
+		Binding:  sessionTokenBinding(userAgent, userIp),
+		SsoUser:  userByte,
+	}
+	if temp, ok := MemTicketClientMap.Load(ticket); ok {
+		claims.Audience = temp.(TicketClientStruct).ClientId
+	}
+	header, err := json.Marshal(map[string]string{"alg": "EdDSA", "typ": "JWT", "kid": sessionTokenKeyId})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64UrlEncode(header) + "." + base64UrlEncode(payload)
+	return signingInput + "." + base64UrlEncode(ed25519.Sign(sessionTokenPrivateKey, []byte(signingInput))), nil
+}
+
+// 校验签名和吊销列表, 返回的错误是配置文件里的错误编号
+func verifySessionToken(token string) (SessionTokenClaims, string) {
+	var claims SessionTokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, "err:54"
+	}
+	var header map[string]string
+	headerByte, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerByte, &header) != nil || header["alg"] != "EdDSA" || header["kid"] != sessionTokenKeyId {
+		return claims, "err:54"
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(sessionTokenPrivateKey.Public().(ed25519.PublicKey), []byte(parts[0]+"."+parts[1]), signature) {
+		return claims, "err:54"
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, "err:54"
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return claims, "err:55"
+	}
+	if _, ok := MemRevokedTokenMap.Load("jti:" + claims.Id); ok {
+		return claims, "err:56"
+	}
+	if temp, ok := MemRevokedTokenMap.Load("user:" + claims.Subject); ok && claims.IssuedAt <= temp.(RevokedTokenStruct).IssuedBefore {
+		return claims, "err:56"
+	}
+	return claims, ""
+}
+
+// 吊销记录保存到已经签发的令牌全部过期
+func revokeSessionTokens(key string) {
+	if !isSessionTokenOn() {
+		return
+	}
+	now := time.Now().Unix()
+	MemRevokedTokenMap.Store(key, RevokedTokenStruct{IssuedBefore: now, Expired: now + getConfig().TicketMaxTTL + 1})
+}
+
+func revokeUserSessionTokens(ssoProvider, userId string) {
+	revokeSessionTokens("user:" + ssoProvider + ":" + userId)
+}
+
+func revokeTicketSessionToken(ticket string) {
+	revokeSessionTokens("jti:" + auditCorrelationId(ticket))
+}
+
+// 业务方调用, 和fetch一样传 session_token user_agent client_ip, 返回令牌里的用户信息
+func sessionTokenHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		switch req.Method {
+		case "POST":
+			if err := req.ParseForm(); err != nil {
+				EchoJson(w, "err:20", nil)
+				return
+			}
+			token := req.Form.Get("session_token")
+			if token == "" {
+				w.WriteHeader(http.StatusNotImplemented)
+				EchoJson(w, "err:21", nil)
+				return
+			}
+			claims, errId := verifySessionToken(token)
+			if errId != "" {
+				metricSessionTokens.Inc("invalid", errId)
+				w.WriteHeader(http.StatusGone)
+				EchoJson(w, errId, nil)
+				return
+			}
+			if claims.Binding != sessionTokenBinding(req.Form.Get("user_agent"), normalizeIp(req.Form.Get("client_ip"))) {
+				metricSessionTokens.Inc("invalid", "err:28")
+				w.WriteHeader(http.StatusGone)
+				EchoJson(w, "err:28", nil)
+				return
+			}
+			// 绑定了业务方的令牌只有这个业务方能校验
+			if claims.Audience != "" {
+				client, ok := authenticateClient(req)
+				if !ok {
+					w.WriteHeader(http.StatusUnauthorized)
+					EchoJson(w, "err:49", nil)
+					return
+				}
+				if client.ClientId != claims.Audience {
+					w.WriteHeader(http.StatusForbidden)
+					EchoJson(w, "err:51", nil)
+					return
+				}
+			}
+			metricSessionTokens.Inc("valid", "")
+			EchoJson(w, "0", claims.SsoUser)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}
+}
+
+// {"keys":[{"kty":"OKP","crv":"Ed25519","use":"sig","alg":"EdDSA","kid":"...","x":"..."}]}
+func sessionTokenJwksHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		oidcJson(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"use": "sig",
+				"alg": "EdDSA",
+				"kid": sessionTokenKeyId,
+				"x":   base64UrlEncode(sessionTokenPrivateKey.Public().(ed25519.PublicKey)),
+			}},
+		})
+	}
+}
+
+// 管理接口, 只允许本机访问
+// GET 列出吊销列表  POST jti=xx 吊销一个令牌, 或者 provider=dingtalk&user_id=xx 吊销这个用户之前签发的所有令牌
+func sessionTokenRevokeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isLocalRequest(req) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/json; charset=utf-8")
+		switch req.Method {
+		case "GET":
+			revoked := map[string]RevokedTokenStruct{}
+			MemRevokedTokenMap.Range(func(key, value interface{}) bool {
+				revoked[key.(string)] = value.(RevokedTokenStruct)
+				return true
+			})
+			b, _ := json.Marshal(revoked)
+			EchoJson(w, "0", b)
+		case "POST":
+			if err := req.ParseForm(); err != nil {
+				EchoJson(w, "err:20", nil)
+				return
+			}
+			var key string
+			if jti := req.Form.Get("jti"); jti != "" {
+				key = "jti:" + jti
+			} else if userId := req.Form.Get("user_id"); userId != "" {
+				provider := req.Form.Get("provider")
+				if provider == "" {
+					provider = "dingtalk"
+				}
+				key = "user:" + provider + ":" + userId
+			} else {
+				w.WriteHeader(http.StatusNotImplemented)
+				EchoJson(w, "err:21", nil)
+				return
+			}
+			revokeSessionTokens(key)
+			audit(AuditEvent{Event: AuditTicketRevoked, Ip: getRemoteIp(req), UserAgent: req.Header.Get("User-Agent"), Detail: "session token revoke " + key})
+			EchoJson(w, "0", []byte(strconv.Quote(key)))
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}
+}
+
+func registerSessionTokenHandlers() {
+	if err := loadSessionTokenKey(); err != nil {
+		panic("session token private key error: " + err.Error())
+	}
+	for key, handler := range map[string]http.HandlerFunc{
+		"session_token_url":        sessionTokenHandler(),
+		"session_token_jwks_url":   sessionTokenJwksHandler(),
+		"session_token_revoke_url": sessionTokenRevokeHandler(),
+	} {
+		if temp, ok := ConfigMap.Load(key); ok && len(temp.(string)) > 0 {
+			http.Handle(temp.(string), handler)
+		}
+	}
+}
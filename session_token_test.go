@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupSessionToken(t *testing.T) {
+	t.Helper()
+	setTestConfig(t, map[string]string{"session_token": "on", "session_token_key_file": filepath.Join(t.TempDir(), "session_token_key.pem")})
+	oldStore, oldKey, oldKeyId := sessionStore, sessionTokenPrivateKey, sessionTokenKeyId
+	sessionStore = NewMemoryStore()
+	t.Cleanup(func() {
+		sessionStore, sessionTokenPrivateKey, sessionTokenKeyId = oldStore, oldKey, oldKeyId
+	})
+	if err := loadSessionTokenKey(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func issueTestSessionToken(t *testing.T, ticket, userId string, ttl int) string {
+	t.Helper()
+	ssoUserInfo := SsoUserInfoStruct{SsoProvider: "dingtalk", SsoDingdingUserId: userId, SsoName: "张三"}
+	ssoUserByte, _ := json.Marshal(ssoUserInfo)
+	token, err := issueSessionToken(ticket, ssoUserInfo, ssoUserByte, ttl, testUserIp, testUserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerifySessionToken(t *testing.T) {
+	setupSessionToken(t)
+
+	token := issueTestSessionToken(t, "ticket-1", "u1", 60)
+	claims, errId := verifySessionToken(token)
+	if errId != "" {
+		t.Fatalf("valid token: %s", errId)
+	}
+	if claims.Subject != "dingtalk:u1" || !strings.Contains(string(claims.SsoUser), "张三") {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64UrlEncode([]byte(`{"sub":"dingtalk:admin","exp":9999999999}`)) + "." + parts[2]
+	if _, errId := verifySessionToken(tampered); errId != "err:54" {
+		t.Errorf("tampered payload: %q, want err:54", errId)
+	}
+	if _, errId := verifySessionToken("not-a-token"); errId != "err:54" {
+		t.Errorf("malformed: %q, want err:54", errId)
+	}
+
+	if _, errId := verifySessionToken(issueTestSessionToken(t, "ticket-expired", "u1", -1)); errId != "err:55" {
+		t.Errorf("expired: %q, want err:55", errId)
+	}
+
+	// 管理后台删除ticket时只吊销这一个令牌
+	other := issueTestSessionToken(t, "ticket-2", "u1", 60)
+	revokeTicketSessionToken("ticket-1")
+	if _, errId := verifySessionToken(token); errId != "err:56" {
+		t.Errorf("revoked by jti: %q, want err:56", errId)
+	}
+	if _, errId := verifySessionToken(other); errId != "" {
+		t.Errorf("other ticket of the same user: %q, want valid", errId)
+	}
+
+	// 离职时吊销这个人之前签发的所有令牌, 之后重新入职签发的不受影响
+	revokeUserSessionTokens("dingtalk", "u1")
+	if _, errId := verifySessionToken(other); errId != "err:56" {
+		t.Errorf("revoked by user: %q, want err:56", errId)
+	}
+	if _, errId := verifySessionToken(issueTestSessionToken(t, "ticket-3", "u2", 60)); errId != "" {
+		t.Errorf("other user: %q, want valid", errId)
+	}
+	MemRevokedTokenMap.Store("user:dingtalk:u1", RevokedTokenStruct{IssuedBefore: time.Now().Unix() - 10, Expired: time.Now().Unix() + 60})
+	if _, errId := verifySessionToken(issueTestSessionToken(t, "ticket-4", "u1", 60)); errId != "" {
+		t.Errorf("issued after user revocation: %q, want valid", errId)
+	}
+}
+
+// 令牌绑定扫码的浏览器和ip, 校验时传的不一样返回err:28
+func TestSessionTokenHandlerBinding(t *testing.T) {
+	setupSessionToken(t)
+	token := issueTestSessionToken(t, "ticket-1", "u1", 60)
+
+	tests := []struct {
+		name      string
+		userAgent string
+		clientIp  string
+		status    int
+		body      string
+	}{
+		{"same browser and ip", testUserAgent, testUserIp, http.StatusOK, "张三"},
+		{"other browser", "curl/8.0", testUserIp, http.StatusGone, "err:28"},
+		{"other ip", testUserAgent, "203.0.113.99", http.StatusGone, "err:28"},
+	}
+	for _, tt := range tests {
+		form := url.Values{"session_token": {token}, "user_agent": {tt.userAgent}, "client_ip": {tt.clientIp}}
+		req := httptest.NewRequest("POST", "/bms-sso/session-token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		sessionTokenHandler()(w, req)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s: status %d body %s, want %d containing %s", tt.name, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+	}
+}
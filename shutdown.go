@@ -0,0 +1,239 @@
+package main
+
+// 优雅退出和不停机重启
+// 收到 SIGINT/SIGTERM: 不再接受新连接, 等正在处理的请求(扫码回调, fetch等)结束, 停止后台协程, 会话存储写快照, 关闭审计日志后退出
+// 收到 SIGUSR2: 先用同一路径的程序(已经替换成新版本)启动新进程, 把监听的socket交给它, 新进程读完配置后通知就绪, 旧进程再同样优雅退出
+//   新进程没启动起来/配置有错退出了/handoverReadyTimeout内没有就绪, 杀掉新进程, 旧进程继续服务
+//   新进程等旧进程退出(会话存储写完快照)后才打开会话存储和开始处理请求
+//   socket一直没有关闭, 交接期间新的连接在内核队列里排队, 正在扫码的用户的回调不会被拒绝
+//   session_store = memory 时内存中的ticket不会交给新进程, 不停机重启需要 file 或 redis
+// 最多等 shutdown_timeout 秒, 超时还没结束的请求直接断开
+// 新进程通过环境变量 SSO_LISTEN_FD 知道fd 3是继承来的监听socket, fd 4写就绪, fd 5读到EOF表示旧进程已经退出
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var shutdownCh = make(chan struct{}) // 退出时关闭, 后台协程不再执行下一轮
+var shutdownMutex sync.Mutex
+var isShuttingDown bool
+var loopWaitGroup sync.WaitGroup // 正在执行的后台协程
+
+const handoverReadyTimeout = time.Second * 30 // 不停机重启时等新进程就绪的时间
+
+// 后台协程代替time.Sleep, 退出时马上返回false, 调用方直接return
+// 返回true时这一轮执行完要调用loopDone, 退出时会等它
+func loopSleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-shutdownCh:
+		return false
+	case <-timer.C:
+	}
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if isShuttingDown {
+		return false
+	}
+	loopWaitGroup.Add(1)
+	return true
+}
+
+func loopDone() {
+	loopWaitGroup.Done()
+}
+
+func getShutdownTimeout() time.Duration {
+	return time.Second * time.Duration(getConfig().ShutdownTimeout)
+}
+
+func isHandoverChild() bool {
+	return os.Getenv("SSO_LISTEN_FD") == "3"
+}
+
+// 不停机重启的新进程: 配置读取成功后通知父进程, 等父进程优雅退出后返回, 然后才打开会话存储
+func waitHandover() {
+	if !isHandoverChild() {
+		return
+	}
+	ready := os.NewFile(4, "handover-ready")
+	ready.Write([]byte("ready\n"))
+	ready.Close()
+	parentDone := os.NewFile(5, "handover-done")
+	ioutil.ReadAll(parentDone) // 父进程退出时关闭, 读到EOF
+	parentDone.Close()
+	loger.Println("parent process shutdown done")
+}
+
+// 不停机重启时从父进程继承监听socket
+func listen(port string) (net.Listener, error) {
+	if isHandoverChild() {
+		os.Unsetenv("SSO_LISTEN_FD")
+		f := os.NewFile(3, "listener")
+		defer f.Close()
+		loger.Println("listener inherited from parent process")
+		return net.FileListener(f)
+	}
+	return net.Listen("tcp", port)
+}
+
+// 配置了pid_file时写入当前pid, systemd用PIDFile跟踪不停机重启后的新进程
+func writePidFile() {
+	pidFile, ok := ConfigMap.Load("pid_file")
+	if !ok || len(pidFile.(string)) == 0 {
+		return
+	}
+	if err := ioutil.WriteFile(pidFile.(string), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		loger.Println("pid file write error:", err.Error())
+	}
+}
+
+// 开始监听端口, 直到收到退出信号
+func serve(port string) {
+	listener, err := listen(port)
+	if err != nil {
+		panic("can not listen the port " + port + ", program exit now!")
+	}
+	writePidFile()
+
+	server := &http.Server{}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-serveErr:
+			panic("serve error: " + err.Error())
+		case sig := <-signals:
+			loger.Println("received signal:", sig.String())
+			if sig == syscall.SIGHUP {
+				reloadConfig("SIGHUP")
+				continue
+			}
+			if sig != syscall.SIGUSR2 {
+				shutdown(server)
+				return
+			}
+			// 复制一份fd, server关闭监听后socket还在, 交给新进程
+			handover, err := listener.(*net.TCPListener).File()
+			if err != nil {
+				loger.Println("restart error:", err.Error())
+				continue
+			}
+			parentDone, err := startHandover(handover)
+			if err != nil {
+				loger.Println("restart error:", err.Error(), "- keep serving")
+				continue
+			}
+			shutdown(server)
+			parentDone.Close() // 新进程开始接管
+			return
+		}
+	}
+}
+
+func shutdown(server *http.Server) {
+	loger.Println("shutdown start")
+	ctx, cancel := context.WithTimeout(context.Background(), getShutdownTimeout())
+	defer cancel()
+
+	shutdownMutex.Lock()
+	isShuttingDown = true
+	close(shutdownCh)
+	shutdownMutex.Unlock()
+
+	if err := server.Shutdown(ctx); err != nil {
+		loger.Println("shutdown http error:", err.Error())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		loopWaitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		loger.Println("shutdown timeout, background loops still running")
+	}
+
+	if err := sessionStore.Close(); err != nil {
+		loger.Println("session store close error:", err.Error())
+	}
+	auditWriter.Close()
+	loger.Println("shutdown done")
+}
+
+// 启动新进程, fd 3是监听socket, 等它就绪后返回用来通知它父进程已经退出的管道
+func startHandover(listenerFile *os.File) (*os.File, error) {
+	defer listenerFile.Close()
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+	doneReader, doneWriter, err := os.Pipe()
+	if err != nil {
+		readyWriter.Close()
+		return nil, err
+	}
+	defer doneReader.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{listenerFile, readyWriter, doneReader}
+	cmd.Env = append(os.Environ(), "SSO_LISTEN_FD=3")
+	err = cmd.Start()
+	readyWriter.Close() // 只留新进程的写端, 新进程退出时这边读到EOF
+	if err != nil {
+		doneWriter.Close()
+		return nil, err
+	}
+	loger.Println("restart: new process pid", cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(readyReader).ReadString('\n')
+		if err == io.EOF {
+			err = errors.New("exited before ready")
+		} else if err == nil && line != "ready\n" {
+			err = errors.New("unexpected handover message " + line)
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(handoverReadyTimeout):
+		err = errors.New("new process not ready in " + handoverReadyTimeout.String())
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		doneWriter.Close()
+		return nil, errors.New("new process failed: " + err.Error())
+	}
+	return doneWriter, nil
+}
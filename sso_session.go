@@ -0,0 +1,157 @@
+package main
+
+// 单点登录会话
+// sso_session = on 时扫码成功后在本服务的域名下写一个HttpOnly的cookie, 同一个浏览器再打开登记过的业务方的扫码页时不用再扫码
+//   只有带client_id并且origin/redirect_uri校验通过的才用会话, 没登记的业务方还是要扫码, 扫码就是用户的确认
+//   直接生成这个业务方的ticket, 和扫码成功一样postMessage给业务方并关闭弹窗, 或者带着ticket跳转redirect_uri
+// 会话从扫码时开始算, 最长 sso_session_max_age 秒, 不会因为使用而延长
+// 业务方的重新认证策略是 client:业务方 的第6个字段: 留空 会话有效就不用扫码   always 每次都扫码   秒数 扫码时间超过这么多秒要重新扫码
+// cookie只保存随机的会话id, 存储里的key是它的sha256, 会话绑定浏览器UA, 离职/被限制登录的用户会话立即失效, 管理员页面可以删除
+// domain是https时cookie带Secure, http部署的浏览器不会带Secure的cookie
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SsoSessionStruct struct {
+	SsoUser        json.RawMessage `json:"sso_user"`         // 扫码时的用户信息, 不带ticket
+	IsExternalUser bool            `json:"is_external_user"` // 外部联系人
+	UserAgent      string          `json:"user_agent"`       // 扫码的浏览器
+	Ip             string          `json:"ip"`               // 扫码时的ip, 管理员页面显示用
+	AuthTime       int64           `json:"auth_time"`        // 扫码时间
+	Expired        int64           `json:"expired"`          // 过期时间戳 到点会自动删除
+}
+
+// sha256(cookie里的会话id) => SsoSessionStruct
+var MemSsoSessionMap = &StoreMap{bucket: "sso_session", encode: encodeJson, decode: decodeSsoSession, expired: expiredSsoSession}
+
+func decodeSsoSession(b []byte) (interface{}, error) {
+	var session SsoSessionStruct
+	err := json.Unmarshal(b, &session)
+	return session, err
+}
+
+func expiredSsoSession(value interface{}) int64 {
+	return value.(SsoSessionStruct).Expired
+}
+
+func isSsoSessionOn() bool {
+	ssoSession, ok := ConfigMap.Load("sso_session")
+	return ok && ssoSession.(string) == "on"
+}
+
+func getSsoSessionCookieName() string {
+	name, _ := ConfigMap.Load("sso_session_cookie")
+	return name.(string)
+}
+
+func getSsoSessionMaxAge() int64 {
+	maxAge, _ := strconv.ParseInt(getConfig().Values["sso_session_max_age"], 10, 64)
+	return maxAge
+}
+
+func ssoSessionKey(sessionId string) string {
+	sum := sha256.Sum256([]byte(sessionId))
+	return hex.EncodeToString(sum[:])
+}
+
+// 留空 always 或者秒数
+func isValidReauth(reauth string) bool {
+	if reauth == "" || reauth == "always" {
+		return true
+	}
+	seconds, err := strconv.ParseInt(reauth, 10, 64)
+	return err == nil && seconds > 0
+}
+
+// 扫码成功时调用, 开始新的会话
+func startSsoSession(w http.ResponseWriter, isExternalUser bool, ssoUserInfo SsoUserInfoStruct, userIp, userAgent string) {
+	ssoUserInfo.SsoTicket = ""
+	ssoUserInfo.SsoSessionToken = ""
+	ssoUserByte, err := json.Marshal(ssoUserInfo)
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	maxAge := getSsoSessionMaxAge()
+	sessionId := GetRandomStr(64)
+	MemSsoSessionMap.Store(ssoSessionKey(sessionId), SsoSessionStruct{SsoUser: ssoUserByte, IsExternalUser: isExternalUser, UserAgent: userAgent, Ip: userIp, AuthTime: now, Expired: now + maxAge})
+	domain, _ := ConfigMap.Load("domain")
+	http.SetCookie(w, &http.Cookie{
+		Name:     getSsoSessionCookieName(),
+		Value:    sessionId,
+		Path:     "/",
+		MaxAge:   int(maxAge),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(domain.(string), "https://"),
+		SameSite: http.SameSiteLaxMode, // 钉钉回调和打开扫码页都是顶层跳转, Lax会带上
+	})
+}
+
+// 这个浏览器的会话可以直接登录时返回会话
+func loadSsoSession(req *http.Request, client *ClientStruct, provider, userAgent string) (SsoSessionStruct, SsoUserInfoStruct, bool) {
+	var session SsoSessionStruct
+	var ssoUserInfo SsoUserInfoStruct
+	if !isSsoSessionOn() {
+		return session, ssoUserInfo, false
+	}
+	cookie, err := req.Cookie(getSsoSessionCookieName())
+	if err != nil || cookie.Value == "" {
+		return session, ssoUserInfo, false
+	}
+	temp, ok := MemSsoSessionMap.Load(ssoSessionKey(cookie.Value))
+	if !ok {
+		return session, ssoUserInfo, false
+	}
+	session = temp.(SsoSessionStruct)
+	now := time.Now().Unix()
+	if now >= session.Expired || now >= session.AuthTime+getSsoSessionMaxAge() || session.UserAgent != userAgent {
+		return session, ssoUserInfo, false
+	}
+	if client == nil { // 没登记的业务方postMessage给"*", 任何网页都能不扫码拿到用户信息, 必须扫码
+		return session, ssoUserInfo, false
+	}
+	if client.Reauth != "" { // 业务方的重新认证策略
+		if client.Reauth == "always" {
+			return session, ssoUserInfo, false
+		}
+		if seconds, _ := strconv.ParseInt(client.Reauth, 10, 64); now-session.AuthTime > seconds {
+			return session, ssoUserInfo, false
+		}
+	}
+	if json.Unmarshal(session.SsoUser, &ssoUserInfo) != nil {
+		return session, ssoUserInfo, false
+	}
+	if provider != "" && provider != ssoUserInfo.SsoProvider { // 指定了别的身份提供方, 要扫码
+		return session, ssoUserInfo, false
+	}
+	if isUserForbidden(ssoUserInfo.SsoDingdingUserId, ssoUserInfo.SsoDingdingOpenId) {
+		return session, ssoUserInfo, false
+	}
+	return session, ssoUserInfo, true
+}
+
+// 删除某个用户的所有会话, 返回删除的个数
+func revokeUserSsoSessions(ssoProvider string, userId string) int {
+	var keys []string
+	MemSsoSessionMap.Range(func(key, value interface{}) bool {
+		var ssoUserInfo SsoUserInfoStruct
+		if json.Unmarshal(value.(SsoSessionStruct).SsoUser, &ssoUserInfo) != nil {
+			return true
+		}
+		if ssoUserInfo.SsoProvider == ssoProvider && ssoUserInfo.SsoDingdingUserId == userId {
+			keys = append(keys, key.(string))
+		}
+		return true
+	})
+	for _, key := range keys {
+		MemSsoSessionMap.Delete(key)
+	}
+	return len(keys)
+}
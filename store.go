@@ -0,0 +1,252 @@
+package main
+
+// 会话存储
+// MemMap/MemMapTTL/MemTrustIpMap/MemForbiddenMap 的数据都保存在SessionStore中, 每个map对应一个bucket
+// session_store 配置 memory: 只在内存, 重启丢失   file: 内存+本地追加日志+定期快照, 重启后回放   redis: 多个实例共享, 由redis自动过期
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+)
+
+// expired是过期时间戳, 0表示不过期, 只有NativeExpiry()为true的存储会用到, 其它存储靠clearExpired*协程清理
+type SessionStore interface {
+	Load(bucket, key string) ([]byte, bool)
+	Store(bucket, key string, value []byte, expired int64)
+	Expire(bucket, key string, expired int64)
+	Delete(bucket, key string)
+	LoadAndDelete(bucket, key string) ([]byte, bool) // 原子地取出并删除, 一次性的code/ticket用, 并发时只有一个能取到
+	Range(bucket string, f func(key string, value []byte) bool)
+	NativeExpiry() bool
+	Ping() error // 检查存储是否可用, 给readyz用
+	Close() error
+}
+
+var sessionStore SessionStore = NewMemoryStore()
+
+// 用法和sync.Map一样, 值经过编解码后保存到sessionStore
+type StoreMap struct {
+	bucket  string
+	encode  func(value interface{}) ([]byte, error)
+	decode  func(b []byte) (interface{}, error)
+	expired func(value interface{}) int64 // 值的过期时间戳, 为nil表示不过期
+	linked  string                        // 同一个key在这个bucket的数据跟着一起过期
+}
+
+var MemMap = &StoreMap{bucket: "ticket", encode: encodeBytes, decode: decodeBytes}                                                        // ticket => 用户信息json
+var MemMapTTL = &StoreMap{bucket: "ticket_ttl", encode: encodeInt64, decode: decodeInt64, expired: expiredInt64, linked: "ticket"}        // ticket => 过期时间戳
+var MemTrustIpMap = &StoreMap{bucket: "trust_ip", encode: encodeJson, decode: decodeTrustIp, expired: expiredTrustIp}                     // ip => TrustIpStruct
+var MemForbiddenMap = &StoreMap{bucket: "forbidden", encode: encodeJson, decode: decodeForbidden, expired: expiredForbidden}              // ip或open id => ForbiddenStruct
+var MemClientMap = &StoreMap{bucket: "client", encode: encodeJson, decode: decodeClient}                                                  // client_id => ClientStruct, 管理接口登记的业务方
+var MemTicketClientMap = &StoreMap{bucket: "ticket_client", encode: encodeJson, decode: decodeTicketClient, expired: expiredTicketClient} // ticket => TicketClientStruct
+
+func (m *StoreMap) Load(key interface{}) (interface{}, bool) {
+	b, ok := sessionStore.Load(m.bucket, key.(string))
+	if !ok {
+		return nil, false
+	}
+	value, err := m.decode(b)
+	if err != nil {
+		loger.Println("session store decode error,", m.bucket, key.(string), err.Error())
+		return nil, false
+	}
+	return value, true
+}
+
+func (m *StoreMap) Store(key, value interface{}) {
+	b, err := m.encode(value)
+	if err != nil {
+		loger.Println("session store encode error,", m.bucket, key.(string), err.Error())
+		return
+	}
+	var expired int64
+	if m.expired != nil {
+		expired = m.expired(value)
+	}
+	sessionStore.Store(m.bucket, key.(string), b, expired)
+	if m.linked != "" && expired > 0 {
+		sessionStore.Expire(m.linked, key.(string), expired)
+	}
+}
+
+func (m *StoreMap) Delete(key interface{}) {
+	sessionStore.Delete(m.bucket, key.(string))
+}
+
+// 取出并删除, 同一个key并发调用只有一个返回true
+func (m *StoreMap) LoadAndDelete(key interface{}) (interface{}, bool) {
+	b, ok := sessionStore.LoadAndDelete(m.bucket, key.(string))
+	if !ok {
+		return nil, false
+	}
+	value, err := m.decode(b)
+	if err != nil {
+		loger.Println("session store decode error,", m.bucket, key.(string), err.Error())
+		return nil, false
+	}
+	return value, true
+}
+
+func (m *StoreMap) Range(f func(key, value interface{}) bool) {
+	sessionStore.Range(m.bucket, func(key string, b []byte) bool {
+		value, err := m.decode(b)
+		if err != nil {
+			return true
+		}
+		return f(key, value)
+	})
+}
+
+func encodeBytes(value interface{}) ([]byte, error) {
+	return value.([]byte), nil
+}
+
+func decodeBytes(b []byte) (interface{}, error) {
+	return b, nil
+}
+
+func encodeInt64(value interface{}) ([]byte, error) {
+	return []byte(strconv.FormatInt(value.(int64), 10)), nil
+}
+
+func decodeInt64(b []byte) (interface{}, error) {
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+func expiredInt64(value interface{}) int64 {
+	return value.(int64)
+}
+
+func expiredTrustIp(value interface{}) int64 {
+	return value.(TrustIpStruct).Expired
+}
+
+func expiredForbidden(value interface{}) int64 {
+	return value.(ForbiddenStruct).Expired
+}
+
+func expiredTicketClient(value interface{}) int64 {
+	return value.(TicketClientStruct).Expired
+}
+
+func encodeJson(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func decodeTrustIp(b []byte) (interface{}, error) {
+	var trustIp TrustIpStruct
+	err := json.Unmarshal(b, &trustIp)
+	return trustIp, err
+}
+
+func decodeForbidden(b []byte) (interface{}, error) {
+	var forbidden ForbiddenStruct
+	err := json.Unmarshal(b, &forbidden)
+	return forbidden, err
+}
+
+func decodeClient(b []byte) (interface{}, error) {
+	var client ClientStruct
+	err := json.Unmarshal(b, &client)
+	return client, err
+}
+
+func decodeTicketClient(b []byte) (interface{}, error) {
+	var ticketClient TicketClientStruct
+	err := json.Unmarshal(b, &ticketClient)
+	return ticketClient, err
+}
+
+// 纯内存存储, 每个bucket一个sync.Map
+type MemoryStore struct {
+	buckets sync.Map
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) bucket(name string) *sync.Map {
+	bucket, _ := s.buckets.LoadOrStore(name, &sync.Map{})
+	return bucket.(*sync.Map)
+}
+
+func (s *MemoryStore) Load(bucket, key string) ([]byte, bool) {
+	value, ok := s.bucket(bucket).Load(key)
+	if !ok {
+		return nil, false
+	}
+	return value.([]byte), true
+}
+
+func (s *MemoryStore) Store(bucket, key string, value []byte, expired int64) {
+	s.bucket(bucket).Store(key, value)
+}
+
+func (s *MemoryStore) Expire(bucket, key string, expired int64) {
+}
+
+func (s *MemoryStore) Delete(bucket, key string) {
+	s.bucket(bucket).Delete(key)
+}
+
+func (s *MemoryStore) LoadAndDelete(bucket, key string) ([]byte, bool) {
+	value, ok := s.bucket(bucket).LoadAndDelete(key)
+	if !ok {
+		return nil, false
+	}
+	return value.([]byte), true
+}
+
+func (s *MemoryStore) Range(bucket string, f func(key string, value []byte) bool) {
+	s.bucket(bucket).Range(func(key, value interface{}) bool {
+		return f(key.(string), value.([]byte))
+	})
+}
+
+func (s *MemoryStore) NativeExpiry() bool {
+	return false
+}
+
+func (s *MemoryStore) Ping() error {
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// 按配置打开会话存储, 在读取配置之后, 启动清理协程之前调用
+func openSessionStore() {
+	storeType := getConfig().SessionStore
+	switch storeType {
+	case "memory":
+		sessionStore = NewMemoryStore()
+	case "file":
+		dir := "./data"
+		if temp, ok := ConfigMap.Load("session_store_dir"); ok && temp.(string) != "" {
+			dir = temp.(string)
+		}
+		snapshotInterval := 300
+		if temp, ok := ConfigMap.Load("session_store_snapshot_interval"); ok {
+			if interval, err := strconv.Atoi(temp.(string)); err == nil && interval > 0 {
+				snapshotInterval = interval
+			}
+		}
+		store, err := NewFileStore(dir, snapshotInterval)
+		if err != nil {
+			panic("session store open error: " + err.Error())
+		}
+		sessionStore = store
+	case "redis":
+		store, err := NewRedisStore()
+		if err != nil {
+			panic("session store open error: " + err.Error())
+		}
+		sessionStore = store
+	default:
+		panic("config session_store not valid")
+	}
+	loger.Println("session store:", storeType)
+}
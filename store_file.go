@@ -0,0 +1,303 @@
+package main
+
+// 本地文件会话存储
+// 数据全部在内存中, 每次修改追加一行到journal.log, 定期把内存写成snapshot.json并清空journal.log
+// 启动时先读snapshot.json再回放journal.log, 重启后ticket/可信ip/屏蔽列表都还在
+// 每条journal写完都fsync, 进程崩溃或者断电最多丢正在写的那一条
+// access_token桶(钉钉/企业微信/飞书的accessToken)只放内存不落盘, 重启后重新获取; 其它数据明文保存, 目录和文件只有本用户能读
+// 带过期时间的数据在写快照时清掉, 没有clearExpired*协程的桶也不会一直留在文件里
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type FileStore struct {
+	*MemoryStore
+	dir          string
+	mutex        sync.Mutex       // 保证journal的顺序和快照的一致性
+	expires      map[string]int64 // bucket + "\x00" + key => 过期时间戳, 只记有过期时间的
+	journal      *os.File
+	stopSnapshot chan struct{}
+}
+
+type fileStoreRecord struct {
+	Op      string `json:"op"` // set del 或 exp
+	Bucket  string `json:"b"`
+	Key     string `json:"k"`
+	Value   []byte `json:"v,omitempty"`
+	Expired int64  `json:"e,omitempty"`
+}
+
+// 快照里的一条数据, 老版本的快照只有值没有过期时间
+type fileStoreEntry struct {
+	Value   []byte `json:"v"`
+	Expired int64  `json:"e,omitempty"`
+}
+
+// 不落盘的桶, 里面是第三方接口的密钥, 丢了可以重新获取
+var fileStoreMemoryOnlyBuckets = map[string]bool{"access_token": true}
+
+func NewFileStore(dir string, snapshotInterval int) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &FileStore{
+		MemoryStore:  NewMemoryStore(),
+		dir:          dir,
+		expires:      make(map[string]int64),
+		stopSnapshot: make(chan struct{}),
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	// 回放完马上做一次快照, journal从空文件开始
+	if err := s.Snapshot(); err != nil {
+		return nil, err
+	}
+	go s.snapshotLoop(time.Duration(snapshotInterval) * time.Second)
+	return s, nil
+}
+
+func (s *FileStore) snapshotPath() string {
+	return filepath.Join(s.dir, "snapshot.json")
+}
+
+func (s *FileStore) journalPath() string {
+	return filepath.Join(s.dir, "journal.log")
+}
+
+func (s *FileStore) replay() error {
+	b, err := ioutil.ReadFile(s.snapshotPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		snapshot := make(map[string]map[string]json.RawMessage)
+		if err := json.Unmarshal(b, &snapshot); err != nil {
+			return err
+		}
+		for bucket, kv := range snapshot {
+			for key, raw := range kv {
+				var entry fileStoreEntry
+				if len(raw) > 0 && raw[0] == '"' { // 老版本快照, 值是base64字符串
+					err = json.Unmarshal(raw, &entry.Value)
+				} else {
+					err = json.Unmarshal(raw, &entry)
+				}
+				if err != nil {
+					return err
+				}
+				s.set(bucket, key, entry.Value, entry.Expired)
+			}
+		}
+	}
+
+	fd, err := os.Open(s.journalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fd.Close()
+	count := 0
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record fileStoreRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			loger.Println("file store journal skip broken line:", err.Error()) // 进程被杀时最后一行可能不完整
+			continue
+		}
+		switch record.Op {
+		case "set":
+			s.set(record.Bucket, record.Key, record.Value, record.Expired)
+		case "del":
+			s.del(record.Bucket, record.Key)
+		case "exp":
+			if _, ok := s.MemoryStore.Load(record.Bucket, record.Key); ok {
+				s.expires[record.Bucket+"\x00"+record.Key] = record.Expired
+			}
+		}
+		count++
+	}
+	loger.Println("file store replay", count, "journal records from", s.dir)
+	return scanner.Err()
+}
+
+// 写一行并fsync, 调用前要持有mutex
+func (s *FileStore) appendJournal(record fileStoreRecord) {
+	if fileStoreMemoryOnlyBuckets[record.Bucket] {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		loger.Println("file store journal encode error:", err.Error())
+		return
+	}
+	if _, err := s.journal.Write(append(line, '\n')); err != nil {
+		loger.Println("file store journal write error:", err.Error())
+		return
+	}
+	if err := s.journal.Sync(); err != nil {
+		loger.Println("file store journal sync error:", err.Error())
+	}
+}
+
+// 修改内存数据和过期时间, 调用前要持有mutex
+func (s *FileStore) set(bucket, key string, value []byte, expired int64) {
+	s.MemoryStore.Store(bucket, key, value, expired)
+	if expired > 0 {
+		s.expires[bucket+"\x00"+key] = expired
+	} else {
+		delete(s.expires, bucket+"\x00"+key)
+	}
+}
+
+func (s *FileStore) del(bucket, key string) {
+	s.MemoryStore.Delete(bucket, key)
+	delete(s.expires, bucket+"\x00"+key)
+}
+
+func (s *FileStore) Store(bucket, key string, value []byte, expired int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.set(bucket, key, value, expired)
+	s.appendJournal(fileStoreRecord{Op: "set", Bucket: bucket, Key: key, Value: value, Expired: expired})
+}
+
+// ticket桶跟着ticket_ttl一起过期
+func (s *FileStore) Expire(bucket, key string, expired int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.MemoryStore.Load(bucket, key); !ok {
+		return
+	}
+	s.expires[bucket+"\x00"+key] = expired
+	s.appendJournal(fileStoreRecord{Op: "exp", Bucket: bucket, Key: key, Expired: expired})
+}
+
+func (s *FileStore) Delete(bucket, key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.MemoryStore.Load(bucket, key); !ok {
+		return
+	}
+	s.del(bucket, key)
+	s.appendJournal(fileStoreRecord{Op: "del", Bucket: bucket, Key: key})
+}
+
+func (s *FileStore) LoadAndDelete(bucket, key string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.MemoryStore.LoadAndDelete(bucket, key)
+	if !ok {
+		return nil, false
+	}
+	delete(s.expires, bucket+"\x00"+key)
+	s.appendJournal(fileStoreRecord{Op: "del", Bucket: bucket, Key: key})
+	return value, true
+}
+
+// 内存数据写入快照文件, 然后清空journal, 已经过期的数据顺便删掉
+func (s *FileStore) Snapshot() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().Unix()
+	var expiredKeys [][2]string
+	snapshot := make(map[string]map[string]fileStoreEntry)
+	s.MemoryStore.buckets.Range(func(bucket, _ interface{}) bool {
+		kv := make(map[string]fileStoreEntry)
+		s.MemoryStore.Range(bucket.(string), func(key string, value []byte) bool {
+			expired := s.expires[bucket.(string)+"\x00"+key]
+			if expired > 0 && now >= expired {
+				expiredKeys = append(expiredKeys, [2]string{bucket.(string), key})
+				return true
+			}
+			kv[key] = fileStoreEntry{Value: value, Expired: expired}
+			return true
+		})
+		if !fileStoreMemoryOnlyBuckets[bucket.(string)] {
+			snapshot[bucket.(string)] = kv
+		}
+		return true
+	})
+	for _, bucketKey := range expiredKeys {
+		s.del(bucketKey[0], bucketKey[1])
+	}
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.snapshotPath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		return err
+	}
+	fd, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.snapshotPath()); err != nil {
+		return err
+	}
+
+	journal, err := os.OpenFile(s.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if s.journal != nil {
+		s.journal.Close()
+	}
+	s.journal = journal
+	return nil
+}
+
+func (s *FileStore) snapshotLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Snapshot(); err != nil {
+				loger.Println("file store snapshot error:", err.Error())
+			}
+		case <-s.stopSnapshot:
+			return
+		}
+	}
+}
+
+// journal被关闭或者文件被删除时不可用
+func (s *FileStore) Ping() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.journal.Stat(); err != nil {
+		return err
+	}
+	_, err := os.Stat(s.journalPath())
+	return err
+}
+
+// 退出前写一次快照
+func (s *FileStore) Close() error {
+	close(s.stopSnapshot)
+	if err := s.Snapshot(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.journal.Close()
+}
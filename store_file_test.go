@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFileStore(t *testing.T, dir string) *FileStore {
+	t.Helper()
+	store, err := NewFileStore(dir, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// accessToken不落盘, 过期的数据写快照时删掉, 重启后过期时间还在
+func TestFileStoreSnapshotAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestFileStore(t, dir)
+	now := time.Now().Unix()
+	store.Store("access_token", "dingtalk", []byte(`{"token":"app-token-secret"}`), now+7200)
+	store.Store("client", "admin", []byte("forever"), 0)
+	store.Store("token_revoked", "old", []byte("gone"), now-1)
+	store.Store("token_revoked", "new", []byte("kept"), now+600)
+	store.Store("ticket", "t1", []byte("user"), 0)
+	store.Expire("ticket", "t1", now-1) // 跟着ticket_ttl过期
+
+	journal, err := ioutil.ReadFile(filepath.Join(dir, "journal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(journal), "access_token") {
+		t.Fatalf("access_token written to journal: %s", journal)
+	}
+
+	if err := store.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Load("token_revoked", "old"); ok {
+		t.Error("expired token_revoked kept after snapshot")
+	}
+	if _, ok := store.Load("ticket", "t1"); ok {
+		t.Error("expired ticket kept after snapshot")
+	}
+	if _, ok := store.Load("access_token", "dingtalk"); !ok {
+		t.Error("access_token dropped from memory")
+	}
+	snapshot, err := ioutil.ReadFile(filepath.Join(dir, "snapshot.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(snapshot), "access_token") {
+		t.Fatalf("access_token written to snapshot: %s", snapshot)
+	}
+
+	store.Store("trust_ip", "192.0.2.1", []byte("ip"), now-1) // 只在journal里
+	if err := store.journal.Close(); err != nil {             // 模拟进程被杀, 不写退出前的快照
+		t.Fatal(err)
+	}
+	close(store.stopSnapshot)
+
+	store = newTestFileStore(t, dir)
+	defer store.Close()
+	if value, ok := store.Load("client", "admin"); !ok || string(value) != "forever" {
+		t.Errorf("client after restart = %q, %v", value, ok)
+	}
+	if value, ok := store.Load("token_revoked", "new"); !ok || string(value) != "kept" {
+		t.Errorf("token_revoked after restart = %q, %v", value, ok)
+	}
+	if _, ok := store.Load("trust_ip", "192.0.2.1"); ok {
+		t.Error("expired journal record kept after restart")
+	}
+	if _, ok := store.Load("access_token", "dingtalk"); ok {
+		t.Error("access_token restored from disk")
+	}
+	if store.expires["token_revoked\x00new"] != now+600 {
+		t.Errorf("expiry after restart = %d, want %d", store.expires["token_revoked\x00new"], now+600)
+	}
+}
+
+// 老版本的快照只有值
+func TestFileStoreOldSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "snapshot.json"), []byte(`{"ticket":{"t1":"dXNlcg=="}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := newTestFileStore(t, dir)
+	defer store.Close()
+	if value, ok := store.Load("ticket", "t1"); !ok || string(value) != "user" {
+		t.Errorf("ticket = %q, %v", value, ok)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+// redis会话存储, 多个实例部署在负载均衡后面时共享ticket/可信ip/屏蔽列表/钉钉accessToken
+// key格式 redis_key_prefix + bucket + ":" + key, 有过期时间的key由redis自动过期, 不需要clearExpired*协程
+// 只用到 GET SET DEL GETDEL EXPIREAT SCAN PING 几个命令, 自己实现RESP协议, 不引入第三方库
+// redis 2.8以上都能用, 6.2以下没有GETDEL时自动改用GET+DEL
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type RedisStore struct {
+	addr     string
+	password string
+	db       string
+	prefix   string
+	idle     chan *redisConn // 空闲连接池
+	noGetdel atomic.Bool     // redis版本低于6.2, 不支持GETDEL
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func NewRedisStore() (*RedisStore, error) {
+	s := &RedisStore{
+		addr:   "127.0.0.1:6379",
+		prefix: "dingding-sso:",
+		idle:   make(chan *redisConn, 16),
+	}
+	if temp, ok := ConfigMap.Load("redis_addr"); ok && temp.(string) != "" {
+		s.addr = temp.(string)
+	}
+	if temp, ok := ConfigMap.Load("redis_password"); ok {
+		s.password = temp.(string)
+	}
+	if temp, ok := ConfigMap.Load("redis_db"); ok {
+		s.db = temp.(string)
+	}
+	if temp, ok := ConfigMap.Load("redis_key_prefix"); ok {
+		s.prefix = temp.(string)
+	}
+
+	if s.addr == "embedded" { // 进程内的redis替身, 本地开发和测试用, 数据不共享也不持久
+		addr, err := StartEmbeddedRedis("127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		s.addr = addr
+		loger.Println("embedded redis listen on", addr)
+	}
+
+	if _, err := s.do("PING"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *RedisStore) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, time.Second*3)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if s.password != "" {
+		if _, err := c.do("AUTH", s.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.db != "" && s.db != "0" {
+		if _, err := c.do("SELECT", s.db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// 从连接池取一个连接执行命令, 网络错误的连接直接丢弃
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	var c *redisConn
+	select {
+	case c = <-s.idle:
+	default:
+		var err error
+		c, err = s.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.do(args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(time.Second * 3))
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.reader)
+}
+
+// 解析一个RESP回复, 字符串返回string, 整数返回int64, bulk返回[]byte(nil表示不存在), 数组返回[]interface{}
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: protocol error " + strconv.Quote(line))
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errors.New("redis: protocol error " + strconv.Quote(line))
+}
+
+func (s *RedisStore) key(bucket, key string) string {
+	return s.prefix + bucket + ":" + key
+}
+
+func (s *RedisStore) Load(bucket, key string) ([]byte, bool) {
+	reply, err := s.do("GET", s.key(bucket, key))
+	if err != nil {
+		loger.Println("redis GET error:", err.Error())
+		return nil, false
+	}
+	value, ok := reply.([]byte)
+	return value, ok && value != nil
+}
+
+func (s *RedisStore) Store(bucket, key string, value []byte, expired int64) {
+	var err error
+	if expired > 0 {
+		if expired <= time.Now().Unix() { // 已经过期的直接删除
+			s.Delete(bucket, key)
+			return
+		}
+		// EXAT要redis 6.2以上, 换算成剩余秒数用EX
+		_, err = s.do("SET", s.key(bucket, key), string(value), "EX", strconv.FormatInt(expired-time.Now().Unix(), 10))
+	} else {
+		_, err = s.do("SET", s.key(bucket, key), string(value))
+	}
+	if err != nil {
+		loger.Println("redis SET error:", err.Error())
+	}
+}
+
+func (s *RedisStore) Expire(bucket, key string, expired int64) {
+	if _, err := s.do("EXPIREAT", s.key(bucket, key), strconv.FormatInt(expired, 10)); err != nil {
+		loger.Println("redis EXPIREAT error:", err.Error())
+	}
+}
+
+func (s *RedisStore) Delete(bucket, key string) {
+	if _, err := s.do("DEL", s.key(bucket, key)); err != nil {
+		loger.Println("redis DEL error:", err.Error())
+	}
+}
+
+// GETDEL要redis 6.2以上, 老版本返回unknown command时改用GET+DEL, DEL返回1的才算取到, 并发时同样只有一个能取到
+func (s *RedisStore) LoadAndDelete(bucket, key string) ([]byte, bool) {
+	if !s.noGetdel.Load() {
+		reply, err := s.do("GETDEL", s.key(bucket, key))
+		if err == nil {
+			value, ok := reply.([]byte)
+			return value, ok && value != nil
+		}
+		if !strings.Contains(strings.ToLower(err.Error()), "unknown command") {
+			loger.Println("redis GETDEL error:", err.Error())
+			return nil, false
+		}
+		s.noGetdel.Store(true)
+	}
+	value, ok := s.Load(bucket, key)
+	if !ok {
+		return nil, false
+	}
+	reply, err := s.do("DEL", s.key(bucket, key))
+	if err != nil {
+		loger.Println("redis DEL error:", err.Error())
+		return nil, false
+	}
+	if deleted, _ := reply.(int64); deleted != 1 { // 被别的请求抢先删了
+		return nil, false
+	}
+	return value, true
+}
+
+// SCAN遍历bucket下的所有key, 遍历过程中被删除或过期的key会跳过
+func (s *RedisStore) Range(bucket string, f func(key string, value []byte) bool) {
+	prefix := s.key(bucket, "")
+	match := redisGlobEscape(prefix) + "*"
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", match, "COUNT", "200")
+		if err != nil {
+			loger.Println("redis SCAN error:", err.Error())
+			return
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return
+		}
+		nextCursor, _ := items[0].([]byte)
+		keys, _ := items[1].([]interface{})
+		for _, temp := range keys {
+			fullKey, _ := temp.([]byte)
+			key := strings.TrimPrefix(string(fullKey), prefix)
+			value, ok := s.Load(bucket, key)
+			if !ok {
+				continue
+			}
+			if !f(key, value) {
+				return
+			}
+		}
+		cursor = string(nextCursor)
+		if cursor == "0" || cursor == "" {
+			return
+		}
+	}
+}
+
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *RedisStore) NativeExpiry() bool {
+	return true
+}
+
+func (s *RedisStore) Ping() error {
+	_, err := s.do("PING")
+	return err
+}
+
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestRedisStore(t *testing.T) *RedisStore {
+	t.Helper()
+	addr, err := StartEmbeddedRedis("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, map[string]string{"session_store": "redis", "redis_addr": addr, "redis_key_prefix": "test:"})
+	store, err := NewRedisStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := sessionStore
+	sessionStore = store
+	t.Cleanup(func() {
+		sessionStore = old
+		store.Close()
+	})
+	return store
+}
+
+// 等到时间戳expired之后
+func sleepUntil(expired int64) {
+	time.Sleep(time.Until(time.Unix(expired, 0)) + time.Millisecond*100)
+}
+
+func TestRedisStoreLoadStoreDelete(t *testing.T) {
+	store := newTestRedisStore(t)
+
+	if _, ok := store.Load("ticket", "missing"); ok {
+		t.Fatal("missing key loaded")
+	}
+	store.Store("ticket", "t1", []byte(`{"sso_name":"张三"}`), 0)
+	value, ok := store.Load("ticket", "t1")
+	if !ok || string(value) != `{"sso_name":"张三"}` {
+		t.Fatalf("load = %q, %v", value, ok)
+	}
+	if _, ok := store.Load("ticket_ttl", "t1"); ok {
+		t.Fatal("other bucket loaded the same key")
+	}
+	store.Store("ticket", "t1", []byte("v2"), 0)
+	if value, _ := store.Load("ticket", "t1"); string(value) != "v2" {
+		t.Fatalf("overwrite = %q", value)
+	}
+	store.Delete("ticket", "t1")
+	if _, ok := store.Load("ticket", "t1"); ok {
+		t.Fatal("deleted key loaded")
+	}
+	store.Store("ticket", "t2", []byte("v"), time.Now().Unix()-1) // 已经过期的不保存
+	if _, ok := store.Load("ticket", "t2"); ok {
+		t.Fatal("expired key stored")
+	}
+}
+
+func TestRedisStoreRange(t *testing.T) {
+	store := newTestRedisStore(t)
+
+	keys := []string{"a", "b*", "c?d", `e\f`, "[g]"} // glob特殊字符要转义
+	for _, key := range keys {
+		store.Store("trust_ip", key, []byte(key), 0)
+	}
+	store.Store("trust_ip_other", "x", []byte("x"), 0)
+	store.Store("trust", "_ip:y", []byte("y"), 0)
+
+	var got []string
+	store.Range("trust_ip", func(key string, value []byte) bool {
+		if key != string(value) {
+			t.Errorf("key %q value %q", key, value)
+		}
+		got = append(got, key)
+		return true
+	})
+	sort.Strings(got)
+	sort.Strings(keys)
+	if len(got) != len(keys) {
+		t.Fatalf("range = %q, want %q", got, keys)
+	}
+	for i := range keys {
+		if got[i] != keys[i] {
+			t.Fatalf("range = %q, want %q", got, keys)
+		}
+	}
+
+	count := 0
+	store.Range("trust_ip", func(key string, value []byte) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Fatalf("range did not stop, called %d times", count)
+	}
+}
+
+func TestRedisStoreExpireAt(t *testing.T) {
+	newTestRedisStore(t)
+
+	expired := time.Now().Unix() + 1
+	MemTrustIpMap.Store("10.0.0.1", TrustIpStruct{TotalLoginCount: 3, Expired: expired})
+	MemTrustIpMap.Store("10.0.0.2", TrustIpStruct{TotalLoginCount: 1, Expired: expired + 60})
+	value, ok := MemTrustIpMap.Load("10.0.0.1")
+	if !ok || value.(TrustIpStruct).TotalLoginCount != 3 {
+		t.Fatalf("load = %v, %v", value, ok)
+	}
+	sleepUntil(expired)
+	if _, ok := MemTrustIpMap.Load("10.0.0.1"); ok {
+		t.Fatal("key not expired at expired")
+	}
+	if _, ok := MemTrustIpMap.Load("10.0.0.2"); !ok {
+		t.Fatal("key expired too early")
+	}
+}
+
+func TestRedisStoreTicketLinkedExpiry(t *testing.T) {
+	newTestRedisStore(t)
+
+	expired := time.Now().Unix() + 1
+	MemMap.Store("t1", []byte("user1"))
+	MemMapTTL.Store("t1", expired) // ticket跟着ticket_ttl一起过期
+	MemMap.Store("t2", []byte("user2"))
+	MemMapTTL.Store("t2", expired+60)
+
+	// 离职校验/钉钉推送刷新用户信息时重新SET会清掉过期时间, 要重新设置
+	MemMap.Store("t1", []byte("user1 refreshed"))
+	ttl, _ := MemMapTTL.Load("t1")
+	sessionStore.Expire("ticket", "t1", ttl.(int64))
+
+	if value, ok := MemMap.Load("t1"); !ok || string(value.([]byte)) != "user1 refreshed" {
+		t.Fatalf("load = %v, %v", value, ok)
+	}
+	sleepUntil(expired)
+	if _, ok := MemMap.Load("t1"); ok {
+		t.Fatal("ticket not expired with ticket_ttl")
+	}
+	if _, ok := MemMapTTL.Load("t1"); ok {
+		t.Fatal("ticket_ttl not expired")
+	}
+	if value, ok := MemMap.Load("t2"); !ok || string(value.([]byte)) != "user2" {
+		t.Fatalf("t2 = %v, %v", value, ok)
+	}
+	if value, ok := MemMapTTL.Load("t2"); !ok || value.(int64) != expired+60 {
+		t.Fatalf("t2 ttl = %v, %v, want %d", value, ok, expired+60)
+	}
+}
+
+// 一次性的code并发兑换只能有一个取到, 不支持GETDEL的老版本redis也一样
+func TestRedisStoreLoadAndDelete(t *testing.T) {
+	store := newTestRedisStore(t)
+	for _, noGetdel := range []bool{false, true} {
+		store.noGetdel.Store(noGetdel)
+		store.Store("oidc_code", "c1", []byte("v"), time.Now().Unix()+60)
+		var taken int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if value, ok := store.LoadAndDelete("oidc_code", "c1"); ok && string(value) == "v" {
+					atomic.AddInt32(&taken, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if taken != 1 {
+			t.Fatalf("noGetdel=%v: taken %d times, want 1", noGetdel, taken)
+		}
+		if _, ok := store.Load("oidc_code", "c1"); ok {
+			t.Fatalf("noGetdel=%v: key still exists", noGetdel)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+// ticket格式
+// v1: 13位毫秒 + 4位自增id + sha256(毫秒 自增id UA ip 10000+ttl) + 10000+ttl, 固定86个字符, 只能用ticket_hash_secret校验
+//   16290920600601001cae543b91ca4278a80d8a3519550e2113ea609bb8e5604376cbacd95e845c8ae10300
+// v2: v2.密钥id.base64url(8字节毫秒 + 4字节ttl + 16字节随机数 + 32字节hmac), hmac = sha256(v2 密钥id 前28字节的base64url UA ip)
+//   v2.0.AAABkp5e8pAAAAEsq3kF...
+// 密钥环: ticket_hash_secret 是密钥id 0, ticket_key:id 配置其它密钥, ticket_key_id 选择生成ticket用的密钥
+//   校验时按ticket里的密钥id找密钥, v1没有密钥id, 挨个试密钥环里的所有密钥
+//   换密钥: 加一行 ticket_key:新id, ticket_key_id 改成新id, 等 ticket_max_ttl 秒后再删掉旧的, 已经登录的用户不用重新扫码
+// ticket_format 默认v1, 有的业务方会校验ticket长度, 确认没有后再改成v2, 两种格式都能校验
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ticketV2Prefix = "v2."
+const ticketV2PayloadLen = 8 + 4 + 16 // 毫秒 + ttl + 随机数
+
+func generateTicket(userAgent, userIp string, ttl int) string {
+	config := getConfig()
+	if config.TicketFormat == "v1" {
+		return generateTicketV1(config.TicketKeys["0"], userAgent, userIp, ttl)
+	}
+	return generateTicketV2(config.TicketKeyId, config.TicketKeys[config.TicketKeyId], userAgent, userIp, ttl)
+}
+
+func generateTicketV1(key, userAgent, userIp string, ttl int) string {
+	now := time.Now().UnixNano() / 1e6
+	counter := GetCounterInt()
+	checksum := hex.EncodeToString(Sha256(fmt.Sprintf("%d %d %s %s %d", now, counter, userAgent, userIp, 10000+ttl), key))
+	return fmt.Sprintf("%d%d%s%d", now, counter, checksum, 10000+ttl)
+}
+
+func generateTicketV2(keyId, key, userAgent, userIp string, ttl int) string {
+	payload := make([]byte, ticketV2PayloadLen)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(time.Now().UnixNano()/1e6))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(ttl))
+	if _, err := io.ReadFull(rand.Reader, payload[12:]); err != nil {
+		panic(err)
+	}
+	checksum := ticketV2Checksum(keyId, key, payload, userAgent, userIp)
+	return ticketV2Prefix + keyId + "." + base64.RawURLEncoding.EncodeToString(append(payload, checksum...))
+}
+
+func ticketV2Checksum(keyId, key string, payload []byte, userAgent, userIp string) []byte {
+	return Sha256(fmt.Sprintf("v2 %s %s %s %s", keyId, base64.RawURLEncoding.EncodeToString(payload), userAgent, userIp), key)
+}
+
+// 返回ticket是否有效和生成时的ttl, where == "scan" 时还要求是100秒内生成的
+func checkTicket(tocheck, userAgent, userIp, where string) (bool, int) {
+	var ok bool
+	var issued int64 // 生成时间, 毫秒
+	var ttl int
+	if strings.HasPrefix(tocheck, ticketV2Prefix) {
+		ok, issued, ttl = checkTicketV2(tocheck, userAgent, userIp)
+	} else {
+		ok, issued, ttl = checkTicketV1(tocheck, userAgent, userIp)
+	}
+	if !ok {
+		return false, 0
+	}
+	if where == "scan" && issued/1000+100 < time.Now().Unix() { // 给扫码的用户100秒扫码时间
+		return false, 0
+	}
+	return true, ttl
+}
+
+func checkTicketV1(tocheck, userAgent, userIp string) (bool, int64, int) {
+	if len(tocheck) != 86 {
+		return false, 0, 0
+	}
+	now := tocheck[:13]
+	counter := tocheck[13:17]
+	ttl := tocheck[17+64:]
+	issued, err := strconv.ParseInt(now, 10, 64)
+	if err != nil {
+		return false, 0, 0
+	}
+	ttlInt, err := strconv.Atoi(ttl)
+	if err != nil {
+		return false, 0, 0
+	}
+	checksum, err := hex.DecodeString(tocheck[17 : 17+64])
+	if err != nil {
+		return false, 0, 0
+	}
+	for _, key := range getConfig().TicketKeys {
+		realCheckSum := Sha256(fmt.Sprintf("%s %s %s %s %s", now, counter, userAgent, userIp, ttl), key)
+		if hmac.Equal(realCheckSum, checksum) {
+			return true, issued, ttlInt - 10000
+		}
+	}
+	return false, 0, 0
+}
+
+func checkTicketV2(tocheck, userAgent, userIp string) (bool, int64, int) {
+	parts := strings.Split(strings.TrimPrefix(tocheck, ticketV2Prefix), ".")
+	if len(parts) != 2 {
+		return false, 0, 0
+	}
+	keyId := parts[0]
+	key, ok := getConfig().TicketKeys[keyId]
+	if !ok { // 密钥已经从密钥环删掉了
+		return false, 0, 0
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(b) != ticketV2PayloadLen+32 {
+		return false, 0, 0
+	}
+	payload, checksum := b[:ticketV2PayloadLen], b[ticketV2PayloadLen:]
+	if !hmac.Equal(ticketV2Checksum(keyId, key, payload, userAgent, userIp), checksum) {
+		return false, 0, 0
+	}
+	return true, int64(binary.BigEndian.Uint64(payload[0:8])), int(binary.BigEndian.Uint32(payload[8:12]))
+}
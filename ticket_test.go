@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testUserAgent = "Mozilla/5.0 test"
+const testUserIp = "192.0.2.1"
+
+// 生成时间可以指定的v2 ticket, 用来测试扫码的100秒
+func generateTicketV2At(keyId, key string, issued time.Time, ttl int) string {
+	payload := make([]byte, ticketV2PayloadLen)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(issued.UnixNano()/1e6))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(ttl))
+	checksum := ticketV2Checksum(keyId, key, payload, testUserAgent, testUserIp)
+	return ticketV2Prefix + keyId + "." + base64.RawURLEncoding.EncodeToString(append(payload, checksum...))
+}
+
+func generateTicketV1At(key string, issued time.Time, ttl int) string {
+	now := issued.UnixNano() / 1e6
+	checksum := Sha256(fmt.Sprintf("%d %d %s %s %d", now, 1001, testUserAgent, testUserIp, 10000+ttl), key)
+	return fmt.Sprintf("%d%d%x%d", now, 1001, checksum, 10000+ttl)
+}
+
+func TestTicketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   map[string]string
+		prefix   string
+		length   int
+		ttl      int
+		checkUa  string
+		checkIp  string
+		where    string
+		wantOk   bool
+		wantTtl  int
+		generate func(config *Config) string // 为nil时用generateTicket
+	}{
+		{name: "v1", config: map[string]string{"ticket_format": "v1"}, length: 86, ttl: 30, checkUa: testUserAgent, checkIp: testUserIp, where: "fetch", wantOk: true, wantTtl: 30},
+		{name: "v1 scan", config: map[string]string{"ticket_format": "v1"}, length: 86, ttl: 3600, checkUa: testUserAgent, checkIp: testUserIp, where: "scan", wantOk: true, wantTtl: 3600},
+		{name: "v2", config: map[string]string{"ticket_format": "v2"}, prefix: "v2.0.", ttl: 30, checkUa: testUserAgent, checkIp: testUserIp, where: "fetch", wantOk: true, wantTtl: 30},
+		{name: "v2 other key id", config: map[string]string{"ticket_format": "v2", "ticket_key:k1": "another secret", "ticket_key_id": "k1"}, prefix: "v2.k1.", ttl: 86400, checkUa: testUserAgent, checkIp: testUserIp, where: "scan", wantOk: true, wantTtl: 86400},
+		{name: "v1 user agent mismatch", config: map[string]string{"ticket_format": "v1"}, length: 86, ttl: 30, checkUa: testUserAgent + " ", checkIp: testUserIp, where: "fetch"},
+		{name: "v1 ip mismatch", config: map[string]string{"ticket_format": "v1"}, length: 86, ttl: 30, checkUa: testUserAgent, checkIp: "192.0.2.2", where: "fetch"},
+		{name: "v2 user agent mismatch", config: map[string]string{"ticket_format": "v2"}, prefix: "v2.0.", ttl: 30, checkUa: "curl", checkIp: testUserIp, where: "fetch"},
+		{name: "v2 ip mismatch", config: map[string]string{"ticket_format": "v2"}, prefix: "v2.0.", ttl: 30, checkUa: testUserAgent, checkIp: "2001:db8::1", where: "fetch"},
+		{name: "v1 issued 99s ago scan", config: map[string]string{}, ttl: 30, checkUa: testUserAgent, checkIp: testUserIp, where: "scan", wantOk: true, wantTtl: 30, generate: func(config *Config) string {
+			return generateTicketV1At(config.TicketKeys["0"], time.Now().Add(-99*time.Second), 30)
+		}},
+		{name: "v1 issued 101s ago scan", config: map[string]string{}, ttl: 30, checkUa: testUserAgent, checkIp: testUserIp, where: "scan", generate: func(config *Config) string {
+			return generateTicketV1At(config.TicketKeys["0"], time.Now().Add(-101*time.Second), 30)
+		}},
+		{name: "v2 issued 99s ago scan", config: map[string]string{}, ttl: 30, checkUa: testUserAgent, checkIp: testUserIp, where: "scan", wantOk: true, wantTtl: 30, generate: func(config *Config) string {
+			return generateTicketV2At("0", config.TicketKeys["0"], time.Now().Add(-99*time.Second), 30)
+		}},
+		{name: "v2 issued 101s ago scan", config: map[string]string{}, ttl: 30, checkUa: testUserAgent, checkIp: testUserIp, where: "scan", generate: func(config *Config) string {
+			return generateTicketV2At("0", config.TicketKeys["0"], time.Now().Add(-101*time.Second), 30)
+		}},
+		{name: "v2 issued 101s ago fetch", config: map[string]string{}, ttl: 30, checkUa: testUserAgent, checkIp: testUserIp, where: "fetch", wantOk: true, wantTtl: 30, generate: func(config *Config) string {
+			return generateTicketV2At("0", config.TicketKeys["0"], time.Now().Add(-101*time.Second), 30)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := setTestConfig(t, test.config)
+			var ticket string
+			if test.generate != nil {
+				ticket = test.generate(config)
+			} else {
+				ticket = generateTicket(testUserAgent, testUserIp, test.ttl)
+			}
+			if test.length > 0 && len(ticket) != test.length {
+				t.Fatalf("ticket %s length = %d, want %d", ticket, len(ticket), test.length)
+			}
+			if test.prefix != "" && !strings.HasPrefix(ticket, test.prefix) {
+				t.Fatalf("ticket %s, want prefix %s", ticket, test.prefix)
+			}
+			ok, ttl := checkTicket(ticket, test.checkUa, test.checkIp, test.where)
+			if ok != test.wantOk || ttl != test.wantTtl {
+				t.Fatalf("checkTicket(%s) = %v, %d, want %v, %d", ticket, ok, ttl, test.wantOk, test.wantTtl)
+			}
+		})
+	}
+}
+
+// 换密钥: 旧密钥还在密钥环里时旧ticket继续有效, 删掉后失效
+func TestTicketKeyRotation(t *testing.T) {
+	setTestConfig(t, map[string]string{"ticket_format": "v2", "ticket_key:old": "old secret", "ticket_key_id": "old"})
+	oldV2 := generateTicket(testUserAgent, testUserIp, 60)
+	setTestConfig(t, map[string]string{"ticket_format": "v1", "ticket_key:old": "old secret", "ticket_key_id": "old"})
+	v1 := generateTicket(testUserAgent, testUserIp, 60) // v1固定用ticket_hash_secret
+
+	setTestConfig(t, map[string]string{"ticket_format": "v2", "ticket_key:old": "old secret", "ticket_key:new": "new secret", "ticket_key_id": "new"})
+	newV2 := generateTicket(testUserAgent, testUserIp, 60)
+	if !strings.HasPrefix(newV2, "v2.new.") {
+		t.Fatalf("ticket %s, want key id new", newV2)
+	}
+	for _, ticket := range []string{oldV2, v1, newV2} {
+		if ok, _ := checkTicket(ticket, testUserAgent, testUserIp, "fetch"); !ok {
+			t.Fatalf("ticket %s not valid while key is in keyring", ticket)
+		}
+	}
+
+	// 旧密钥删掉以后
+	setTestConfig(t, map[string]string{"ticket_format": "v2", "ticket_key:new": "new secret", "ticket_key_id": "new"})
+	if ok, _ := checkTicket(oldV2, testUserAgent, testUserIp, "fetch"); ok {
+		t.Fatalf("ticket %s valid after key old rotated out", oldV2)
+	}
+	for _, ticket := range []string{v1, newV2} {
+		if ok, _ := checkTicket(ticket, testUserAgent, testUserIp, "fetch"); !ok {
+			t.Fatalf("ticket %s not valid", ticket)
+		}
+	}
+
+	// 密钥id改成还存在的另一个密钥也不行, 只按ticket里的密钥id找密钥
+	forged := strings.Replace(newV2, "v2.new.", "v2.0.", 1)
+	if ok, _ := checkTicket(forged, testUserAgent, testUserIp, "fetch"); ok {
+		t.Fatalf("ticket %s valid with another key id", forged)
+	}
+}
+
+func TestTicketMalformed(t *testing.T) {
+	config := setTestConfig(t, map[string]string{"ticket_format": "v2"})
+	v2 := generateTicket(testUserAgent, testUserIp, 30)
+	v1 := generateTicketV1(config.TicketKeys["0"], testUserAgent, testUserIp, 30)
+	encoded := strings.TrimPrefix(v2, "v2.0.")
+
+	tests := []struct {
+		name   string
+		ticket string
+	}{
+		{"empty", ""},
+		{"v2 prefix only", "v2."},
+		{"v2 without payload", "v2.0"},
+		{"v2 empty payload", "v2.0."},
+		{"v2 truncated payload", v2[:len(v2)-4]},
+		{"v2 payload one byte short", "v2.0." + base64.RawURLEncoding.EncodeToString(mustDecodeBase64(t, encoded)[:ticketV2PayloadLen+31])},
+		{"v2 payload one byte long", "v2.0." + base64.RawURLEncoding.EncodeToString(append(mustDecodeBase64(t, encoded), 0))},
+		{"v2 garbage base64", "v2.0.!!!!not*base64$$$"},
+		{"v2 extra part", v2 + ".x"},
+		{"v2 unknown key id", "v2.nokey." + encoded},
+		{"v2 flipped checksum", "v2.0." + base64.RawURLEncoding.EncodeToString(flipLastByte(mustDecodeBase64(t, encoded)))},
+		{"v1 truncated", v1[:85]},
+		{"v1 not digits", "x" + v1[1:]},
+		{"v1 checksum not hex", v1[:17] + strings.Repeat("z", 64) + v1[81:]},
+		{"v1 ttl not digits", v1[:82] + "abc" + v1[85:]},
+		{"v1 flipped checksum", v1[:17] + flipHex(v1[17:81]) + v1[81:]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ok, ttl := checkTicket(test.ticket, testUserAgent, testUserIp, "fetch"); ok || ttl != 0 {
+				t.Fatalf("checkTicket(%q) = %v, %d, want false, 0", test.ticket, ok, ttl)
+			}
+		})
+	}
+}
+
+func mustDecodeBase64(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func flipLastByte(b []byte) []byte {
+	b[len(b)-1] ^= 1
+	return b
+}
+
+func flipHex(s string) string {
+	if s[0] == '0' {
+		return "1" + s[1:]
+	}
+	return "0" + s[1:]
+}